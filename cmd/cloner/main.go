@@ -20,6 +20,7 @@ var cli struct {
 	Clone     clone.Clone     `cmd:"" help:"Best effort copy of databases"`
 	Checksum  clone.Checksum  `cmd:"" help:"Find differences between databases"`
 	Replicate clone.Replicate `cmd:"" help:"Replicate from one database to another and consistent clone"`
+	Cutover   clone.Cutover   `cmd:"" help:"Fence the source, wait for the target to catch up and record the position to reverse replication from"`
 	Ping      clone.Ping      `cmd:"" help:"Ping the databases to check the config is right"`
 
 	MetricsPort int `help:"Which port to publish metrics and debugging info to" default:"9102"`
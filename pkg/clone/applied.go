@@ -0,0 +1,153 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	appliedTransactionsSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_applied_transactions_skipped",
+			Help: "How many transactions were skipped after a restart since parallel replication had already applied them after the checkpoint",
+		},
+		[]string{"task"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(appliedTransactionsSkipped)
+}
+
+// binlogPosition identifies a transaction by the binlog position at its end, the pieces of a large transaction split
+// with --split-large-transactions are identified by their position and their piece number
+type binlogPosition struct {
+	file     string
+	position uint32
+	piece    int
+}
+
+func appliedPosition(transaction Transaction) binlogPosition {
+	return binlogPosition{
+		file:     transaction.FinalPosition.File,
+		position: transaction.FinalPosition.Position,
+		piece:    transaction.Piece,
+	}
+}
+
+// appliedTransactions skips the transactions parallel replication applied after the last checkpoint before a restart.
+// The transactions of a set are applied in parallel and the checkpoint is only written once the whole set has been
+// applied, so each transaction records its position in --applied-table in its own target transaction and the
+// checkpoint transaction of the set deletes them again. The pieces of a large transaction can be applied by different
+// sequences in any order, so each piece is recorded on its own and skipped on its own.
+type appliedTransactions struct {
+	positions map[binlogPosition]struct{}
+}
+
+// skip returns true for a transaction or a piece of a large transaction that has already been applied
+func (a *appliedTransactions) skip(transaction Transaction) bool {
+	if a == nil || len(a.positions) == 0 {
+		return false
+	}
+	key := appliedPosition(transaction)
+	if _, ok := a.positions[key]; ok {
+		delete(a.positions, key)
+		return true
+	}
+	return false
+}
+
+func (w *TransactionWriter) createAppliedTable(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, w.config.WriteTimeout)
+	defer cancel()
+	stmt := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			task     VARCHAR(255) NOT NULL,
+			file     VARCHAR(255) NOT NULL,
+			position BIGINT(20)   NOT NULL,
+			piece    INT          NOT NULL,
+			PRIMARY KEY (task, file, position, piece)
+		)
+		`, "`"+w.config.AppliedTable+"`")
+	_, err := w.target.ExecContext(timeoutCtx, stmt)
+	if err != nil {
+		return errors.Wrapf(err, "could not create applied table in target database:\n%s", stmt)
+	}
+	return nil
+}
+
+// readAppliedTransactions reads the transactions applied after the last checkpoint
+func (w *TransactionWriter) readAppliedTransactions(ctx context.Context) (*appliedTransactions, error) {
+	rows, err := w.target.QueryContext(ctx,
+		fmt.Sprintf("SELECT file, position, piece FROM %s WHERE task = ?", "`"+w.config.AppliedTable+"`"),
+		w.config.TaskName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	applied := &appliedTransactions{positions: make(map[binlogPosition]struct{})}
+	for rows.Next() {
+		var key binlogPosition
+		err = rows.Scan(&key.file, &key.position, &key.piece)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		applied.positions[key] = struct{}{}
+	}
+	if len(applied.positions) > 0 {
+		logrus.WithContext(ctx).WithField("task", "replicate").
+			Infof("%d transactions were applied after the checkpoint, skipping them", len(applied.positions))
+	}
+	return applied, errors.WithStack(rows.Err())
+}
+
+// recordApplied records that a transaction or a piece of a large transaction has been applied in the target transaction
+// that applies it
+func (w *TransactionWriter) recordApplied(ctx context.Context, tx *sql.Tx, transaction Transaction) error {
+	_, err := tx.ExecContext(ctx,
+		fmt.Sprintf("REPLACE INTO %s (task, file, position, piece) VALUES (?, ?, ?, ?)", "`"+w.config.AppliedTable+"`"),
+		w.config.TaskName, transaction.FinalPosition.File, transaction.FinalPosition.Position, transaction.Piece)
+	return errors.WithStack(err)
+}
+
+// deleteAppliedWith has the checkpoint of the set delete the record of a transaction, the records of the pieces of a
+// large transaction are deleted with its last piece
+func (w *TransactionWriter) deleteAppliedWith(set *transactionSet, transaction Transaction) {
+	position := appliedPosition(transaction)
+	if transaction.Partial {
+		w.pieces = append(w.pieces, position)
+		return
+	}
+	set.applied = append(set.applied, w.pieces...)
+	set.applied = append(set.applied, position)
+	w.pieces = nil
+}
+
+// deleteApplied deletes the records of the transactions of a set in the transaction that writes its checkpoint
+func (w *TransactionWriter) deleteApplied(ctx context.Context, tx *sql.Tx, positions []binlogPosition) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	var stmt strings.Builder
+	args := make([]interface{}, 0, 1+3*len(positions))
+	args = append(args, w.config.TaskName)
+	stmt.WriteString("DELETE FROM `")
+	stmt.WriteString(w.config.AppliedTable)
+	stmt.WriteString("` WHERE task = ? AND (file, position, piece) IN (")
+	for i, position := range positions {
+		if i > 0 {
+			stmt.WriteString(",")
+		}
+		stmt.WriteString("(?,?,?)")
+		args = append(args, position.file, position.position, position.piece)
+	}
+	stmt.WriteString(")")
+	_, err := tx.ExecContext(ctx, stmt.String(), args...)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,89 @@
+package clone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFillTransactionSetSkipsAppliedTransactions(t *testing.T) {
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	transaction := func(position uint32, piece int, partial bool) Transaction {
+		return Transaction{
+			Mutations:     []Mutation{{Type: Insert, Table: table, Rows: [][]interface{}{{int64(position)}}}},
+			FinalPosition: Position{File: "mysql-bin.000001", Position: position},
+			Partial:       partial,
+			Piece:         piece,
+		}
+	}
+
+	writer := &TransactionWriter{
+		config: Replicate{
+			TaskName:                        "test",
+			SplitLargeTransactions:          true,
+			ParallelTransactionBatchMaxSize: 100,
+			ParallelTransactionBatchTimeout: 100 * time.Millisecond,
+		},
+		applied: &appliedTransactions{positions: map[binlogPosition]struct{}{
+			{file: "mysql-bin.000001", position: 200}:           {},
+			{file: "mysql-bin.000001", position: 200, piece: 2}: {},
+			{file: "mysql-bin.000001", position: 400, piece: 3}: {},
+		}},
+	}
+	transactions := make(chan Transaction, 10)
+	transactions <- transaction(100, 0, false)
+	transactions <- transaction(200, 0, false)
+	// The pieces of a large transaction have the position before it, each of them is skipped on its own since they
+	// could have been applied in any order
+	transactions <- transaction(200, 1, true)
+	transactions <- transaction(200, 2, true)
+	transactions <- transaction(400, 3, false)
+	transactions <- transaction(300, 0, false)
+	set, err := writer.fillTransactionSet(context.Background(), transactions)
+	require.NoError(t, err)
+
+	var applied []binlogPosition
+	for _, sequence := range set.sequences {
+		for _, transaction := range sequence.transactions {
+			applied = append(applied, appliedPosition(transaction.transaction))
+		}
+	}
+	assert.ElementsMatch(t, []binlogPosition{
+		{file: "mysql-bin.000001", position: 100},
+		{file: "mysql-bin.000001", position: 200, piece: 1},
+		{file: "mysql-bin.000001", position: 300},
+	}, applied)
+	assert.Equal(t, uint32(300), set.finalPosition.Position)
+	// The checkpoint of the set deletes the records of the skipped transactions as well
+	assert.ElementsMatch(t, []binlogPosition{
+		{file: "mysql-bin.000001", position: 100},
+		{file: "mysql-bin.000001", position: 200},
+		{file: "mysql-bin.000001", position: 200, piece: 1},
+		{file: "mysql-bin.000001", position: 200, piece: 2},
+		{file: "mysql-bin.000001", position: 400, piece: 3},
+		{file: "mysql-bin.000001", position: 300},
+	}, set.applied)
+	assert.Empty(t, writer.applied.positions)
+
+	// The checkpoint of a set that ends with a piece is before the large transaction, the records of its pieces are
+	// only deleted by the checkpoint after the last piece
+	transactions <- transaction(300, 1, true)
+	set, err = writer.fillTransactionSet(context.Background(), transactions)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), set.ordinal)
+	assert.Empty(t, set.applied)
+
+	transactions <- transaction(300, 2, true)
+	transactions <- transaction(500, 3, false)
+	set, err = writer.fillTransactionSet(context.Background(), transactions)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), set.ordinal)
+	assert.Equal(t, []binlogPosition{
+		{file: "mysql-bin.000001", position: 300, piece: 1},
+		{file: "mysql-bin.000001", position: 300, piece: 2},
+		{file: "mysql-bin.000001", position: 500, piece: 3},
+	}, set.applied)
+}
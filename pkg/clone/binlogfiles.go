@@ -0,0 +1,317 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// binlogFileHeaderSize is the size of the magic number at the start of every binlog file, the first event starts after
+const binlogFileHeaderSize = 4
+
+// BinlogEventStreamer is implemented by both replication.BinlogStreamer and BinlogFileStreamer
+type BinlogEventStreamer interface {
+	GetEvent(ctx context.Context) (*replication.BinlogEvent, error)
+}
+
+// BinlogFileStreamer reads binlog events from the binlog files in a directory using a replication.BinlogParser instead
+// of streaming them from a server. It starts at a file and position, or at the first file skipping the transactions
+// already in the GTID set, and then follows the files: when it reaches the end of the newest file it waits for more
+// events to be written or for the next file to appear.
+//
+// The events look the same as the events from a replication.BinlogSyncer: a fake RotateEvent is emitted at the start
+// of every file and the XIDEvents have the GTID set executed so far.
+type BinlogFileStreamer struct {
+	dir          string
+	pollInterval time.Duration
+	parser       *replication.BinlogParser
+
+	// gset is the GTID set executed so far, nil if the binlogs don't have GTIDs
+	gset mysql.GTIDSet
+	// skipping is true while we skip a transaction that was already executed
+	skipping bool
+
+	events chan *replication.BinlogEvent
+	errs   chan error
+	cancel context.CancelFunc
+}
+
+// NewBinlogFileStreamer starts reading binlog files in the background
+func NewBinlogFileStreamer(ctx context.Context, dir string, pollInterval time.Duration, position Position) (*BinlogFileStreamer, error) {
+	parser := replication.NewBinlogParser()
+	parser.SetFlavor(mysql.MySQLFlavor)
+	parser.SetTimestampStringLocation(time.UTC)
+
+	s := &BinlogFileStreamer{
+		dir:          dir,
+		pollInterval: pollInterval,
+		parser:       parser,
+		events:       make(chan *replication.BinlogEvent, 1024),
+		errs:         make(chan error, 1),
+	}
+	if position.Gset != nil {
+		s.gset = position.Gset.Clone()
+	}
+
+	file := position.File
+	offset := int64(position.Position)
+	if file == "" {
+		files, err := listBinlogFiles(dir, "")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(files) == 0 {
+			return nil, errors.Errorf("no binlog files found in %s", dir)
+		}
+		file = files[0]
+		offset = binlogFileHeaderSize
+	}
+	if offset < binlogFileHeaderSize {
+		offset = binlogFileHeaderSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	go func() {
+		err := s.run(ctx, file, offset)
+		if err != nil {
+			s.errs <- err
+		}
+	}()
+	return s, nil
+}
+
+// GetEvent returns the next event, blocking until there is one
+func (s *BinlogFileStreamer) GetEvent(ctx context.Context) (*replication.BinlogEvent, error) {
+	select {
+	case event := <-s.events:
+		return event, nil
+	case err := <-s.errs:
+		return nil, errors.WithStack(err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *BinlogFileStreamer) Close() {
+	s.cancel()
+}
+
+func (s *BinlogFileStreamer) run(ctx context.Context, file string, offset int64) error {
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+	for {
+		logger.Infof("reading binlog file %s from position %d", file, offset)
+		err := s.emit(ctx, &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.ROTATE_EVENT},
+			Event:  &replication.RotateEvent{Position: uint64(offset), NextLogName: []byte(file)},
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		next, err := s.readFile(ctx, file, offset)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		file, offset = next, binlogFileHeaderSize
+	}
+}
+
+// readFile reads a file until the end, waiting for more events until there is a next file, and returns the next file
+func (s *BinlogFileStreamer) readFile(ctx context.Context, file string, offset int64) (string, error) {
+	var nextFile string
+	for {
+		err := s.parser.ParseFile(filepath.Join(s.dir, file), offset, func(e *replication.BinlogEvent) error {
+			if format, ok := e.Event.(*replication.FormatDescriptionEvent); ok {
+				// The table map events of MariaDB are parsed differently, every file starts with the server version
+				s.parser.SetFlavor(versionFlavor(string(format.ServerVersion)))
+			}
+			if e.Header.LogPos > 0 && int64(e.Header.LogPos) <= offset {
+				// The format description event is parsed again each time we continue reading a file
+				return nil
+			}
+			if rotate, ok := e.Event.(*replication.RotateEvent); ok {
+				nextFile = string(rotate.NextLogName)
+			}
+			err := s.handle(ctx, e)
+			if err != nil {
+				return err
+			}
+			if e.Header.LogPos > 0 {
+				offset = int64(e.Header.LogPos)
+			}
+			return nil
+		})
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if nextFile != "" {
+			return nextFile, nil
+		}
+		// The server may have crashed without writing a rotate event, if there is a newer file we continue there
+		newer, listErr := listBinlogFiles(s.dir, file)
+		if listErr != nil {
+			return "", errors.WithStack(listErr)
+		}
+		if len(newer) > 0 {
+			if err != nil {
+				return "", errors.Wrapf(err, "could not read %s", file)
+			}
+			return newer[0], nil
+		}
+		if err != nil {
+			// Most likely the last event is still being written, we try again from the last complete event
+			logrus.WithError(err).Debugf("could not read the end of %s, retrying", file)
+		}
+		select {
+		case <-time.After(s.pollInterval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// handle tracks the executed GTID set like the replication.BinlogSyncer does and skips transactions already executed
+func (s *BinlogFileStreamer) handle(ctx context.Context, e *replication.BinlogEvent) error {
+	switch event := e.Event.(type) {
+	case *replication.MariadbGTIDListEvent:
+		if s.gset == nil {
+			s.gset = mariadbGTIDListSet(event)
+		}
+	case *replication.PreviousGTIDsEvent:
+		if s.gset == nil && event.GTIDSets != "" {
+			gset, err := mysql.ParseMysqlGTIDSet(event.GTIDSets)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			s.gset = gset
+		}
+	case *replication.GTIDEvent:
+		s.skipping = false
+		if s.gset == nil {
+			break
+		}
+		gtid := fmt.Sprintf("%s:%d", formatSID(event.SID), event.GNO)
+		executed, err := mysql.ParseMysqlGTIDSet(gtid)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if s.gset.Contain(executed) {
+			s.skipping = true
+			return nil
+		}
+		err = s.gset.Update(gtid)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	case *replication.MariadbGTIDEvent:
+		s.skipping = false
+		if s.gset == nil {
+			break
+		}
+		gtid := event.GTID.String()
+		executed, err := mysql.ParseMariadbGTIDSet(gtid)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if s.gset.Contain(executed) {
+			s.skipping = true
+			return nil
+		}
+		err = s.gset.Update(gtid)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	case *replication.XIDEvent:
+		if s.skipping {
+			s.skipping = false
+			return nil
+		}
+		if s.gset != nil {
+			event.GSet = s.gset.Clone()
+		}
+	case *replication.QueryEvent:
+		if s.skipping {
+			// Single statement transactions such as DDL end with the query, multi statement transactions begin with a
+			// BEGIN query and end with an XIDEvent
+			if string(event.Query) != "BEGIN" {
+				s.skipping = false
+			}
+			return nil
+		}
+		if s.gset != nil {
+			event.GSet = s.gset.Clone()
+		}
+	default:
+	}
+	if s.skipping {
+		return nil
+	}
+	return s.emit(ctx, e)
+}
+
+func (s *BinlogFileStreamer) emit(ctx context.Context, e *replication.BinlogEvent) error {
+	select {
+	case s.events <- e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// formatSID formats the server UUID of a GTID
+func formatSID(sid []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16])
+}
+
+// listBinlogFiles lists the binlog files in a directory in order, if after is set only the files with the same base
+// name that come after it are returned. Binlog files are named <base name>.<sequence number>.
+func listBinlogFiles(dir string, after string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	afterBase, afterSeq, _ := parseBinlogFileName(after)
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		base, seq, ok := parseBinlogFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		if after != "" && (base != afterBase || seq <= afterSeq) {
+			continue
+		}
+		files = append(files, entry.Name())
+	}
+	sort.Slice(files, func(i, j int) bool {
+		_, a, _ := parseBinlogFileName(files[i])
+		_, b, _ := parseBinlogFileName(files[j])
+		return a < b
+	})
+	return files, nil
+}
+
+func parseBinlogFileName(name string) (base string, seq int64, ok bool) {
+	dot := strings.LastIndex(name, ".")
+	if dot <= 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseInt(name[dot+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:dot], seq, true
+}
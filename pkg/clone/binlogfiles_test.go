@@ -0,0 +1,233 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListBinlogFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"binlog.000010", "binlog.000002", "binlog.000009", "binlog.index", "other.000011", "notes.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "binlog.000001"), 0o755))
+
+	files, err := listBinlogFiles(dir, "binlog.000002")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"binlog.000009", "binlog.000010"}, files)
+
+	files, err = listBinlogFiles(dir, "binlog.000010")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestParseBinlogPosition(t *testing.T) {
+	file, position, err := parseBinlogPosition("mysql-bin.000003:1234")
+	require.NoError(t, err)
+	assert.Equal(t, "mysql-bin.000003", file)
+	assert.Equal(t, uint32(1234), position)
+
+	_, _, err = parseBinlogPosition("mysql-bin.000003")
+	assert.Error(t, err)
+	_, _, err = parseBinlogPosition("mysql-bin.000003:abc")
+	assert.Error(t, err)
+}
+
+func TestBinlogFileStreamerSkipsExecutedTransactions(t *testing.T) {
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562", formatSID(sid))
+
+	gset, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-2")
+	require.NoError(t, err)
+	s := &BinlogFileStreamer{
+		gset:   gset,
+		events: make(chan *replication.BinlogEvent, 100),
+	}
+	transaction := func(gno int64) []*replication.BinlogEvent {
+		return []*replication.BinlogEvent{
+			{Header: &replication.EventHeader{}, Event: &replication.GTIDEvent{SID: sid, GNO: gno}},
+			{Header: &replication.EventHeader{}, Event: &replication.QueryEvent{Query: []byte("BEGIN")}},
+			{Header: &replication.EventHeader{}, Event: &replication.RowsEvent{}},
+			{Header: &replication.EventHeader{}, Event: &replication.XIDEvent{}},
+		}
+	}
+	ctx := context.Background()
+	for gno := int64(1); gno <= 3; gno++ {
+		for _, e := range transaction(gno) {
+			require.NoError(t, s.handle(ctx, e))
+		}
+	}
+	// A DDL is a single query after the GTID
+	require.NoError(t, s.handle(ctx, &replication.BinlogEvent{Header: &replication.EventHeader{},
+		Event: &replication.GTIDEvent{SID: sid, GNO: 2}}))
+	require.NoError(t, s.handle(ctx, &replication.BinlogEvent{Header: &replication.EventHeader{},
+		Event: &replication.QueryEvent{Query: []byte("ALTER TABLE customers ADD COLUMN age INT")}}))
+	close(s.events)
+
+	var events []*replication.BinlogEvent
+	for e := range s.events {
+		events = append(events, e)
+	}
+	// Only the transaction with gno 3 is new
+	require.Len(t, events, 4)
+	xid, ok := events[3].Event.(*replication.XIDEvent)
+	require.True(t, ok)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-3", xid.GSet.String())
+	assert.False(t, s.skipping)
+}
+
+// binlogFile builds a binlog file with GTID transactions of a single query in the format written by MySQL 8 without
+// checksums
+type binlogFile struct {
+	path    string
+	buf     bytes.Buffer
+	written int
+}
+
+func newBinlogFile(dir string, name string) *binlogFile {
+	f := &binlogFile{path: filepath.Join(dir, name)}
+	f.buf.Write(replication.BinLogFileHeader)
+	body := make([]byte, 2+50+4+1)
+	binary.LittleEndian.PutUint16(body, 4)
+	copy(body[2:], "8.0.32")
+	body[2+50+4] = byte(replication.EventHeaderSize)
+	body = append(body, make([]byte, 41)...)
+	body = append(body, replication.BINLOG_CHECKSUM_ALG_OFF, 0, 0, 0, 0)
+	f.event(replication.FORMAT_DESCRIPTION_EVENT, body)
+	return f
+}
+
+// event appends an event and returns its end position
+func (f *binlogFile) event(eventType replication.EventType, body []byte) uint32 {
+	header := make([]byte, replication.EventHeaderSize)
+	size := uint32(replication.EventHeaderSize + len(body))
+	end := uint32(f.buf.Len()) + size
+	binary.LittleEndian.PutUint32(header[0:], uint32(time.Now().Unix()))
+	header[4] = byte(eventType)
+	binary.LittleEndian.PutUint32(header[5:], 1)
+	binary.LittleEndian.PutUint32(header[9:], size)
+	binary.LittleEndian.PutUint32(header[13:], end)
+	f.buf.Write(header)
+	f.buf.Write(body)
+	return end
+}
+
+func (f *binlogFile) query(query string) uint32 {
+	schema := "test"
+	body := make([]byte, 4+4+1+2+2)
+	body[8] = byte(len(schema))
+	body = append(body, schema...)
+	body = append(body, 0)
+	body = append(body, query...)
+	return f.event(replication.QUERY_EVENT, body)
+}
+
+// transaction appends a transaction and returns the position after it
+func (f *binlogFile) transaction(sid []byte, gno int64, query string) uint32 {
+	gtid := make([]byte, 1+16+8)
+	copy(gtid[1:], sid)
+	binary.LittleEndian.PutUint64(gtid[17:], uint64(gno))
+	f.event(replication.GTID_EVENT, gtid)
+	f.query("BEGIN")
+	f.query(query)
+	xid := make([]byte, 8)
+	binary.LittleEndian.PutUint64(xid, uint64(gno))
+	return f.event(replication.XID_EVENT, xid)
+}
+
+func (f *binlogFile) rotate(next string) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, binlogFileHeaderSize)
+	f.event(replication.ROTATE_EVENT, append(body, next...))
+}
+
+// flush appends what has been added since the last flush to the file
+func (f *binlogFile) flush(t *testing.T) {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Write(f.buf.Bytes()[f.written:])
+	require.NoError(t, err)
+	f.written = f.buf.Len()
+}
+
+// readTransactions reads events until n transactions have been committed and returns their queries, the rotate events
+// as file:position and the GTID set of the last commit
+func readTransactions(t *testing.T, s *BinlogFileStreamer, n int) ([]string, []string, mysql.GTIDSet) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var queries, rotates []string
+	var gset mysql.GTIDSet
+	for n > 0 {
+		e, err := s.GetEvent(ctx)
+		require.NoError(t, err)
+		switch event := e.Event.(type) {
+		case *replication.RotateEvent:
+			rotates = append(rotates, string(event.NextLogName)+":"+strconv.FormatUint(event.Position, 10))
+		case *replication.QueryEvent:
+			if string(event.Query) != "BEGIN" {
+				queries = append(queries, string(event.Query))
+			}
+		case *replication.XIDEvent:
+			gset = event.GSet
+			n--
+		}
+	}
+	return queries, rotates, gset
+}
+
+func TestBinlogFileStreamerReadsFiles(t *testing.T) {
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	dir := t.TempDir()
+	first := newBinlogFile(dir, "binlog.000001")
+	afterFirst := first.transaction(sid, 1, "INSERT INTO customers VALUES (1)")
+	first.transaction(sid, 2, "INSERT INTO customers VALUES (2)")
+	first.rotate("binlog.000002")
+	first.flush(t)
+	second := newBinlogFile(dir, "binlog.000002")
+	second.transaction(sid, 3, "INSERT INTO customers VALUES (3)")
+	second.flush(t)
+
+	ctx := context.Background()
+	s, err := NewBinlogFileStreamer(ctx, dir, 10*time.Millisecond, Position{})
+	require.NoError(t, err)
+	queries, rotates, gset := readTransactions(t, s, 3)
+	s.Close()
+	assert.Equal(t, []string{
+		"INSERT INTO customers VALUES (1)",
+		"INSERT INTO customers VALUES (2)",
+		"INSERT INTO customers VALUES (3)",
+	}, queries)
+	// The rotate event at the end of the first file is followed by the fake one of the next file
+	assert.Equal(t, []string{"binlog.000001:4", "binlog.000002:4", "binlog.000002:4"}, rotates)
+	assert.Nil(t, gset, "the files have no previous GTIDs event so the GTID set is unknown")
+
+	// Restarting in the middle of the first file continues after the transactions it has already executed
+	executed, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1")
+	require.NoError(t, err)
+	s, err = NewBinlogFileStreamer(ctx, dir, 10*time.Millisecond, Position{File: "binlog.000001", Position: afterFirst, Gset: executed})
+	require.NoError(t, err)
+	defer s.Close()
+	queries, rotates, gset = readTransactions(t, s, 2)
+	assert.Equal(t, []string{"INSERT INTO customers VALUES (2)", "INSERT INTO customers VALUES (3)"}, queries)
+	assert.Equal(t, []string{"binlog.000001:" + strconv.Itoa(int(afterFirst)), "binlog.000002:4", "binlog.000002:4"}, rotates)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-3", gset.String())
+
+	// Events written to the newest file are read as they appear
+	second.transaction(sid, 4, "INSERT INTO customers VALUES (4)")
+	second.flush(t)
+	queries, _, gset = readTransactions(t, s, 1)
+	assert.Equal(t, []string{"INSERT INTO customers VALUES (4)"}, queries)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-4", gset.String())
+}
@@ -0,0 +1,348 @@
+package clone
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// causalityIndex finds the sequences of a transactionSet that an incoming transaction is causal with. Every key
+// written by the set is in a single map keyed by the table name and a compact binary encoding of the key and in a
+// treap per table ordered by the key, and the chunks of the Repair mutations are in an interval tree per table. So the
+// work per transaction depends on the number of rows it writes (and the keys inside the chunk of a repair) rather than
+// the size of the set.
+//
+// Sequences that are merged are not re-indexed, they point to the sequence they were merged into instead, see root.
+type causalityIndex struct {
+	keys map[string]*indexedKey
+	// tableKeys orders the keys per table for Repair mutations, they are the only ones that need a range scan
+	tableKeys map[string]*keyNode
+	chunks    map[string]*chunkNode
+	buf       []byte
+}
+
+type indexedKey struct {
+	keys     []interface{}
+	sequence *transactionSequence
+}
+
+func newCausalityIndex() *causalityIndex {
+	return &causalityIndex{
+		keys:      make(map[string]*indexedKey),
+		tableKeys: make(map[string]*keyNode),
+		chunks:    make(map[string]*chunkNode),
+	}
+}
+
+// causalSequences returns the distinct sequences the transaction is causal with
+func (x *causalityIndex) causalSequences(transaction Transaction) []*transactionSequence {
+	var result []*transactionSequence
+	add := func(sequence *transactionSequence) {
+		root := sequence.root()
+		for _, r := range result {
+			if r == root {
+				return
+			}
+		}
+		result = append(result, root)
+	}
+	for _, mutation := range transaction.Mutations {
+		tableName := mutation.Table.Name
+		if mutation.Type == Repair {
+			// Chunks never overlap so we only need to check the keys
+			x.tableKeys[tableName].scan(mutation.Chunk.Start, mutation.Chunk.End, func(key *indexedKey) {
+				add(key.sequence)
+			})
+			continue
+		}
+		for _, rows := range [][][]interface{}{mutation.Before, mutation.Rows} {
+			for _, row := range rows {
+				keys := mutation.Table.KeysOfRow(row)
+				if key, ok := x.keys[x.encodeKey(tableName, keys)]; ok {
+					add(key.sequence)
+				}
+				x.chunks[tableName].stab(keys, add)
+			}
+		}
+	}
+	return result
+}
+
+// add indexes the keys and chunks of a transaction that was appended to a sequence
+func (x *causalityIndex) add(transaction Transaction, sequence *transactionSequence) {
+	for _, mutation := range transaction.Mutations {
+		tableName := mutation.Table.Name
+		if mutation.Type == Repair {
+			x.chunks[tableName] = x.chunks[tableName].insert(&chunkNode{
+				chunk:    mutation.Chunk,
+				sequence: sequence,
+				priority: rand.Uint32(),
+				maxEnd:   mutation.Chunk.End,
+			})
+			continue
+		}
+		for _, rows := range [][][]interface{}{mutation.Before, mutation.Rows} {
+			for _, row := range rows {
+				keys := mutation.Table.KeysOfRow(row)
+				encoded := x.encodeKey(tableName, keys)
+				if key, ok := x.keys[encoded]; ok {
+					key.sequence = sequence
+					continue
+				}
+				key := &indexedKey{keys: keys, sequence: sequence}
+				x.keys[encoded] = key
+				x.tableKeys[tableName] = x.tableKeys[tableName].insert(&keyNode{key: key, priority: rand.Uint32()})
+			}
+		}
+	}
+}
+
+// encodeKey encodes the table name and key values, key values that are equal encode the same
+func (x *causalityIndex) encodeKey(tableName string, keys []interface{}) string {
+	buf := append(x.buf[:0], tableName...)
+	buf = append(buf, 0)
+	for _, value := range keys {
+		buf = appendEncodedValue(buf, value)
+	}
+	x.buf = buf
+	return string(buf)
+}
+
+const (
+	encodedNil byte = iota
+	encodedInt
+	encodedUint
+	encodedFloat
+	encodedString
+	encodedTime
+	encodedOther
+)
+
+// appendEncodedValue appends a type tag and the value, integers of all sizes and signedness encode the same if they
+// have the same value and so do strings and byte slices
+func appendEncodedValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, encodedNil)
+	case int:
+		return appendEncodedInt(buf, int64(v))
+	case int8:
+		return appendEncodedInt(buf, int64(v))
+	case int16:
+		return appendEncodedInt(buf, int64(v))
+	case int32:
+		return appendEncodedInt(buf, int64(v))
+	case int64:
+		return appendEncodedInt(buf, v)
+	case uint:
+		return appendEncodedUint(buf, uint64(v))
+	case uint8:
+		return appendEncodedUint(buf, uint64(v))
+	case uint16:
+		return appendEncodedUint(buf, uint64(v))
+	case uint32:
+		return appendEncodedUint(buf, uint64(v))
+	case uint64:
+		return appendEncodedUint(buf, v)
+	case float32:
+		return binary.BigEndian.AppendUint64(append(buf, encodedFloat), math.Float64bits(float64(v)))
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, encodedFloat), math.Float64bits(v))
+	case string:
+		buf = binary.AppendUvarint(append(buf, encodedString), uint64(len(v)))
+		return append(buf, v...)
+	case []byte:
+		buf = binary.AppendUvarint(append(buf, encodedString), uint64(len(v)))
+		return append(buf, v...)
+	case time.Time:
+		return binary.BigEndian.AppendUint64(append(buf, encodedTime), uint64(v.UnixNano()))
+	default:
+		s := fmt.Sprintf("%T:%v", v, v)
+		buf = binary.AppendUvarint(append(buf, encodedOther), uint64(len(s)))
+		return append(buf, s...)
+	}
+}
+
+func appendEncodedInt(buf []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(append(buf, encodedInt), uint64(v))
+}
+
+func appendEncodedUint(buf []byte, v uint64) []byte {
+	if v <= math.MaxInt64 {
+		return appendEncodedInt(buf, int64(v))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, encodedUint), v)
+}
+
+// root returns the sequence this sequence has been merged into, compressing the path on the way
+func (s *transactionSequence) root() *transactionSequence {
+	root := s
+	for root.mergedInto != nil {
+		root = root.mergedInto
+	}
+	for s != root {
+		next := s.mergedInto
+		s.mergedInto = root
+		s = next
+	}
+	return root
+}
+
+// keyNode is a node of a treap of the keys written to a table ordered by the key
+type keyNode struct {
+	key      *indexedKey
+	priority uint32
+
+	left, right *keyNode
+}
+
+// insert inserts a node and returns the new root of the subtree, the key must not be in the subtree already
+func (n *keyNode) insert(node *keyNode) *keyNode {
+	if n == nil {
+		return node
+	}
+	if genericCompareKeys(node.key.keys, n.key.keys) < 0 {
+		n.left = n.left.insert(node)
+		if n.left.priority > n.priority {
+			left := n.left
+			n.left = left.right
+			left.right = n
+			n = left
+		}
+	} else {
+		n.right = n.right.insert(node)
+		if n.right.priority > n.priority {
+			right := n.right
+			n.right = right.left
+			right.left = n
+			n = right
+		}
+	}
+	return n
+}
+
+// scan calls fn with every key from start (inclusive) to end (exclusive) in order, a nil start or end is unbounded
+func (n *keyNode) scan(start []interface{}, end []interface{}, fn func(key *indexedKey)) {
+	if n == nil {
+		return
+	}
+	afterStart := start == nil || genericCompareKeys(n.key.keys, start) >= 0
+	beforeEnd := end == nil || genericCompareKeys(n.key.keys, end) < 0
+	if afterStart {
+		n.left.scan(start, end, fn)
+	}
+	if afterStart && beforeEnd {
+		fn(n.key)
+	}
+	if beforeEnd {
+		n.right.scan(start, end, fn)
+	}
+}
+
+// chunkNode is a node of an interval tree of the Repair chunks of a table. It's a treap ordered by the chunk start
+// where each node also holds the maximum chunk end of its subtree. A nil start or end is unbounded.
+type chunkNode struct {
+	chunk    Chunk
+	sequence *transactionSequence
+	priority uint32
+	maxEnd   []interface{}
+
+	left, right *chunkNode
+}
+
+// insert inserts a node and returns the new root of the subtree
+func (n *chunkNode) insert(node *chunkNode) *chunkNode {
+	if n == nil {
+		return node
+	}
+	if compareChunkStarts(node.chunk.Start, n.chunk.Start) < 0 {
+		n.left = n.left.insert(node)
+		if n.left.priority > n.priority {
+			n = n.rotateRight()
+		}
+	} else {
+		n.right = n.right.insert(node)
+		if n.right.priority > n.priority {
+			n = n.rotateLeft()
+		}
+	}
+	n.update()
+	return n
+}
+
+func (n *chunkNode) rotateRight() *chunkNode {
+	left := n.left
+	n.left = left.right
+	left.right = n
+	n.update()
+	left.update()
+	return left
+}
+
+func (n *chunkNode) rotateLeft() *chunkNode {
+	right := n.right
+	n.right = right.left
+	right.left = n
+	n.update()
+	right.update()
+	return right
+}
+
+func (n *chunkNode) update() {
+	n.maxEnd = n.chunk.End
+	if n.left != nil && compareChunkEnds(n.left.maxEnd, n.maxEnd) > 0 {
+		n.maxEnd = n.left.maxEnd
+	}
+	if n.right != nil && compareChunkEnds(n.right.maxEnd, n.maxEnd) > 0 {
+		n.maxEnd = n.right.maxEnd
+	}
+}
+
+// stab calls fn with the sequence of every chunk that contains the keys
+func (n *chunkNode) stab(keys []interface{}, fn func(sequence *transactionSequence)) {
+	if n == nil {
+		return
+	}
+	// Chunk ends are exclusive, if the maximum end is at or before the keys no chunk in this subtree contains them
+	if n.maxEnd != nil && genericCompareKeys(keys, n.maxEnd) >= 0 {
+		return
+	}
+	n.left.stab(keys, fn)
+	if n.chunk.ContainsKeys(keys) {
+		fn(n.sequence)
+	}
+	// Every chunk to the right starts at or after this chunk
+	if n.chunk.Start == nil || genericCompareKeys(keys, n.chunk.Start) >= 0 {
+		n.right.stab(keys, fn)
+	}
+}
+
+// compareChunkStarts compares chunk starts where nil is before everything
+func compareChunkStarts(a []interface{}, b []interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	default:
+		return genericCompareKeys(a, b)
+	}
+}
+
+// compareChunkEnds compares chunk ends where nil is after everything
+func compareChunkEnds(a []interface{}, b []interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	default:
+		return genericCompareKeys(a, b)
+	}
+}
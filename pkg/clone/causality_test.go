@@ -0,0 +1,110 @@
+package clone
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendEncodedValue(t *testing.T) {
+	encode := func(values ...interface{}) string {
+		var buf []byte
+		for _, value := range values {
+			buf = appendEncodedValue(buf, value)
+		}
+		return string(buf)
+	}
+	// Integers of different types with the same value are the same key
+	assert.Equal(t, encode(int64(5), "a"), encode(int32(5), []byte("a")))
+	assert.Equal(t, encode(uint64(5)), encode(5))
+	assert.NotEqual(t, encode(-1), encode(uint64(1<<63)))
+	assert.NotEqual(t, encode(5), encode("5"))
+	assert.NotEqual(t, encode(nil), encode(0))
+	// Lengths keep adjacent strings apart
+	assert.NotEqual(t, encode("ab", "c"), encode("a", "bc"))
+}
+
+func TestChunkTreeStab(t *testing.T) {
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	chunks := []Chunk{
+		{Table: table, Start: nil, End: []interface{}{10}},
+		{Table: table, Start: []interface{}{10}, End: []interface{}{20}},
+		{Table: table, Start: []interface{}{20}, End: []interface{}{30}},
+		{Table: table, Start: []interface{}{40}, End: nil},
+	}
+	sequences := make(map[*transactionSequence]int)
+	var root *chunkNode
+	// Insert in an order that isn't sorted by start
+	for _, i := range []int{2, 0, 3, 1} {
+		sequence := &transactionSequence{}
+		sequences[sequence] = i
+		root = root.insert(&chunkNode{chunk: chunks[i], sequence: sequence, priority: uint32(i * 7 % 4), maxEnd: chunks[i].End})
+	}
+	stab := func(key int) []int {
+		var result []int
+		root.stab([]interface{}{key}, func(sequence *transactionSequence) {
+			result = append(result, sequences[sequence])
+		})
+		return result
+	}
+	assert.Equal(t, []int{0}, stab(-100))
+	assert.Equal(t, []int{1}, stab(10))
+	assert.Equal(t, []int{1}, stab(19))
+	assert.Equal(t, []int{2}, stab(29))
+	assert.Empty(t, stab(35))
+	assert.Equal(t, []int{3}, stab(1000))
+}
+
+func TestKeyTreeScan(t *testing.T) {
+	var root *keyNode
+	// Insert in an order that isn't sorted by key
+	for i, id := range []int{30, 5, 20, 10, 40, 15} {
+		root = root.insert(&keyNode{key: &indexedKey{keys: []interface{}{id}}, priority: uint32(i * 7 % 5)})
+	}
+	scan := func(start []interface{}, end []interface{}) []interface{} {
+		var result []interface{}
+		root.scan(start, end, func(key *indexedKey) {
+			result = append(result, key.keys[0])
+		})
+		return result
+	}
+	assert.Equal(t, []interface{}{5, 10, 15, 20, 30, 40}, scan(nil, nil))
+	assert.Equal(t, []interface{}{10, 15}, scan([]interface{}{10}, []interface{}{20}))
+	assert.Equal(t, []interface{}{5, 10}, scan(nil, []interface{}{15}))
+	assert.Equal(t, []interface{}{30, 40}, scan([]interface{}{21}, nil))
+	assert.Empty(t, scan([]interface{}{41}, nil))
+}
+
+func TestCausalityIndexFollowsMerges(t *testing.T) {
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	update := func(ids ...int) Transaction {
+		var rows [][]interface{}
+		for _, id := range ids {
+			rows = append(rows, []interface{}{id, "name"})
+		}
+		return Transaction{Mutations: []Mutation{{Type: Update, Table: table, Rows: rows}}}
+	}
+	set := transactionSet{}
+	set.Append(update(1))
+	set.Append(update(2))
+	set.Append(update(1, 2))
+	assert.Len(t, set.sequences, 1)
+	// The keys of both merged sequences point to the union
+	set.Append(update(1))
+	set.Append(update(2))
+	set.Append(update(3))
+	assert.Len(t, set.sequences, 2)
+	assert.Len(t, set.sequences[0].transactions, 5)
+
+	// A repair of the chunk covering 1 and 3 merges the remaining sequences and later writes into it depend on it
+	set.Append(Transaction{Mutations: []Mutation{{
+		Type:  Repair,
+		Table: table,
+		Chunk: Chunk{Table: table, Start: []interface{}{0}, End: []interface{}{100}},
+	}}})
+	assert.Len(t, set.sequences, 1)
+	set.Append(update(50))
+	set.Append(update(100))
+	assert.Len(t, set.sequences, 2)
+	assert.Len(t, set.sequences[0].transactions, 8)
+}
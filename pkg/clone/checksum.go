@@ -165,6 +165,12 @@ func (cmd *Checksum) run(ctx context.Context) ([]Diff, error) {
 		return nil, errors.Errorf("need more parallelism")
 	}
 
+	err := cmd.StartHealthThrottler(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer cmd.Health.Stop()
+
 	// Load tables
 	// TODO in consistent clone we should diff the schema of the source with the target,
 	//      for now we just use the target schema
@@ -34,6 +34,15 @@ type Chunk struct {
 
 	// Size is the expected number of rows in the chunk
 	Size int
+
+	// request is the snapshot request the chunk is snapshotted for, nil if the snapshot wasn't requested through the
+	// request table
+	request *snapshotRequest
+}
+
+// targeted returns true for the chunks of a targeted snapshot request, they don't move the progress of a snapshot
+func (c *Chunk) targeted() bool {
+	return c.request.targeted()
 }
 
 func (c *Chunk) String() string {
@@ -129,9 +138,13 @@ type pagingStreamer struct {
 
 	table      string
 	keyColumns []string
+	// start is the first id to stream from inclusive, nil streams from the smallest id
+	start []interface{}
+	// end is the id to stream up to exclusive, nil streams up to the largest id
+	end []interface{}
 }
 
-func newPagingStreamer(conn DBReader, table *Table, pageSize int, retry RetryOptions) *pagingStreamer {
+func newPagingStreamer(conn DBReader, table *Table, pageSize int, retry RetryOptions, start []interface{}, end []interface{}) *pagingStreamer {
 	p := &pagingStreamer{
 		conn:         conn,
 		retry:        retry,
@@ -141,6 +154,8 @@ func newPagingStreamer(conn DBReader, table *Table, pageSize int, retry RetryOpt
 		currentIndex: 0,
 		keyColumns:   table.KeyColumns,
 		table:        table.Name,
+		start:        start,
+		end:          end,
 	}
 
 	return p
@@ -170,20 +185,16 @@ func (p *pagingStreamer) Next(ctx context.Context) ([]interface{}, error) {
 func (p *pagingStreamer) loadPage(ctx context.Context) ([][]interface{}, error) {
 	var result [][]interface{}
 	err := Retry(ctx, p.retry, func(ctx context.Context) error {
-		var err error
-
 		result = make([][]interface{}, 0, p.pageSize)
-		var rows *sql.Rows
+		var clauses []string
+		var params []interface{}
 		if p.first {
 			p.first = false
-			keyColumns := strings.Join(p.keyColumns, ", ")
-			stmt := fmt.Sprintf("select %s from %s order by %s limit %d",
-				keyColumns, p.table, keyColumns, p.pageSize)
-			rows, err = p.conn.QueryContext(ctx, stmt)
-			if err != nil {
-				return errors.Wrapf(err, "could not execute query: %v", stmt)
+			if p.start != nil {
+				c, ps := expandRowConstructorComparison(p.keyColumns, ">=", p.start)
+				clauses = append(clauses, c)
+				params = append(params, ps...)
 			}
-			defer rows.Close()
 		} else {
 			result = nil
 			if len(p.currentPage) == 0 {
@@ -191,16 +202,27 @@ func (p *pagingStreamer) loadPage(ctx context.Context) ([][]interface{}, error)
 				return backoff.Permanent(io.EOF)
 			}
 			lastItem := p.currentPage[len(p.currentPage)-1]
-			comparison, params := expandRowConstructorComparison(p.keyColumns, ">", lastItem)
-			keyColumns := strings.Join(p.keyColumns, ", ")
-			stmt := fmt.Sprintf("select %s from %s where %s order by %s limit %d",
-				keyColumns, p.table, comparison, keyColumns, p.pageSize)
-			rows, err = p.conn.QueryContext(ctx, stmt, params...)
-			if err != nil {
-				return errors.Wrapf(err, "could not execute query: %v", stmt)
-			}
-			defer rows.Close()
+			c, ps := expandRowConstructorComparison(p.keyColumns, ">", lastItem)
+			clauses = append(clauses, c)
+			params = append(params, ps...)
 		}
+		if p.end != nil {
+			c, ps := expandRowConstructorComparison(p.keyColumns, "<", p.end)
+			clauses = append(clauses, c)
+			params = append(params, ps...)
+		}
+		where := ""
+		if len(clauses) > 0 {
+			where = "where " + strings.Join(clauses, " and ")
+		}
+		keyColumns := strings.Join(p.keyColumns, ", ")
+		stmt := fmt.Sprintf("select %s from %s %s order by %s limit %d",
+			keyColumns, p.table, where, keyColumns, p.pageSize)
+		rows, err := p.conn.QueryContext(ctx, stmt, params...)
+		if err != nil {
+			return errors.Wrapf(err, "could not execute query: %v", stmt)
+		}
+		defer rows.Close()
 		for rows.Next() {
 			scanArgs := make([]interface{}, len(p.keyColumns))
 			for i := range scanArgs {
@@ -223,9 +245,9 @@ func (p *pagingStreamer) loadPage(ctx context.Context) ([][]interface{}, error)
 	return result, err
 }
 
-func streamIds(conn DBReader, table *Table, pageSize int, retry RetryOptions) PeekingIDStreamer {
+func streamIds(conn DBReader, table *Table, pageSize int, retry RetryOptions, start []interface{}, end []interface{}) PeekingIDStreamer {
 	return &peekingIDStreamer{
-		wrapped: newPagingStreamer(conn, table, pageSize, retry),
+		wrapped: newPagingStreamer(conn, table, pageSize, retry, start, end),
 	}
 }
 
@@ -251,6 +273,13 @@ func generateTableChunks(ctx context.Context, table *Table, source *sql.DB, retr
 
 // generateTableChunksAsync generates chunks async on the current goroutine
 func generateTableChunksAsync(ctx context.Context, table *Table, source *sql.DB, chunks chan Chunk, retry RetryOptions) error {
+	return generateTableChunksFrom(ctx, table, source, chunks, retry, nil, nil, nil)
+}
+
+// generateTableChunksFrom generates the chunks covering the ids from start inclusive to end exclusive, a nil start or
+// end is unbounded. The chunks before a non-nil start have already been processed so there is no First chunk. The
+// chunks carry the snapshot request they are generated for.
+func generateTableChunksFrom(ctx context.Context, table *Table, source *sql.DB, chunks chan Chunk, retry RetryOptions, start []interface{}, end []interface{}, request *snapshotRequest) error {
 	logger := log.WithContext(ctx).WithField("task", "chunker")
 	logger = logger.WithField("table", table.Name)
 	logger.Infof("chunking start: %s", table.Name)
@@ -258,28 +287,40 @@ func generateTableChunksAsync(ctx context.Context, table *Table, source *sql.DB,
 
 	chunkSize := table.Config.ChunkSize
 
-	ids := streamIds(source, table, chunkSize, retry)
+	ids := streamIds(source, table, chunkSize, retry, start, end)
 
 	var err error
 	currentChunkSize := 0
-	var startID []interface{}
+	startID := start
 	seq := int64(0)
 	var id []interface{}
 	hasNext := true
 	for hasNext {
 		id, hasNext, err = ids.Next(ctx)
 		if errors.Is(err, io.EOF) {
-			if startID == nil {
+			if start != nil {
+				// There are no rows left after the start, emit the chunk covering the rest of the keyspace
+				chunks <- Chunk{
+					Table:   table,
+					request: request,
+					Seq:     seq,
+					Start:   start,
+					End:     end,
+					Last:    true,
+					Size:    0,
+				}
+			} else if startID == nil {
 				// The table is empty.
 				// Emit a special chunk covering entire keyspace.
 				chunks <- Chunk{
-					Table: table,
-					Seq:   0,
-					Start: nil,
-					End:   nil,
-					First: true,
-					Last:  true,
-					Size:  0,
+					Table:   table,
+					request: request,
+					Seq:     0,
+					Start:   nil,
+					End:     end,
+					First:   true,
+					Last:    true,
+					Size:    0,
 				}
 			}
 			return nil
@@ -294,12 +335,13 @@ func generateTableChunksAsync(ctx context.Context, table *Table, source *sql.DB,
 			// This is the minimum source ID.
 			// Emit a special chunk covering items with keys smaller than minimum ID.
 			chunks <- Chunk{
-				Table: table,
-				Seq:   seq,
-				Start: nil,
-				End:   startID,
-				First: true,
-				Size:  0,
+				Table:   table,
+				request: request,
+				Seq:     seq,
+				Start:   nil,
+				End:     startID,
+				First:   true,
+				Size:    0,
 			}
 		}
 
@@ -311,11 +353,12 @@ func generateTableChunksAsync(ctx context.Context, table *Table, source *sql.DB,
 			}
 			select {
 			case chunks <- Chunk{
-				Table: table,
-				Seq:   seq,
-				Start: startID,
-				End:   nextID,
-				Size:  currentChunkSize,
+				Table:   table,
+				request: request,
+				Seq:     seq,
+				Start:   startID,
+				End:     nextID,
+				Size:    currentChunkSize,
 			}:
 			case <-ctx.Done():
 				return ctx.Err()
@@ -332,9 +375,10 @@ func generateTableChunksAsync(ctx context.Context, table *Table, source *sql.DB,
 		chunksEnqueued.WithLabelValues(table.Name).Inc()
 		select {
 		case chunks <- Chunk{
-			Table: table,
-			Seq:   seq,
-			Start: startID,
+			Table:   table,
+			request: request,
+			Seq:     seq,
+			Start:   startID,
 			// Make sure the End position is _after_ the final row by "adding one" to it
 			End:  nextChunkPosition(id),
 			Size: currentChunkSize,
@@ -346,12 +390,13 @@ func generateTableChunksAsync(ctx context.Context, table *Table, source *sql.DB,
 
 	// Emit a special chunk covering items with keys greater than maximum ID.
 	chunks <- Chunk{
-		Table: table,
-		Seq:   seq,
-		Start: nextChunkPosition(id),
-		End:   nil,
-		Last:  true,
-		Size:  0,
+		Table:   table,
+		request: request,
+		Seq:     seq,
+		Start:   nextChunkPosition(id),
+		End:     end,
+		Last:    true,
+		Size:    0,
 	}
 
 	logger.Infof("chunking done: %s (duration=%v)", table.Name, time.Since(startTime))
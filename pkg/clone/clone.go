@@ -65,6 +65,12 @@ func (cmd *Clone) run() error {
 		return errors.Errorf("need more parallelism")
 	}
 
+	err := cmd.StartHealthThrottler(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer cmd.Health.Stop()
+
 	// Load tables
 	// TODO in consistent clone we should diff the schema of the source with the target,
 	//      for now we just use the target schema
@@ -181,7 +187,7 @@ func (cmd *Clone) run() error {
 			diffs := make(chan Diff)
 
 			// TODO I think we should use a separate errgroup here
-			writer := NewWriter(cmd.WriterConfig, table, writer, writeLogger, writerLimiter)
+			writer := NewWriter(cmd.WriterConfig, table, writer, sourceReader, writeLogger, writerLimiter)
 			writer.Write(ctx, g, diffs)
 
 			reader := NewReader(
@@ -49,8 +49,16 @@ func genericCompare(a interface{}, b interface{}) (int, error) {
 		return compareInt64(a, b)
 	case int32:
 		return compareInt64(a, b)
+	case int16:
+		return compareInt64(a, b)
+	case int8:
+		return compareInt64(a, b)
 	case uint:
 		return compareUint64(a, b)
+	case uint8:
+		return compareUint64(a, b)
+	case uint16:
+		return compareUint64(a, b)
 	case uint32:
 		return compareUint64(a, b)
 	case uint64:
@@ -108,6 +116,14 @@ func compareUint64(a interface{}, b interface{}) (int, error) {
 		if b < 0 {
 			return compareInt64(a, b)
 		}
+	case int16:
+		if b < 0 {
+			return compareInt64(a, b)
+		}
+	case int8:
+		if b < 0 {
+			return compareInt64(a, b)
+		}
 	case int64:
 		if b < 0 {
 			return compareInt64(a, b)
@@ -183,6 +199,10 @@ func compareInt64(a interface{}, b interface{}) (int, error) {
 		switch b := b.(type) {
 		case uint:
 			return compareUint64(a, b)
+		case uint8:
+			return compareUint64(a, b)
+		case uint16:
+			return compareUint64(a, b)
 		case uint32:
 			return compareUint64(a, b)
 		case uint64:
@@ -206,6 +226,10 @@ func coerceInt64(value interface{}) (int64, error) {
 	switch value := value.(type) {
 	case uint:
 		return int64(value), nil
+	case uint8:
+		return int64(value), nil
+	case uint16:
+		return int64(value), nil
 	case uint32:
 		return int64(value), nil
 	case uint64:
@@ -215,6 +239,10 @@ func coerceInt64(value interface{}) (int64, error) {
 		return int64(value), nil
 	case int:
 		return int64(value), nil
+	case int8:
+		return int64(value), nil
+	case int16:
+		return int64(value), nil
 	case int32:
 		return int64(value), nil
 	case int64:
@@ -234,6 +262,16 @@ func coerceUint64(value interface{}) (uint64, error) {
 			return 0, errors.Errorf("can't coerce negative number to uint64: %+v", value)
 		}
 		return uint64(value), nil
+	case int8:
+		if value < 0 {
+			return 0, errors.Errorf("can't coerce negative number to uint64: %+v", value)
+		}
+		return uint64(value), nil
+	case int16:
+		if value < 0 {
+			return 0, errors.Errorf("can't coerce negative number to uint64: %+v", value)
+		}
+		return uint64(value), nil
 	case int32:
 		if value < 0 {
 			return 0, errors.Errorf("can't coerce negative number to uint64: %+v", value)
@@ -246,6 +284,10 @@ func coerceUint64(value interface{}) (uint64, error) {
 		return uint64(value), nil
 	case uint:
 		return uint64(value), nil
+	case uint8:
+		return uint64(value), nil
+	case uint16:
+		return uint64(value), nil
 	case uint32:
 		return uint64(value), nil
 	case uint64:
@@ -259,6 +301,8 @@ func coerceFloat64(value interface{}) (float64, error) {
 	switch value := value.(type) {
 	case float32:
 		return float64(value), nil
+	case float64:
+		return value, nil
 	default:
 		return 0, errors.Errorf("can't (yet?) coerce %v to float64: %v", reflect.TypeOf(value), value)
 	}
@@ -38,6 +38,12 @@ func TestGenericCompare(t *testing.T) {
 
 	assert.Equal(t, genericCompareOrPanic(math.MinInt, math.MinInt), 0)
 
+	// The binlog has TINYINT and SMALLINT as int8 and int16 (or uint8 and uint16 if unsigned)
+	assert.Equal(t, genericCompareOrPanic(int8(-1), int64(-1)), 0)
+	assert.Equal(t, genericCompareOrPanic(int16(300), uint64(299)), 1)
+	assert.Equal(t, genericCompareOrPanic(uint8(255), int8(-1)), 1)
+	assert.Equal(t, genericCompareOrPanic(uint16(65535), int64(65535)), 0)
+
 	_, err := genericCompare(math.MinInt, uint64(math.MaxUint64))
 	assert.Errorf(t, err, "")
 	_, err = genericCompare(uint64(math.MaxUint64), math.MinInt)
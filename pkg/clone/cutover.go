@@ -0,0 +1,506 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// Cutover fences the source, waits for the replication task to apply everything written to the source, checksums the
+// chunks replication wrote to recently and then writes a cutover record with the GTID of the target that reverse
+// replication can start from
+type Cutover struct {
+	ReaderConfig
+
+	TaskName        string `help:"The name of the replication task to cut over" default:"main"`
+	CheckpointTable string `help:"Name of the checkpoint table of the replication task on the target" optional:"" default:"_cloner_checkpoint"`
+	CutoverTable    string `help:"Name of the table on the target to write the cutover record to" optional:"" default:"_cloner_cutover"`
+	CreateTables    bool   `help:"Create the required tables if they do not exist" default:"true"`
+
+	FenceHook   string `help:"Shell command that stops writes to the source, used instead of setting super_read_only on the source (for example putting the application in maintenance mode)" optional:""`
+	UnfenceHook string `help:"Shell command that allows writes to the source again when the cutover is rolled back, required with --fence-hook" optional:""`
+
+	ConvergeTimeout       time.Duration `help:"How long to wait for the target to apply everything written to the source before rolling back" default:"5m"`
+	ConvergeCheckInterval time.Duration `help:"How often to check the checkpoint of the replication task while waiting" default:"1s"`
+
+	ChecksumWindow  time.Duration `help:"Checksum the chunks the replication task wrote to within this long before the target converged once it has, they are recorded by running the replication task with --dirty-chunk-size. 0 skips the checksum" default:"0"`
+	DirtyChunkTable string        `help:"Name of the table on the target the replication task records the chunks it writes to in" optional:"" default:"_cloner_dirty_chunk"`
+
+	Rollback bool `help:"Roll back a completed cutover: allow writes to the source again and delete the cutover record" default:"false"`
+
+	WriteTimeout time.Duration `help:"Timeout for each write" default:"30s"`
+
+	// sourceFlavor and targetFlavor are the replication flavors detected when the cutover starts
+	sourceFlavor string
+	targetFlavor string
+}
+
+// rollbackStep undoes a step of the cutover
+type rollbackStep struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// Run cuts over from source to target
+func (cmd *Cutover) Run() error {
+	var err error
+
+	start := time.Now()
+
+	err = cmd.ReaderConfig.LoadConfig()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	logrus.Infof("using config: %v", cmd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cmd.Rollback {
+		err = cmd.rollback(ctx)
+	} else {
+		err = cmd.run(ctx)
+	}
+
+	elapsed := time.Since(start)
+	logger := logrus.WithField("duration", elapsed)
+	if err != nil {
+		if stackErr, ok := err.(stackTracer); ok {
+			logger = logger.WithField("stacktrace", stackErr.StackTrace())
+		}
+		logger.WithError(err).Errorf("error: %+v", err)
+	}
+
+	return errors.WithStack(err)
+}
+
+func (cmd *Cutover) run(ctx context.Context) error {
+	if cmd.FenceHook != "" && cmd.UnfenceHook == "" {
+		return errors.Errorf("--unfence-hook is required with --fence-hook so the cutover can be rolled back")
+	}
+
+	source, err := cmd.Source.DB()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer source.Close()
+	target, err := cmd.Target.DB()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer target.Close()
+	err = cmd.detectFlavors(ctx, source, target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if cmd.CreateTables {
+		err = cmd.createCutoverTable(ctx, target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var rollbacks []rollbackStep
+	err = cmd.cutover(ctx, source, target, &rollbacks)
+	if err != nil {
+		logrus.WithField("task", "cutover").WithError(err).Errorf("cutover failed, rolling back")
+		// The context may have been cancelled but we still need to roll back
+		rollbackCtx, cancel := context.WithTimeout(context.Background(), cmd.WriteTimeout)
+		defer cancel()
+		rollbackErr := runRollbacks(rollbackCtx, rollbacks)
+		if rollbackErr != nil {
+			return errors.Wrapf(rollbackErr, "failed to roll back after cutover failed: %v", err)
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (cmd *Cutover) cutover(ctx context.Context, source *sql.DB, target *sql.DB, rollbacks *[]rollbackStep) error {
+	logger := logrus.WithContext(ctx).WithField("task", "cutover")
+
+	readOnly, superReadOnly, err := cmd.readReadOnly(ctx, source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	logger.Infof("fencing the source")
+	err = cmd.fence(ctx, source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*rollbacks = append(*rollbacks, rollbackStep{
+		name: "unfence source",
+		undo: func(ctx context.Context) error {
+			return cmd.unfence(ctx, source, readOnly, superReadOnly)
+		},
+	})
+
+	var sourceGTID string
+	err = source.QueryRowContext(ctx, "SELECT "+gtidExecutedVariable(cmd.sourceFlavor)).Scan(&sourceGTID)
+	if err != nil {
+		return errors.Wrapf(err, "could not read gtid_executed from the source")
+	}
+	logger.Infof("source fenced at gtid=%s, waiting for the target to converge", sourceGTID)
+
+	err = cmd.waitForConvergence(ctx, target, sourceGTID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if cmd.ChecksumWindow > 0 {
+		logger.Infof("target converged, checksumming the chunks written to in the last %v", cmd.ChecksumWindow)
+		err = cmd.checksum(ctx, source, target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var targetGTID string
+	err = target.QueryRowContext(ctx, "SELECT "+gtidExecutedVariable(cmd.targetFlavor)).Scan(&targetGTID)
+	if err != nil {
+		return errors.Wrapf(err, "could not read gtid_executed from the target")
+	}
+	err = cmd.writeCutoverRecord(ctx, target, sourceGTID, targetGTID, readOnly, superReadOnly)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logger.WithField("source_gtid", sourceGTID).
+		WithField("target_gtid", targetGTID).
+		Infof("cutover done, start reverse replication with --starting-gtid=%s", targetGTID)
+	return nil
+}
+
+// rollback rolls back a completed cutover using the source state saved in the cutover record
+func (cmd *Cutover) rollback(ctx context.Context) error {
+	source, err := cmd.Source.DB()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer source.Close()
+	target, err := cmd.Target.DB()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer target.Close()
+	err = cmd.detectFlavors(ctx, source, target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var readOnly, superReadOnly bool
+	row := target.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT source_read_only, source_super_read_only FROM %s WHERE task = ?", "`"+cmd.CutoverTable+"`"),
+		cmd.TaskName)
+	err = row.Scan(&readOnly, &superReadOnly)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.Errorf("there is no cutover record for task %q to roll back", cmd.TaskName)
+		}
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(runRollbacks(ctx, []rollbackStep{
+		{
+			name: "unfence source",
+			undo: func(ctx context.Context) error {
+				return cmd.unfence(ctx, source, readOnly, superReadOnly)
+			},
+		},
+		{
+			name: "delete cutover record",
+			undo: func(ctx context.Context) error {
+				_, err := target.ExecContext(ctx,
+					fmt.Sprintf("DELETE FROM %s WHERE task = ?", "`"+cmd.CutoverTable+"`"), cmd.TaskName)
+				return errors.WithStack(err)
+			},
+		},
+	}))
+}
+
+// runRollbacks undoes the steps in reverse order, it keeps going if a step fails and returns the first error
+func runRollbacks(ctx context.Context, steps []rollbackStep) error {
+	var firstErr error
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		logger := logrus.WithContext(ctx).WithField("task", "cutover")
+		logger.Infof("rolling back: %s", step.name)
+		err := step.undo(ctx)
+		if err != nil {
+			logger.WithError(err).Errorf("failed to roll back %s: %v", step.name, err)
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "failed to roll back %s", step.name)
+			}
+		}
+	}
+	return firstErr
+}
+
+// detectFlavors detects the replication flavors of the source and the target
+func (cmd *Cutover) detectFlavors(ctx context.Context, source *sql.DB, target *sql.DB) (err error) {
+	cmd.sourceFlavor, err = detectFlavor(ctx, source, cmd.Source.Flavor)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	cmd.targetFlavor, err = detectFlavor(ctx, target, cmd.Target.Flavor)
+	return errors.WithStack(err)
+}
+
+func (cmd *Cutover) readReadOnly(ctx context.Context, source *sql.DB) (readOnly bool, superReadOnly bool, err error) {
+	stmt := "SELECT @@global.read_only, @@global.super_read_only"
+	if cmd.sourceFlavor == mysql.MariaDBFlavor {
+		// MariaDB has no super_read_only
+		stmt = "SELECT @@global.read_only, 0"
+	}
+	row := source.QueryRowContext(ctx, stmt)
+	err = errors.WithStack(row.Scan(&readOnly, &superReadOnly))
+	return
+}
+
+// fence stops writes to the source using the fence hook or super_read_only (which implies read_only), MariaDB only
+// has read_only which doesn't stop users with the READ ONLY ADMIN privilege
+func (cmd *Cutover) fence(ctx context.Context, source *sql.DB) error {
+	if cmd.FenceHook != "" {
+		return errors.WithStack(cmd.runHook(ctx, cmd.FenceHook))
+	}
+	stmt := "SET GLOBAL super_read_only = ON"
+	if cmd.sourceFlavor == mysql.MariaDBFlavor {
+		stmt = "SET GLOBAL read_only = ON"
+	}
+	_, err := source.ExecContext(ctx, stmt)
+	return errors.WithStack(err)
+}
+
+// unfence restores the read_only and super_read_only of the source from before the cutover
+func (cmd *Cutover) unfence(ctx context.Context, source *sql.DB, readOnly bool, superReadOnly bool) error {
+	if cmd.UnfenceHook != "" {
+		return errors.WithStack(cmd.runHook(ctx, cmd.UnfenceHook))
+	}
+	if cmd.sourceFlavor != mysql.MariaDBFlavor {
+		// super_read_only has to be turned off before read_only and turning it on turns on read_only
+		_, err := source.ExecContext(ctx, "SET GLOBAL super_read_only = "+onOff(superReadOnly))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err := source.ExecContext(ctx, "SET GLOBAL read_only = "+onOff(readOnly))
+	return errors.WithStack(err)
+}
+
+func onOff(value bool) string {
+	if value {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// runHook runs a shell command with the task name in the CLONER_TASK environment variable
+func (cmd *Cutover) runHook(ctx context.Context, hook string) error {
+	c := exec.CommandContext(ctx, "sh", "-c", hook)
+	c.Env = append(os.Environ(), "CLONER_TASK="+cmd.TaskName)
+	output, err := c.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "hook %q failed: %s", hook, output)
+	}
+	logrus.WithContext(ctx).WithField("task", "cutover").Infof("hook %q: %s", hook, output)
+	return nil
+}
+
+// waitForConvergence waits until the source_gtid in the checkpoint of the replication task covers the source GTID set
+func (cmd *Cutover) waitForConvergence(ctx context.Context, target *sql.DB, sourceGTID string) error {
+	logger := logrus.WithContext(ctx).WithField("task", "cutover")
+	fenced, err := parseGTIDSet(sourceGTID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	timeout := time.After(cmd.ConvergeTimeout)
+	stmt := fmt.Sprintf("SELECT source_gtid FROM %s WHERE task = ?", "`"+cmd.CheckpointTable+"`")
+	for {
+		var checkpointGTID sql.NullString
+		err := target.QueryRowContext(ctx, stmt, cmd.TaskName).Scan(&checkpointGTID)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return errors.WithStack(err)
+			}
+			logger.Infof("no checkpoint for task %q yet", cmd.TaskName)
+		} else if !checkpointGTID.Valid {
+			return errors.Errorf("the checkpoint of task %q has no source_gtid, replication needs to run with GTIDs to cut over", cmd.TaskName)
+		} else {
+			applied, err := parseGTIDSet(checkpointGTID.String)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if applied.Contain(fenced) {
+				return nil
+			}
+			logger.Infof("target has applied gtid=%s, waiting for gtid=%s", applied, fenced)
+		}
+
+		select {
+		case <-time.After(cmd.ConvergeCheckInterval):
+		case <-timeout:
+			return errors.Errorf("target did not converge within %v", cmd.ConvergeTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checksum compares the chunks the replication task wrote to within --checksum-window, the source is fenced and the
+// target has converged so any diff is real
+func (cmd *Cutover) checksum(ctx context.Context, source *sql.DB, target *sql.DB) error {
+	logger := logrus.WithContext(ctx).WithField("task", "cutover")
+	chunksByTable, err := cmd.readDirtyChunks(ctx, target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(chunksByTable) == 0 {
+		logger.Warnf("no chunks were written to in the last %v, is the replication task running with --dirty-chunk-size?",
+			cmd.ChecksumWindow)
+		return nil
+	}
+	tables, err := LoadTables(ctx, cmd.ReaderConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	readLogger := NewThroughputLogger("checksum", cmd.ThroughputLoggingFrequency, 0)
+	diffsCh := make(chan Diff)
+	var diffs []Diff
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		for diff := range diffsCh {
+			diffs = append(diffs, diff)
+		}
+		return nil
+	})
+	err = func() error {
+		defer close(diffsCh)
+		readers, rctx := errgroup.WithContext(gctx)
+		readers.SetLimit(cmd.ReaderParallelism)
+		for _, table := range tables {
+			chunks, ok := chunksByTable[table.Name]
+			if !ok {
+				continue
+			}
+			delete(chunksByTable, table.Name)
+			reader := NewReader(cmd.ReaderConfig, table, readLogger, &IgnoreReplicationLagWaiter{}, source, nil, target, nil)
+			logger.Infof("checksumming %d chunks of %s", len(chunks), table.Name)
+			for _, c := range chunks {
+				chunk := c
+				chunk.Table = table
+				readers.Go(func() error {
+					if chunk.Start == nil && chunk.End == nil {
+						// The table has no single integer key column, it's compared in chunks as a whole
+						return errors.WithStack(reader.Diff(rctx, diffsCh))
+					}
+					chunkDiffs, err := reader.diffChunk(rctx, chunk)
+					if err != nil {
+						return errors.WithStack(err)
+					}
+					for _, diff := range chunkDiffs {
+						select {
+						case diffsCh <- diff:
+						case <-rctx.Done():
+							return rctx.Err()
+						}
+					}
+					return nil
+				})
+			}
+		}
+		return errors.WithStack(readers.Wait())
+	}()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = g.Wait()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for table := range chunksByTable {
+		logger.Warnf("not checksumming %s which was written to but isn't one of the tables to clone", table)
+	}
+
+	if len(diffs) > 0 {
+		checksum := Checksum{ReaderConfig: cmd.ReaderConfig}
+		checksum.reportDiffs(diffs)
+		return errors.Errorf("found %d diffs after the target converged", len(diffs))
+	}
+	return nil
+}
+
+// readDirtyChunks reads the chunks the replication task wrote to within --checksum-window by table
+func (cmd *Cutover) readDirtyChunks(ctx context.Context, target *sql.DB) (map[string][]Chunk, error) {
+	rows, err := target.QueryContext(ctx,
+		fmt.Sprintf("SELECT table_name, chunk_start, chunk_end FROM %s "+
+			"WHERE task = ? AND updated_at >= NOW() - INTERVAL ? SECOND ORDER BY table_name, chunk_start",
+			"`"+cmd.DirtyChunkTable+"`"),
+		cmd.TaskName, int64(math.Ceil(cmd.ChecksumWindow.Seconds())))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	chunksByTable := make(map[string][]Chunk)
+	for rows.Next() {
+		var tableName, start, end string
+		err = rows.Scan(&tableName, &start, &end)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var chunk Chunk
+		chunk.Start, err = decodeChunkKey(start)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		chunk.End, err = decodeChunkKey(end)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		chunksByTable[tableName] = append(chunksByTable[tableName], chunk)
+	}
+	return chunksByTable, errors.WithStack(rows.Err())
+}
+
+func (cmd *Cutover) writeCutoverRecord(ctx context.Context, target *sql.DB, sourceGTID string, targetGTID string, readOnly bool, superReadOnly bool) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, cmd.WriteTimeout)
+	defer cancel()
+	_, err := target.ExecContext(timeoutCtx,
+		fmt.Sprintf(`
+			REPLACE INTO %s (task, source_gtid, target_gtid, source_read_only, source_super_read_only, created_at)
+			VALUES (?, ?, ?, ?, ?, NOW())
+		`, "`"+cmd.CutoverTable+"`"),
+		cmd.TaskName, sourceGTID, targetGTID, readOnly, superReadOnly)
+	return errors.Wrapf(err, "could not write cutover record")
+}
+
+func (cmd *Cutover) createCutoverTable(ctx context.Context, target *sql.DB) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, cmd.WriteTimeout)
+	defer cancel()
+	stmt := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			task                   VARCHAR(255) NOT NULL,
+			source_gtid            TEXT         NOT NULL,
+			target_gtid            TEXT         NOT NULL,
+			source_read_only       TINYINT      NOT NULL,
+			source_super_read_only TINYINT      NOT NULL,
+			created_at             TIMESTAMP    NOT NULL,
+			PRIMARY KEY (task)
+		)
+		`, "`"+cmd.CutoverTable+"`")
+	_, err := target.ExecContext(timeoutCtx, stmt)
+	if err != nil {
+		return errors.Wrapf(err, "could not create cutover table in target database:\n%s", stmt)
+	}
+	return nil
+}
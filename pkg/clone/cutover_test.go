@@ -0,0 +1,132 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRollbacks(t *testing.T) {
+	var undone []string
+	step := func(name string, err error) rollbackStep {
+		return rollbackStep{
+			name: name,
+			undo: func(ctx context.Context) error {
+				undone = append(undone, name)
+				return err
+			},
+		}
+	}
+	err := runRollbacks(context.Background(), []rollbackStep{
+		step("fence", nil),
+		step("record", errors.New("boom")),
+		step("other", nil),
+	})
+	// Every step is rolled back in reverse even if one fails
+	assert.Equal(t, []string{"other", "record", "fence"}, undone)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to roll back record")
+}
+
+func TestCutoverHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.out")
+	cmd := &Cutover{TaskName: "main"}
+	require.NoError(t, cmd.runHook(context.Background(), `echo "fenced $CLONER_TASK" > `+out))
+	content, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "fenced main\n", string(content))
+
+	err = cmd.runHook(context.Background(), "echo nope >&2; exit 3")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "nope")
+}
+
+func TestCutoverFence(t *testing.T) {
+	err := startVitess()
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// We connect directly to the underlying MySQL database since vtgate can't set global variables
+	sourceConfig := DBConfig{
+		Type:     MySQL,
+		Host:     "localhost:" + vitessContainer.resource.GetPort("15002/tcp"),
+		Username: "vt_dba",
+		Password: "",
+		Database: "vt_customer_-80",
+	}
+	source, err := sourceConfig.DB()
+	require.NoError(t, err)
+	defer source.Close()
+
+	cmd := &Cutover{TaskName: "main"}
+	cmd.sourceFlavor, err = detectFlavor(ctx, source, "")
+	require.NoError(t, err)
+	readOnly, superReadOnly, err := cmd.readReadOnly(ctx, source)
+	require.NoError(t, err)
+
+	err = cmd.fence(ctx, source)
+	require.NoError(t, err)
+	fencedReadOnly, fencedSuperReadOnly, err := cmd.readReadOnly(ctx, source)
+	require.NoError(t, err)
+	assert.True(t, fencedReadOnly)
+	assert.True(t, fencedSuperReadOnly)
+
+	err = cmd.unfence(ctx, source, readOnly, superReadOnly)
+	require.NoError(t, err)
+	unfencedReadOnly, unfencedSuperReadOnly, err := cmd.readReadOnly(ctx, source)
+	require.NoError(t, err)
+	assert.Equal(t, readOnly, unfencedReadOnly)
+	assert.Equal(t, superReadOnly, unfencedSuperReadOnly)
+}
+
+func TestCutoverWaitForConvergence(t *testing.T) {
+	err := startTidb()
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	target, err := tidbContainer.Config().DB()
+	require.NoError(t, err)
+	defer target.Close()
+	cmd := &Cutover{
+		TaskName:              "cutover-test",
+		CheckpointTable:       "_cloner_checkpoint_cutover_test",
+		ConvergeTimeout:       5 * time.Second,
+		ConvergeCheckInterval: 10 * time.Millisecond,
+	}
+	_, err = target.ExecContext(ctx, "DROP TABLE IF EXISTS "+cmd.CheckpointTable)
+	require.NoError(t, err)
+	writer := &TransactionWriter{config: Replicate{CheckpointTable: cmd.CheckpointTable}, target: target}
+	writer.config.WriteTimeout = time.Minute
+	err = writer.createCheckpointTable(ctx)
+	require.NoError(t, err)
+
+	const uuid = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	checkpoint := func(gtid string) {
+		_, err := target.ExecContext(ctx,
+			fmt.Sprintf("REPLACE INTO %s (task, file, position, source_gtid, timestamp) VALUES (?, '', 0, ?, NOW())",
+				cmd.CheckpointTable), cmd.TaskName, gtid)
+		require.NoError(t, err)
+	}
+
+	// The checkpoint catches up while we wait
+	checkpoint(uuid + ":1-5")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		checkpoint(uuid + ":1-10")
+	}()
+	err = cmd.waitForConvergence(ctx, target, uuid+":1-10")
+	require.NoError(t, err)
+
+	// A checkpoint that doesn't catch up times out
+	cmd.ConvergeTimeout = 100 * time.Millisecond
+	err = cmd.waitForConvergence(ctx, target, uuid+":1-11")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "did not converge")
+}
@@ -54,6 +54,7 @@ type DBConfig struct {
 	Cert               string         `help:"Certificate file for client side authentication (PEM encoded)"`
 	Key                string         `help:"Key file for client side authentication (PEM encoded)"`
 	InsecureSkipVerify bool           `help:"Insecurely skip verifying that the certificate of the server matches the host name'"`
+	Flavor             string         `help:"Replication flavor of the server: mysql, mariadb or auto to detect it from the server version" enum:"auto,mysql,mariadb" default:"auto"`
 }
 
 type DataSourceType string
@@ -162,7 +163,105 @@ func (c *refreshPasswordConnector) Connect(ctx context.Context) (driver.Conn, er
 	return c.connector.Connect(ctx)
 }
 
+// sourceHost is the source host replication streams from, it's shared by everything that connects to the source so
+// that the watermarks, chunk reads and heartbeats follow a failover of the TransactionStream
+type sourceHost struct {
+	mutex  sync.Mutex
+	config DBConfig
+}
+
+func newSourceHost(config DBConfig) *sourceHost {
+	return &sourceHost{config: config}
+}
+
+func (h *sourceHost) get() DBConfig {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.config
+}
+
+func (h *sourceHost) set(host string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.config.Host = host
+}
+
+// DB opens a connection pool that connects to the current source host, connections to a previous source host are
+// discarded instead of being reused
+func (h *sourceHost) DB() *sql.DB {
+	return sql.OpenDB(&followingConnector{source: h})
+}
+
+// followingConnector connects to the current host of a sourceHost
+type followingConnector struct {
+	source *sourceHost
+
+	mutex     sync.Mutex
+	host      string
+	connector driver.Connector
+}
+
+func (c *followingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	config := c.source.get()
+	if c.connector == nil || c.host != config.Host {
+		connector, err := config.mysqlConnector()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.connector = connector
+		c.host = config.Host
+	}
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mysqlConn, ok := conn.(driverConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, errors.Errorf("unexpected %T connection", conn)
+	}
+	return &followingConn{driverConn: mysqlConn, source: c.source, host: c.host}, nil
+}
+
+func (c *followingConnector) Driver() driver.Driver {
+	return &mysql.MySQLDriver{}
+}
+
+// driverConn is what the connections of the MySQL driver implement
+type driverConn interface {
+	driver.Conn
+	driver.Pinger
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.NamedValueChecker
+	driver.SessionResetter
+	driver.Validator
+}
+
+// followingConn is a connection to the host the source was at when it was opened
+type followingConn struct {
+	driverConn
+	source *sourceHost
+	host   string
+}
+
+func (c *followingConn) IsValid() bool {
+	return c.host == c.source.get().Host && c.driverConn.IsValid()
+}
+
 func (c DBConfig) openMySQL() (*sql.DB, error) {
+	connector, err := c.mysqlConnector()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sql.OpenDB(connector), nil
+}
+
+func (c DBConfig) mysqlConnector() (driver.Connector, error) {
 	host := c.Host
 	abstractSocket := false
 	if strings.HasPrefix(host, "unix(@") {
@@ -210,7 +309,7 @@ func (c DBConfig) openMySQL() (*sql.DB, error) {
 			},
 		}
 	}
-	return sql.OpenDB(connector), errors.WithStack(err)
+	return connector, errors.WithStack(err)
 }
 
 func (c DBConfig) openMisk() (*sql.DB, error) {
@@ -362,6 +461,10 @@ func (c DBConfig) BinlogSyncerConfig(ctx context.Context, serverID uint32) (repl
 		return replication.BinlogSyncerConfig{},
 			errors.Errorf("can't stream binlogs from Vitess, you need to connect directly to underlying database")
 	}
+	flavor, err := c.DetectFlavor(ctx)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, errors.WithStack(err)
+	}
 	if c.MiskDatasource != "" {
 		endpoint, err := c.miskEndpoint()
 		if err != nil {
@@ -379,7 +482,7 @@ func (c DBConfig) BinlogSyncerConfig(ctx context.Context, serverID uint32) (repl
 		}
 		return replication.BinlogSyncerConfig{
 			ServerID:                serverID,
-			Flavor:                  "mysql",
+			Flavor:                  flavor,
 			Host:                    endpoint.Host,
 			Port:                    port,
 			User:                    endpoint.Username,
@@ -402,7 +505,7 @@ func (c DBConfig) BinlogSyncerConfig(ctx context.Context, serverID uint32) (repl
 		}
 		return replication.BinlogSyncerConfig{
 			ServerID:                serverID,
-			Flavor:                  "mysql",
+			Flavor:                  flavor,
 			Host:                    host,
 			Port:                    port,
 			User:                    c.Username,
@@ -250,6 +250,9 @@ func RowsEqual(sourceRow *Row, targetRow *Row) (bool, error) {
 // if this is used to copy data between databases we need to make sure they are using the same timezone
 const mysqlTimeFormat = "2006-01-02 15:04:05"
 
+// mysqlDateFormat is the format of DATE values
+const mysqlDateFormat = "2006-01-02"
+
 // readChunk reads a chunk without diffing producing only insert diffs
 func (r *Reader) readChunk(ctx context.Context, chunk Chunk) ([]Diff, error) {
 	var sizeBytes uint64
@@ -480,8 +483,12 @@ func bufferChunk(ctx context.Context, retry RetryOptions, source DBReader, from
 		}
 		return nil
 	})
+	if err != nil {
+		return result, sizeBytes, err
+	}
 
-	return result, sizeBytes, err
+	err = retry.Throttle.Wait(ctx, chunk.Table, len(result.rows), sizeBytes)
+	return result, sizeBytes, errors.WithStack(err)
 }
 
 // readChunk reads and buffers a chunk without retries
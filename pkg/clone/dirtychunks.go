@@ -0,0 +1,127 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dirtyChunk is a key range of --dirty-chunk-size replication has written to, tables without a single integer key
+// column are recorded as a whole
+type dirtyChunk struct {
+	table string
+	start int64
+	whole bool
+}
+
+// key returns the start and end of the chunk as chunk keys, nil for a whole table
+func (c dirtyChunk) key(size int64) (start []interface{}, end []interface{}) {
+	if c.whole {
+		return nil, nil
+	}
+	return []interface{}{c.start}, []interface{}{c.start + size}
+}
+
+// dirtyChunkSet collects the chunks written by the transactions up to a checkpoint, they are recorded in
+// --dirty-chunk-table in the same target transaction as the checkpoint. It's nil when dirty chunks aren't tracked.
+type dirtyChunkSet map[dirtyChunk]struct{}
+
+func (w *TransactionWriter) newDirtyChunkSet() dirtyChunkSet {
+	if w.config.DirtyChunkSize <= 0 {
+		return nil
+	}
+	return make(dirtyChunkSet)
+}
+
+// add adds the chunks the replicated rows of the transaction are in, snapshot repairs are consistent with the source
+// so they don't dirty anything
+func (d dirtyChunkSet) add(config Replicate, transaction Transaction) {
+	if d == nil {
+		return
+	}
+	for _, mutation := range transaction.Mutations {
+		if mutation.Type == Repair || config.isInternalTable(mutation.Table.Name) {
+			continue
+		}
+		table := mutation.Table
+		if len(table.KeyColumnIndexes) != 1 {
+			d[dirtyChunk{table: table.Name, whole: true}] = struct{}{}
+			continue
+		}
+		// The key of an update can't change so the after images are enough
+		for _, row := range mutation.Rows {
+			key, err := coerceInt64(row[table.KeyColumnIndexes[0]])
+			if err != nil {
+				d[dirtyChunk{table: table.Name, whole: true}] = struct{}{}
+				break
+			}
+			d[dirtyChunk{table: table.Name, start: dirtyChunkStart(key, config.DirtyChunkSize)}] = struct{}{}
+		}
+	}
+}
+
+// dirtyChunkStart rounds the key down to the start of its chunk
+func dirtyChunkStart(key int64, size int64) int64 {
+	start := key / size * size
+	if key < 0 && start != key {
+		start -= size
+	}
+	return start
+}
+
+func (w *TransactionWriter) createDirtyChunkTable(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, w.config.WriteTimeout)
+	defer cancel()
+	// chunk_start and chunk_end are encoded with encodeChunkKey, they are null for a whole table
+	stmt := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			task        VARCHAR(255) NOT NULL,
+			table_name  VARCHAR(255) NOT NULL,
+			chunk_start VARCHAR(255) NOT NULL,
+			chunk_end   VARCHAR(255) NOT NULL,
+			updated_at  TIMESTAMP    NOT NULL,
+			PRIMARY KEY (task, table_name, chunk_start)
+		)
+		`, "`"+w.config.DirtyChunkTable+"`")
+	_, err := w.target.ExecContext(timeoutCtx, stmt)
+	if err != nil {
+		return errors.Wrapf(err, "could not create dirty chunk table in target database:\n%s", stmt)
+	}
+	return nil
+}
+
+// recordDirtyChunks records the chunks in the target transaction that writes the checkpoint of the transactions that
+// wrote to them, a restart from an earlier checkpoint adds them again
+func (w *TransactionWriter) recordDirtyChunks(ctx context.Context, tx *sql.Tx, chunks dirtyChunkSet) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	var stmt strings.Builder
+	args := make([]interface{}, 0, 4*len(chunks))
+	stmt.WriteString("REPLACE INTO `")
+	stmt.WriteString(w.config.DirtyChunkTable)
+	stmt.WriteString("` (task, table_name, chunk_start, chunk_end, updated_at) VALUES ")
+	i := 0
+	for chunk := range chunks {
+		start, end := chunk.key(w.config.DirtyChunkSize)
+		encodedStart, err := encodeChunkKey(start)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		encodedEnd, err := encodeChunkKey(end)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if i > 0 {
+			stmt.WriteString(",")
+		}
+		stmt.WriteString("(?,?,?,?,NOW())")
+		args = append(args, w.config.TaskName, chunk.table, encodedStart, encodedEnd)
+		i++
+	}
+	_, err := tx.ExecContext(ctx, stmt.String(), args...)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,54 @@
+package clone
+
+import (
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirtyChunkSet(t *testing.T) {
+	customers := &Table{
+		Name:             "customers",
+		MysqlTable:       &schema.Table{Name: "customers"},
+		KeyColumns:       []string{"id"},
+		KeyColumnIndexes: []int{0},
+	}
+	transactions := &Table{
+		Name:             "transactions",
+		MysqlTable:       &schema.Table{Name: "transactions"},
+		KeyColumns:       []string{"customer_id", "id"},
+		KeyColumnIndexes: []int{1, 0},
+	}
+	heartbeat := &Table{Name: "_cloner_heartbeat", KeyColumns: []string{"task"}, KeyColumnIndexes: []int{0}}
+	config := Replicate{DirtyChunkSize: 100, HeartbeatTable: "_cloner_heartbeat"}
+	w := &TransactionWriter{config: config}
+
+	dirty := w.newDirtyChunkSet()
+	dirty.add(config, Transaction{Mutations: []Mutation{
+		{Type: Insert, Table: customers, Rows: [][]interface{}{{int64(5), "a"}, {int64(99), "b"}, {int64(100), "c"}}},
+		{Type: Update, Table: customers, Before: [][]interface{}{{int32(-1), "d"}}, Rows: [][]interface{}{{int32(-1), "e"}}},
+		{Type: Delete, Table: transactions, Rows: [][]interface{}{{int64(1), int64(5)}}},
+		{Type: Update, Table: heartbeat, Rows: [][]interface{}{{"main"}}},
+		{Type: Repair, Table: customers, Rows: [][]interface{}{{int64(1000), "f"}}},
+	}})
+	assert.Equal(t, dirtyChunkSet{
+		{table: "customers", start: 0}:       {},
+		{table: "customers", start: 100}:     {},
+		{table: "customers", start: -100}:    {},
+		{table: "transactions", whole: true}: {},
+	}, dirty)
+
+	start, end := dirtyChunk{table: "customers", start: -100}.key(config.DirtyChunkSize)
+	assert.Equal(t, []interface{}{int64(-100)}, start)
+	assert.Equal(t, []interface{}{int64(0)}, end)
+	start, end = dirtyChunk{table: "transactions", whole: true}.key(config.DirtyChunkSize)
+	assert.Nil(t, start)
+	assert.Nil(t, end)
+
+	// Nothing is tracked without --dirty-chunk-size
+	w.config.DirtyChunkSize = 0
+	dirty = w.newDirtyChunkSet()
+	dirty.add(w.config, Transaction{Mutations: []Mutation{{Type: Insert, Table: customers, Rows: [][]interface{}{{int64(5), "a"}}}}})
+	assert.Nil(t, dirty)
+}
@@ -0,0 +1,235 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// sourceProbeTimeout is how long we wait for each candidate source to answer
+const sourceProbeTimeout = 10 * time.Second
+
+var (
+	sourceFailovers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_source_failovers",
+			Help: "How many times replication switched to another of the candidate source hosts, labeled with the host it switched to",
+		},
+		[]string{"task", "host"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sourceFailovers)
+}
+
+// failsOver returns true if replication can switch to another source host
+func (cmd *Replicate) failsOver() bool {
+	return len(cmd.SourceCandidates) > 0 || cmd.SourceDiscoveryCommand != ""
+}
+
+// checkFailover refuses the options that can't follow a switch to another source host. The binlog files and positions
+// of the hosts differ, so only what's compared by GTID can continue on another host.
+func (cmd *Replicate) checkFailover() error {
+	if cmd.Source.MiskDatasource != "" || cmd.Source.Type != MySQL {
+		return errors.Errorf("--source-candidates and --source-discovery-command need a MySQL source host")
+	}
+	if cmd.RelayLogDir != "" {
+		return errors.Errorf("--source-candidates and --source-discovery-command can't be used with --relay-log-dir, " +
+			"the relay log is ordered by the binlog positions of the source")
+	}
+	if cmd.ReplicationParallelism > 1 {
+		return errors.Errorf("--source-candidates and --source-discovery-command can't be used with " +
+			"--replication-parallelism above 1, the transactions applied after the checkpoint are recorded by binlog position")
+	}
+	return nil
+}
+
+// sourceDB opens a connection pool to the source, it follows a failover to another source host
+func (cmd *Replicate) sourceDB() (*sql.DB, error) {
+	if cmd.sourceHost != nil {
+		return cmd.sourceHost.DB(), nil
+	}
+	return cmd.Source.DB()
+}
+
+// sourceStatus is what we need to know about a candidate source to decide if we can stream from it
+type sourceStatus struct {
+	readOnly          bool
+	logReplicaUpdates bool
+	executed          mysql.GTIDSet
+}
+
+// unsuitable describes why we can't continue replication from the checkpoint on a server with this status, or returns
+// an empty string if we can. The checkpoint is nil when there is nothing to continue from.
+func (s sourceStatus) unsuitable(checkpoint mysql.GTIDSet) string {
+	if s.readOnly && !s.logReplicaUpdates {
+		return "it's read only and doesn't have log_replica_updates so it doesn't write the replicated transactions to its binlogs"
+	}
+	if checkpoint != nil && (s.executed == nil || !s.executed.Contain(checkpoint)) {
+		return fmt.Sprintf("it hasn't executed the checkpoint gtid=%s, it's at gtid=%v", checkpoint, s.executed)
+	}
+	return ""
+}
+
+// failOver makes sure the source we stream from is reachable and has the transactions of the checkpoint, otherwise it
+// switches to the first suitable host of --source-candidates or the --source-discovery-command. Writable primaries are
+// preferred over replicas with log_replica_updates. We can only continue on another host by GTID.
+func (s *TransactionStream) failOver(ctx context.Context) error {
+	if !s.config.failsOver() {
+		return nil
+	}
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+
+	checkpoint, restarting, err := s.checkpointGTIDSet(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	current := s.config.Source.Host
+	candidates, err := s.sourceCandidates(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	host, err := selectSource(current, candidates, checkpoint, func(host string) (sourceStatus, error) {
+		return s.probeSource(ctx, host)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if host == current {
+		return nil
+	}
+	if checkpoint == nil && restarting {
+		return errors.Errorf("can't replicate from source %s, replication can only continue on %s by GTID "+
+			"but the checkpoint has no GTID set", current, host)
+	}
+	logger.Warnf("can't replicate from source %s, failing over to %s", current, host)
+	sourceFailovers.WithLabelValues(s.config.TaskName, host).Inc()
+	s.config.Source.Host = host
+	if s.config.sourceHost != nil {
+		s.config.sourceHost.set(host)
+	}
+	return nil
+}
+
+// selectSource returns the current host if it's suitable, otherwise the first suitable writable candidate or else the
+// first suitable candidate with log_replica_updates
+func selectSource(current string, candidates []string, checkpoint mysql.GTIDSet, probe func(host string) (sourceStatus, error)) (string, error) {
+	var problems []string
+	var replica string
+	probed := make(map[string]bool)
+	for _, host := range append([]string{current}, candidates...) {
+		if probed[host] {
+			continue
+		}
+		probed[host] = true
+		status, err := probe(host)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", host, err))
+			continue
+		}
+		if reason := status.unsuitable(checkpoint); reason != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", host, reason))
+			continue
+		}
+		if host == current || !status.readOnly {
+			return host, nil
+		}
+		if replica == "" {
+			replica = host
+		}
+	}
+	if replica != "" {
+		return replica, nil
+	}
+	return "", errors.Errorf("none of the candidate sources can be replicated from: %s", strings.Join(problems, "; "))
+}
+
+// sourceCandidates returns --source-candidates followed by the hosts printed by --source-discovery-command, one per line
+func (s *TransactionStream) sourceCandidates(ctx context.Context) ([]string, error) {
+	candidates := append([]string(nil), s.config.SourceCandidates...)
+	if s.config.SourceDiscoveryCommand == "" {
+		return candidates, nil
+	}
+	output, err := exec.CommandContext(ctx, "/bin/sh", "-c", s.config.SourceDiscoveryCommand).Output()
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if ok {
+			return nil, errors.Wrapf(err, "source discovery command failed:\n%s\n%s",
+				s.config.SourceDiscoveryCommand, string(exitErr.Stderr))
+		}
+		return nil, errors.WithStack(err)
+	}
+	return append(candidates, strings.Fields(string(output))...), nil
+}
+
+// probeSource connects to a candidate source host and reads its status
+func (s *TransactionStream) probeSource(ctx context.Context, host string) (sourceStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, sourceProbeTimeout)
+	defer cancel()
+
+	config := s.config.Source
+	config.Host = host
+	db, err := config.DB()
+	if err != nil {
+		return sourceStatus{}, errors.WithStack(err)
+	}
+	defer db.Close()
+	flavor, err := detectFlavor(ctx, db, config.Flavor)
+	if err != nil {
+		return sourceStatus{}, errors.WithStack(err)
+	}
+	return readSourceStatus(ctx, db, flavor)
+}
+
+func readSourceStatus(ctx context.Context, db *sql.DB, flavor string) (sourceStatus, error) {
+	var status sourceStatus
+	var executed string
+	// log_slave_updates is still an alias of log_replica_updates on the versions that renamed it
+	err := db.QueryRowContext(ctx, "SELECT @@GLOBAL.read_only, @@GLOBAL.log_slave_updates, "+gtidExecutedVariable(flavor)).
+		Scan(&status.readOnly, &status.logReplicaUpdates, &executed)
+	if err != nil {
+		return status, errors.WithStack(err)
+	}
+	if executed != "" {
+		status.executed, err = parseGTIDSet(executed)
+		if err != nil {
+			return status, errors.WithStack(err)
+		}
+	}
+	return status, nil
+}
+
+// checkpointGTIDSet reads the GTID set replication continues from, ok is false if there is no checkpoint yet and the
+// GTID set is nil if the checkpoint doesn't have one
+func (s *TransactionStream) checkpointGTIDSet(ctx context.Context) (gset mysql.GTIDSet, ok bool, err error) {
+	if s.relay != nil {
+		relayed, ok, err := s.relay.lastPosition()
+		if err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+		if ok {
+			return relayed.Gset, true, nil
+		}
+	}
+	_, _, executedGtidSet, err := s.sink.ReadCheckpoint(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	if executedGtidSet == "" {
+		return nil, true, nil
+	}
+	gset, err = parseGTIDSet(executedGtidSet)
+	return gset, true, errors.WithStack(err)
+}
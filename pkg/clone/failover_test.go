@@ -0,0 +1,136 @@
+package clone
+
+import (
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectSource(t *testing.T) {
+	gtids := func(value string) mysql.GTIDSet {
+		gset, err := mysql.ParseMysqlGTIDSet(value)
+		require.NoError(t, err)
+		return gset
+	}
+	checkpoint := gtids("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100")
+	caughtUp := gtids("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-120")
+	behind := gtids("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-90")
+
+	tests := []struct {
+		name     string
+		statuses map[string]sourceStatus
+		expected string
+		err      string
+	}{
+		{
+			name: "current is fine",
+			statuses: map[string]sourceStatus{
+				"old:3306": {executed: caughtUp},
+				"new:3306": {executed: caughtUp},
+			},
+			expected: "old:3306",
+		},
+		{
+			name: "current is a replica with log_replica_updates",
+			statuses: map[string]sourceStatus{
+				"old:3306": {readOnly: true, logReplicaUpdates: true, executed: caughtUp},
+				"new:3306": {executed: caughtUp},
+			},
+			expected: "old:3306",
+		},
+		{
+			name: "writable primary is preferred over a replica",
+			statuses: map[string]sourceStatus{
+				"replica:3306": {readOnly: true, logReplicaUpdates: true, executed: caughtUp},
+				"new:3306":     {executed: caughtUp},
+			},
+			expected: "new:3306",
+		},
+		{
+			name: "replica with log_replica_updates",
+			statuses: map[string]sourceStatus{
+				"replica:3306": {readOnly: true, logReplicaUpdates: true, executed: caughtUp},
+				"new:3306":     {readOnly: true, executed: caughtUp},
+			},
+			expected: "replica:3306",
+		},
+		{
+			name: "demoted primary without log_replica_updates",
+			statuses: map[string]sourceStatus{
+				"old:3306": {readOnly: true, executed: caughtUp},
+				"new:3306": {executed: caughtUp},
+			},
+			expected: "new:3306",
+		},
+		{
+			name: "candidate behind the checkpoint",
+			statuses: map[string]sourceStatus{
+				"replica:3306": {executed: behind},
+			},
+			err: "none of the candidate sources can be replicated from: old:3306: connection refused; " +
+				"replica:3306: it hasn't executed the checkpoint gtid=3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100, " +
+				"it's at gtid=3e11fa47-71ca-11e1-9e33-c80aa9429562:1-90; " +
+				"new:3306: connection refused",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var probed []string
+			host, err := selectSource("old:3306", []string{"replica:3306", "new:3306", "old:3306"}, checkpoint,
+				func(host string) (sourceStatus, error) {
+					probed = append(probed, host)
+					status, ok := test.statuses[host]
+					if !ok {
+						return sourceStatus{}, errors.New("connection refused")
+					}
+					return status, nil
+				})
+			if test.err != "" {
+				require.Error(t, err)
+				assert.Equal(t, test.err, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, host)
+			assert.NotContains(t, probed[1:], "old:3306", "each host is probed once")
+		})
+	}
+}
+
+// validConn is a connection the driver considers valid
+type validConn struct {
+	driverConn
+}
+
+func (validConn) IsValid() bool {
+	return true
+}
+
+func TestFollowingConnIsDiscardedAfterFailover(t *testing.T) {
+	source := newSourceHost(DBConfig{Type: MySQL, Host: "primary:3306"})
+	conn := &followingConn{driverConn: validConn{}, source: source, host: "primary:3306"}
+	assert.True(t, conn.IsValid())
+
+	// The pool connects to the new host instead of reusing the connection
+	source.set("replica:3306")
+	assert.False(t, conn.IsValid())
+	assert.Equal(t, "replica:3306", source.get().Host)
+}
+
+func TestCheckFailover(t *testing.T) {
+	cmd := &Replicate{SourceCandidates: []string{"replica:3306"}}
+	cmd.Source.Type = MySQL
+	cmd.ReplicationParallelism = 1
+	assert.True(t, cmd.failsOver())
+	require.NoError(t, cmd.checkFailover())
+
+	// Binlog positions of different hosts can't be compared
+	cmd.ReplicationParallelism = 10
+	assert.Error(t, cmd.checkFailover())
+	cmd.ReplicationParallelism = 1
+	cmd.RelayLogDir = "/tmp/relay"
+	assert.Error(t, cmd.checkFailover())
+}
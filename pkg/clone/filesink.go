@@ -0,0 +1,287 @@
+package clone
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// rotatedFileTimeFormat is the suffix of rotated files, it sorts in time order
+const rotatedFileTimeFormat = "20060102T150405.000000000"
+
+// FileSink appends transactions as JSON Lines to a file, one transaction per line. The last line written is the
+// checkpoint so there is no separate checkpoint to get out of sync with the file: on start up any partially written
+// line is truncated and replication continues from the position of the last complete line.
+type FileSink struct {
+	config Replicate
+	path   string
+
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+}
+
+func NewFileSink(config Replicate) (*FileSink, error) {
+	if config.SinkFile == "" {
+		return nil, errors.Errorf("--sink-file is required for the jsonl sink")
+	}
+	return &FileSink{
+		config: config,
+		path:   config.SinkFile,
+	}, nil
+}
+
+func (s *FileSink) Init(ctx context.Context) error {
+	err := os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(truncatePartialLine(s.path))
+}
+
+// ReadCheckpoint reads the position of the last line of the current file, or of the newest rotated file if the
+// current file is empty
+func (s *FileSink) ReadCheckpoint(ctx context.Context) (file string, position uint32, executedGtidSet string, err error) {
+	paths, err := s.rotatedFiles()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	paths = append(paths, s.path)
+	for i := len(paths) - 1; i >= 0; i-- {
+		var line []byte
+		line, err = readLastLine(paths[i])
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			err = errors.WithStack(err)
+			return
+		}
+		if line == nil {
+			continue
+		}
+		var t sinkTransaction
+		err = json.Unmarshal(line, &t)
+		if err != nil {
+			err = errors.Wrapf(err, "could not parse the last line of %s", paths[i])
+			return
+		}
+		if t.Task != s.config.TaskName {
+			err = errors.Errorf("%s belongs to task %q, not %q", paths[i], t.Task, s.config.TaskName)
+			return
+		}
+		return t.File, t.Position, t.SourceGTID, nil
+	}
+	err = errors.WithStack(sql.ErrNoRows)
+	return
+}
+
+func (s *FileSink) Run(ctx context.Context, b backoff.BackOff, transactions chan Transaction) error {
+	err := s.open()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer s.close()
+
+	for {
+		batch, err := nextBatch(ctx, transactions, s.config.SinkBatchSize, s.config.SinkBatchTimeout)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var written int
+		for _, transaction := range batch {
+			line, err := encodeTransaction(s.config, transaction)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if s.config.SinkFileMaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.config.SinkFileMaxSize {
+				err = s.rotate()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			n, err := s.writer.Write(line)
+			s.size += int64(n)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			written += n
+		}
+		err = s.sync()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sinkTransactionsDelivered.WithLabelValues(s.config.TaskName, SinkJSONL).Add(float64(len(batch)))
+		sinkBytesDelivered.WithLabelValues(s.config.TaskName, SinkJSONL).Add(float64(written))
+
+		// We've written a batch of transactions, we can reset the backoff
+		b.Reset()
+	}
+}
+
+func (s *FileSink) open() error {
+	// A previous run may have failed half way through a line
+	err := truncatePartialLine(s.path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.WithStack(err)
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.size = stat.Size()
+	return nil
+}
+
+func (s *FileSink) sync() error {
+	err := s.writer.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(s.file.Sync())
+}
+
+func (s *FileSink) close() {
+	if s.file == nil {
+		return
+	}
+	_ = s.sync()
+	_ = s.file.Close()
+	s.file = nil
+}
+
+// rotate renames the current file with a timestamp suffix and starts a new one
+func (s *FileSink) rotate() error {
+	err := s.sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = s.file.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.file = nil
+	rotated := s.path + "." + time.Now().UTC().Format(rotatedFileTimeFormat)
+	err = os.Rename(s.path, rotated)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logrus.WithField("task", "replicate").Infof("rotated %s to %s", s.path, rotated)
+	return errors.WithStack(s.open())
+}
+
+// rotatedFiles returns the rotated files oldest first
+func (s *FileSink) rotatedFiles() ([]string, error) {
+	matches, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var rotated []string
+	for _, match := range matches {
+		_, err := time.Parse(rotatedFileTimeFormat, strings.TrimPrefix(match, s.path+"."))
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		rotated = append(rotated, match)
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// truncatePartialLine removes anything after the last newline of the file
+func truncatePartialLine(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	newline, err := lastNewline(file, stat.Size())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if newline+1 == stat.Size() {
+		return nil
+	}
+	logrus.WithField("task", "replicate").
+		Warnf("truncating partially written line at the end of %s", path)
+	return errors.WithStack(file.Truncate(newline + 1))
+}
+
+// readLastLine returns the last line of a file that ends with a newline, without the newline, nil if the file is empty
+func readLastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	end, err := lastNewline(file, stat.Size())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if end < 0 {
+		return nil, nil
+	}
+	start, err := lastNewline(file, end)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	line := make([]byte, end-start-1)
+	_, err = file.ReadAt(line, start+1)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return line, nil
+}
+
+// lastNewline returns the offset of the last newline before end, or -1 if there is none
+func lastNewline(file *os.File, end int64) (int64, error) {
+	buf := make([]byte, 64*1024)
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := file.ReadAt(buf[:end-start], start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, errors.WithStack(err)
+		}
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] == '\n' {
+				return start + int64(i), nil
+			}
+		}
+		end = start
+	}
+	return -1, nil
+}
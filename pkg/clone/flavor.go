@@ -0,0 +1,208 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pkg/errors"
+)
+
+// DetectFlavor returns the configured replication flavor (mysql or mariadb) or detects it from the server version
+func (c DBConfig) DetectFlavor(ctx context.Context) (string, error) {
+	if c.Flavor == mysql.MySQLFlavor || c.Flavor == mysql.MariaDBFlavor {
+		return c.Flavor, nil
+	}
+	if c.Type == Vitess {
+		return mysql.MySQLFlavor, nil
+	}
+	db, err := c.DB()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer db.Close()
+	return detectFlavor(ctx, db, c.Flavor)
+}
+
+// detectFlavor is DetectFlavor for an already open connection
+func detectFlavor(ctx context.Context, db *sql.DB, configured string) (string, error) {
+	if configured == mysql.MySQLFlavor || configured == mysql.MariaDBFlavor {
+		return configured, nil
+	}
+	var version string
+	err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read the server version to detect the replication flavor")
+	}
+	return versionFlavor(version), nil
+}
+
+// versionFlavor returns the replication flavor of a server version such as 8.0.32 or 10.6.12-MariaDB-log
+func versionFlavor(version string) string {
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return mysql.MariaDBFlavor
+	}
+	return mysql.MySQLFlavor
+}
+
+// gtidExecutedVariable is the variable with the GTIDs of all the transactions in the binlogs of the server, MariaDB
+// has no gtid_executed
+func gtidExecutedVariable(flavor string) string {
+	if flavor == mysql.MariaDBFlavor {
+		return "@@GLOBAL.gtid_binlog_pos"
+	}
+	return "@@GLOBAL.gtid_executed"
+}
+
+// parseGTIDSet parses a GTID set of either flavor, MySQL GTIDs look like uuid:1-100 and MariaDB GTIDs look like
+// domain-server-sequence so we can tell them apart without asking the server
+func parseGTIDSet(value string) (mysql.GTIDSet, error) {
+	flavor := mysql.MySQLFlavor
+	if value != "" && !strings.Contains(value, ":") {
+		flavor = mysql.MariaDBFlavor
+	}
+	gset, err := mysql.ParseGTIDSet(flavor, value)
+	return gset, errors.WithStack(err)
+}
+
+// mariadbGTIDListSet converts the GTID list at the start of a MariaDB binlog file to the GTID set executed before the
+// file. The list has the last GTID of every server in every domain, the set only the last GTID of every domain.
+func mariadbGTIDListSet(event *replication.MariadbGTIDListEvent) mysql.GTIDSet {
+	gset := &mysql.MariadbGTIDSet{Sets: make(map[uint32]*mysql.MariadbGTID)}
+	for i := range event.GTIDs {
+		gtid := event.GTIDs[i]
+		last, ok := gset.Sets[gtid.DomainID]
+		if !ok || gtid.SequenceNumber > last.SequenceNumber {
+			gset.Sets[gtid.DomainID] = &gtid
+		}
+	}
+	return gset
+}
+
+// readMasterStatus reads the binlog position and executed GTID set of a server, the GTID set is empty if GTIDs are
+// disabled. MariaDB doesn't have the Executed_Gtid_Set column in SHOW MASTER STATUS.
+func readMasterStatus(ctx context.Context, db *sql.DB, flavor string) (file string, position uint32, executedGtidSet string, err error) {
+	var binlogDoDB string
+	var binlogIgnoreDB string
+	row := db.QueryRowContext(ctx, "SHOW MASTER STATUS")
+	if flavor != mysql.MariaDBFlavor {
+		err = errors.WithStack(row.Scan(&file, &position, &binlogDoDB, &binlogIgnoreDB, &executedGtidSet))
+		return
+	}
+	err = row.Scan(&file, &position, &binlogDoDB, &binlogIgnoreDB)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	err = errors.WithStack(db.QueryRowContext(ctx, "SELECT "+gtidExecutedVariable(flavor)).Scan(&executedGtidSet))
+	return
+}
+
+// convertMariaDBValues converts the values of the MariaDB INET4, INET6 and UUID columns in rows read from the binlog to
+// the text we read from a SELECT. The binlog has the binary form of INET4 and INET6 with trailing zero bytes stripped and
+// the binary form of UUID as it's stored.
+func convertMariaDBValues(table *Table, rows [][]interface{}) error {
+	if table == nil || table.MysqlTable == nil {
+		return nil
+	}
+	for i, column := range table.MysqlTable.Columns {
+		var format func(value interface{}) (string, error)
+		switch column.RawType {
+		case "inet4":
+			format = func(value interface{}) (string, error) { return formatInet(value, net.IPv4len) }
+		case "inet6":
+			format = func(value interface{}) (string, error) { return formatInet(value, net.IPv6len) }
+		case "uuid":
+			format = formatUUID
+		default:
+			continue
+		}
+		for _, row := range rows {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			formatted, err := format(row[i])
+			if err != nil {
+				return errors.Wrapf(err, "could not convert column %s.%s", table.Name, column.Name)
+			}
+			row[i] = formatted
+		}
+	}
+	return nil
+}
+
+// binaryValue returns the bytes of a binary column value read from the binlog
+func binaryValue(value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case string:
+		return []byte(value), nil
+	case []byte:
+		return value, nil
+	default:
+		return nil, errors.Errorf("unexpected %T value for a binary column: %v", value, value)
+	}
+}
+
+// formatUUID formats a MariaDB UUID value the way MariaDB does. MariaDB stores RFC 4122 UUIDs of versions 1 to 5 with
+// their segments in reverse order (node, clock sequence, time high, time mid, time low) so that they sort by time, other
+// UUIDs are stored as they are. MariaDB before 10.11.5 reverses every UUID so UUIDs that aren't RFC 4122 UUIDs written
+// by those versions are formatted with their segments in the wrong order.
+func formatUUID(value interface{}) (string, error) {
+	raw, err := binaryValue(value)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if len(raw) > 16 {
+		return "", errors.Errorf("%d byte value for a UUID column", len(raw))
+	}
+	stored := make([]byte, 16)
+	copy(stored, raw)
+	uuid := stored
+	// The variant is in the stored clock sequence and the version in the stored time high when the segments are reversed
+	if stored[6]&0x80 != 0 && stored[8] > 0 && stored[8] < 0x60 {
+		uuid = make([]byte, 0, 16)
+		uuid = append(uuid, stored[12:16]...)
+		uuid = append(uuid, stored[10:12]...)
+		uuid = append(uuid, stored[8:10]...)
+		uuid = append(uuid, stored[6:8]...)
+		uuid = append(uuid, stored[0:6]...)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+// formatInet formats a MariaDB INET4 or INET6 value the way MariaDB does
+func formatInet(value interface{}, size int) (string, error) {
+	raw, err := binaryValue(value)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if len(raw) > size {
+		return "", errors.Errorf("%d byte value for a %d byte INET column", len(raw), size)
+	}
+	ip := make(net.IP, size)
+	copy(ip, raw)
+	if size == net.IPv4len {
+		return ip.String(), nil
+	}
+	// MariaDB prints IPv4-mapped (::ffff:1.2.3.4) and IPv4-compatible (::1.2.3.4) addresses with a dotted suffix, net.IP
+	// prints the former as a plain IPv4 address and the latter in hex
+	v4 := net.IP(ip[12:])
+	zeros := true
+	for _, b := range ip[:10] {
+		if b != 0 {
+			zeros = false
+			break
+		}
+	}
+	if zeros && ip[10] == 0xff && ip[11] == 0xff {
+		return fmt.Sprintf("::ffff:%s", v4), nil
+	}
+	if zeros && ip[10] == 0 && ip[11] == 0 && (v4[0] != 0 || v4[1] != 0 || v4[2] != 0 || v4[3] > 1) {
+		return fmt.Sprintf("::%s", v4), nil
+	}
+	return ip.String(), nil
+}
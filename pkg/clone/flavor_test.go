@@ -0,0 +1,102 @@
+package clone
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	mysqlschema "github.com/go-mysql-org/go-mysql/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlavor(t *testing.T) {
+	assert.Equal(t, mysql.MySQLFlavor, versionFlavor("8.0.32"))
+	assert.Equal(t, mysql.MariaDBFlavor, versionFlavor("10.6.12-MariaDB-log"))
+	assert.Equal(t, "@@GLOBAL.gtid_executed", gtidExecutedVariable(mysql.MySQLFlavor))
+	assert.Equal(t, "@@GLOBAL.gtid_binlog_pos", gtidExecutedVariable(mysql.MariaDBFlavor))
+
+	gset, err := parseGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	require.NoError(t, err)
+	assert.IsType(t, &mysql.MysqlGTIDSet{}, gset)
+	gset, err = parseGTIDSet("0-1-100,1-2-5")
+	require.NoError(t, err)
+	assert.IsType(t, &mysql.MariadbGTIDSet{}, gset)
+	assert.True(t, gset.Contain(&mysql.MariadbGTIDSet{Sets: map[uint32]*mysql.MariadbGTID{
+		0: {DomainID: 0, ServerID: 1, SequenceNumber: 99},
+	}}))
+}
+
+func TestBinlogFileStreamerSkipsExecutedMariaDBTransactions(t *testing.T) {
+	s := &BinlogFileStreamer{events: make(chan *replication.BinlogEvent, 100)}
+	ctx := context.Background()
+	// The binlog file starts with the last GTID of every server in every domain
+	require.NoError(t, s.handle(ctx, &replication.BinlogEvent{Header: &replication.EventHeader{},
+		Event: &replication.MariadbGTIDListEvent{GTIDs: []mysql.MariadbGTID{
+			{DomainID: 0, ServerID: 2, SequenceNumber: 5},
+			{DomainID: 0, ServerID: 1, SequenceNumber: 7},
+		}}}))
+	assert.Equal(t, "0-1-7", s.gset.String())
+
+	for sequence := uint64(6); sequence <= 8; sequence++ {
+		for _, event := range []replication.Event{
+			&replication.MariadbGTIDEvent{GTID: mysql.MariadbGTID{DomainID: 0, ServerID: 1, SequenceNumber: sequence}},
+			&replication.QueryEvent{Query: []byte("BEGIN")},
+			&replication.RowsEvent{},
+			&replication.XIDEvent{},
+		} {
+			require.NoError(t, s.handle(ctx, &replication.BinlogEvent{Header: &replication.EventHeader{}, Event: event}))
+		}
+	}
+	close(s.events)
+
+	var events []*replication.BinlogEvent
+	for e := range s.events {
+		events = append(events, e)
+	}
+	// The list event and the transaction with sequence 8
+	require.Len(t, events, 5)
+	xid, ok := events[4].Event.(*replication.XIDEvent)
+	require.True(t, ok)
+	assert.Equal(t, "0-1-8", xid.GSet.String())
+}
+
+func TestConvertMariaDBValues(t *testing.T) {
+	table := &Table{
+		Name: "hosts",
+		MysqlTable: &mysqlschema.Table{
+			Name: "hosts",
+			Columns: []mysqlschema.TableColumn{
+				{Name: "id", RawType: "int"}, {Name: "v4", RawType: "inet4"}, {Name: "v6", RawType: "inet6"},
+			},
+		},
+	}
+	// The binlog strips the trailing zero bytes
+	rows := [][]interface{}{
+		{1, "\x0a\x00\x00\x01", "\x20\x01\x0d\xb8"},
+		{2, "\xc0\xa8\x01", "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01"},
+		{3, nil, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x0a\x00\x00\x01"},
+		{4, nil, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"},
+	}
+	require.NoError(t, convertMariaDBValues(table, rows))
+	assert.Equal(t, [][]interface{}{
+		{1, "10.0.0.1", "2001:db8::"},
+		{2, "192.168.1.0", "::ffff:10.0.0.1"},
+		{3, nil, "::10.0.0.1"},
+		{4, nil, "::1"},
+	}, rows)
+
+	table.MysqlTable.Columns[2].RawType = "uuid"
+	rows = [][]interface{}{
+		// A version 1 UUID is stored with its segments reversed
+		{1, nil, "\xc8\x0a\xa9\x42\x95\x62\x9e\x33\x11\xe1\x71\xca\x3e\x11\xfa\x47"},
+		// Any other UUID is stored as it is
+		{2, nil, "\x01\x23\x45\x67\x89\xab\x0d\xef\x01\x23\x45\x67\x89\xab\xcd\xef"},
+	}
+	require.NoError(t, convertMariaDBValues(table, rows))
+	assert.Equal(t, [][]interface{}{
+		{1, nil, "3e11fa47-71ca-11e1-9e33-c80aa9429562"},
+		{2, nil, "01234567-89ab-0def-0123-456789abcdef"},
+	}, rows)
+}
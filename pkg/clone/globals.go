@@ -28,6 +28,13 @@ type TableConfig struct {
 	WriteBatchSize int      `toml:"write_batch_size" help:"Global chunk size if chunk size not specified on the table"`
 	WriteTimout    duration `toml:"write_timeout" help:"Global chunk size if chunk size not specified on the table"`
 	KeyColumns     []string `toml:"keys" help:"Use these columns as a unique key for this table, defaults to primary key columns"`
+
+	SourceReadRowsPerSecond  float64 `toml:"source_read_rows_per_second" help:"Maximum rows per second read from the source for this table"`
+	SourceReadBytesPerSecond float64 `toml:"source_read_bytes_per_second" help:"Maximum bytes per second read from the source for this table"`
+	TargetReadRowsPerSecond  float64 `toml:"target_read_rows_per_second" help:"Maximum rows per second read from the target for this table"`
+	TargetReadBytesPerSecond float64 `toml:"target_read_bytes_per_second" help:"Maximum bytes per second read from the target for this table"`
+	WriteRowsPerSecond       float64 `toml:"write_rows_per_second" help:"Maximum rows per second written to the target for this table"`
+	WriteBytesPerSecond      float64 `toml:"write_bytes_per_second" help:"Maximum bytes per second written to the target for this table"`
 }
 
 type Config struct {
@@ -65,7 +72,29 @@ type ReaderConfig struct {
 
 	Tables []string `help:"Which tables to process, default is all in the source schema"`
 
+	SourceReadRowsPerSecond  float64 `help:"Maximum rows per second read from the source across all tables, 0 means unlimited (can also be set per table and adjusted at runtime via /rate-limits)" default:"0"`
+	SourceReadBytesPerSecond float64 `help:"Maximum bytes per second read from the source across all tables, 0 means unlimited" default:"0"`
+	TargetReadRowsPerSecond  float64 `help:"Maximum rows per second read from the target across all tables, 0 means unlimited" default:"0"`
+	TargetReadBytesPerSecond float64 `help:"Maximum bytes per second read from the target across all tables, 0 means unlimited" default:"0"`
+	WriteRowsPerSecond       float64 `help:"Maximum rows per second written to the target across all tables, 0 means unlimited" default:"0"`
+	WriteBytesPerSecond      float64 `help:"Maximum bytes per second written to the target across all tables, 0 means unlimited" default:"0"`
+
+	SourceMaxThreadsRunning    int           `help:"Pause reads and writes while Threads_running on the source is above this, 0 disables the check" default:"0"`
+	TargetMaxThreadsRunning    int           `help:"Pause reads and writes while Threads_running on the target is above this, 0 disables the check" default:"0"`
+	SourceMaxHistoryListLength int           `help:"Pause reads and writes while the InnoDB history list length on the source is above this, 0 disables the check" default:"0"`
+	TargetMaxHistoryListLength int           `help:"Pause reads and writes while the InnoDB history list length on the target is above this, 0 disables the check" default:"0"`
+	TargetReplicas             []string      `help:"Host:port of replicas of the target to check the replication lag of, connected to with the target credentials" optional:""`
+	TargetMaxReplicaLag        time.Duration `help:"Pause reads and writes while Seconds_Behind_Source of any of the --target-replicas is above this" default:"30s"`
+	SourceThrottleQuery        string        `help:"Custom SQL probe run on the source, reads and writes pause while it returns a value above 0" optional:""`
+	TargetThrottleQuery        string        `help:"Custom SQL probe run on the target, reads and writes pause while it returns a value above 0" optional:""`
+	HealthCheckInterval        time.Duration `help:"How often to run the server health checks" default:"1s"`
+
 	Config Config `kong:"-"`
+
+	// Throttles are created from the rate limits when the config is loaded
+	Throttles *Throttles `kong:"-"`
+	// Health is started by the commands that use the health checks, see StartHealthThrottler
+	Health *HealthThrottler `kong:"-"`
 }
 
 type WriterConfig struct {
@@ -80,6 +109,8 @@ type WriterConfig struct {
 	SaveGTIDExecuted bool `help:"During replication save the gtid_executed into the checkpoint table, useful when reversing replication" default:"false"`
 
 	NoDiff bool `help:"Clone without diffing using INSERT IGNORE can be faster as a first pass" default:"false"`
+
+	UniqueKeyConflictPolicy string `help:"What to do when a write fails on a unique secondary key: 'none' gives up on the row, 'delete' deletes the conflicting target row if it is stale (otherwise defers), 'defer' retries the row after all other batches of the table have been written" enum:"none,delete,defer" default:"none"`
 }
 
 // LoadConfig loads the ConfigFile if specified
@@ -91,6 +122,8 @@ func (c *ReaderConfig) LoadConfig() error {
 			return errors.WithStack(err)
 		}
 	}
+	c.Throttles = NewThrottles(*c)
+	activeThrottles.Store(c.Throttles)
 	return nil
 }
 
@@ -0,0 +1,195 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SnapshotModeWatermark writes low and high watermarks to the watermark table of the source around each chunk read
+	SnapshotModeWatermark = "watermark"
+	// SnapshotModeGTID reads each chunk in a consistent snapshot and places it in the binlogs by gtid_executed instead
+	// so nothing is written to the source
+	SnapshotModeGTID = "gtid"
+)
+
+// checkGTIDSnapshots checks that the snapshot reader can place consistent snapshots in the binlogs by gtid_executed
+func (s *Snapshotter) checkGTIDSnapshots(ctx context.Context) error {
+	flavor, err := detectFlavor(ctx, s.reader, s.readerFlavor())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if flavor == mysql.MariaDBFlavor {
+		return errors.Errorf("--snapshot-mode=gtid doesn't support MariaDB")
+	}
+	var gtidMode string
+	var binlogOrderCommits bool
+	err = s.reader.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_mode, @@GLOBAL.binlog_order_commits").
+		Scan(&gtidMode, &binlogOrderCommits)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if gtidMode != "ON" {
+		return errors.Errorf("--snapshot-mode=gtid needs gtid_mode=ON, it's %s", gtidMode)
+	}
+	if !binlogOrderCommits {
+		// Otherwise a transaction can show up in gtid_executed before it's visible to a consistent snapshot
+		return errors.Errorf("--snapshot-mode=gtid needs binlog_order_commits=ON")
+	}
+	return nil
+}
+
+func (s *Snapshotter) readerFlavor() string {
+	if s.reader != s.source {
+		return s.config.SnapshotReader.Flavor
+	}
+	return s.config.Source.Flavor
+}
+
+// snapshotChunkAtGTID reads a chunk without writing watermarks. The transactions the replication thread has
+// received have to be visible in the snapshot, so we first wait for them to be in gtid_executed which they are added
+// to after they're committed (with binlog_order_commits). Then the chunk is read in a consistent snapshot and we read
+// gtid_executed again, the chunk is reconciled with the transactions that aren't in the first GTID set until the
+// binlogs reach the second. A transaction that was in the snapshot but not yet in the second GTID set is written again
+// after the chunk which leaves the same rows.
+func (s *Snapshotter) snapshotChunkAtGTID(ctx context.Context, chunk Chunk) (*ChunkSnapshot, error) {
+	low, err := s.waitForReceivedGTIDs(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to snapshot %s", chunk.String())
+	}
+
+	var stream *bufferStream
+	var sizeBytes uint64
+	var high mysql.GTIDSet
+	err = Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
+		conn, err := s.reader.Conn(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() {
+			_, _ = conn.ExecContext(ctx, "ROLLBACK")
+		}()
+		high, err = readGTIDExecuted(ctx, conn)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		stream, sizeBytes, err = readChunk(ctx, conn, "source", chunk)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = s.sourceRetry.Throttle.Wait(ctx, chunk.Table, len(stream.rows), sizeBytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rows, err := readAll(stream)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	snapshot := &ChunkSnapshot{Chunk: chunk, Rows: rows, LowGset: low, Gset: high}
+	snapshot.sort()
+
+	chunksSnapshotted.WithLabelValues(s.config.TaskName, chunk.Table.Name).Inc()
+	s.readLogger.Record(chunk.Table.Name, len(rows), sizeBytes)
+	return snapshot, nil
+}
+
+// waitForReceivedGTIDs reads gtid_executed of the snapshot reader once it contains the last transaction the
+// replication thread has received
+func (s *Snapshotter) waitForReceivedGTIDs(ctx context.Context) (mysql.GTIDSet, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.SnapshotReaderTimeout)
+	defer cancel()
+	ticker := time.NewTicker(snapshotReaderPollInterval)
+	defer ticker.Stop()
+	for {
+		executed, err := readGTIDExecuted(ctx, s.reader)
+		if err == nil && (s.received.Gset == nil || executed.Contain(s.received.Gset)) {
+			return executed, nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return nil, errors.WithStack(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, errors.Errorf("gtid_executed of the snapshot reader hasn't reached gtid=%s within %v",
+					s.received.Gset, s.config.SnapshotReaderTimeout)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func readGTIDExecuted(ctx context.Context, db interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}) (mysql.GTIDSet, error) {
+	var executed string
+	err := db.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&executed)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	gset, err := mysql.ParseMysqlGTIDSet(executed)
+	return gset, errors.Wrapf(err, "could not parse gtid_executed: %s", executed)
+}
+
+// enterGTIDChunks decides which chunks read at a GTID set the transaction is reconciled with, the ones it's not in the
+// first GTID set of. The GTID set of a piece of a large transaction is the one before it so we can't tell whether the
+// transaction is in it, reconciling it again is harmless.
+func (s *Snapshotter) enterGTIDChunks(transaction Transaction) {
+	for _, chunk := range s.ongoingChunks {
+		if chunk.Gset == nil {
+			continue
+		}
+		gset := transaction.FinalPosition.Gset
+		chunk.InsideWatermarks = transaction.Partial || gset == nil || !chunk.LowGset.Contain(gset)
+	}
+}
+
+// finishGTIDChunks returns the repairs of the chunks read at a GTID set the binlogs have reached at the position
+func (s *Snapshotter) finishGTIDChunks(position Position, partial bool) []Mutation {
+	if partial || position.Gset == nil {
+		return nil
+	}
+	var repairs []Mutation
+	for _, chunk := range append([]*ChunkSnapshot(nil), s.ongoingChunks...) {
+		if chunk.Gset == nil || !position.Gset.Contain(chunk.Gset) {
+			continue
+		}
+		repairs = append(repairs, chunk.repair())
+		s.removeOngoingChunk(chunk)
+	}
+	return repairs
+}
+
+// markReceived records the position of the last transaction the replication thread has received. We don't know the
+// GTID of a large transaction until we receive its last piece, the chunks aren't read until then since the pieces
+// before it have already been written.
+func (s *Snapshotter) markReceived(transaction Transaction) {
+	s.receivingPieces = transaction.Partial
+	if transaction.Partial || transaction.FinalPosition.Gset == nil {
+		return
+	}
+	s.received = transaction.FinalPosition
+}
+
+// readyGTIDChunks returns a transaction with the repairs of the chunks the binlogs had already reached when they were
+// read, which happens when nothing has been written to the source since
+func (s *Snapshotter) readyGTIDChunks() (Transaction, bool) {
+	repairs := s.finishGTIDChunks(s.received, false)
+	if len(repairs) == 0 {
+		return Transaction{}, false
+	}
+	return Transaction{Mutations: repairs, FinalPosition: s.received}, true
+}
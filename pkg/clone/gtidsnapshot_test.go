@@ -0,0 +1,105 @@
+package clone
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGTIDChunks(t *testing.T) {
+	gtids := func(last int) mysql.GTIDSet {
+		gset, err := mysql.ParseMysqlGTIDSet(fmt.Sprintf("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-%d", last))
+		require.NoError(t, err)
+		return gset
+	}
+	table := &Table{
+		Name: "customer",
+		MysqlTable: &schema.Table{
+			Name:      "customer",
+			PKColumns: []int{0},
+			Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}},
+		},
+		KeyColumns:       []string{"id"},
+		KeyColumnIndexes: []int{0},
+	}
+	update := func(last int, partial bool, id int64, name string) Transaction {
+		return Transaction{
+			Mutations: []Mutation{{
+				Type:   Update,
+				Table:  table,
+				Before: [][]interface{}{{id, "before"}},
+				Rows:   [][]interface{}{{id, name}},
+			}},
+			FinalPosition: Position{File: "mysql-bin.000001", Position: uint32(last), Gset: gtids(last)},
+			Partial:       partial,
+		}
+	}
+	// process does what the replication thread does with a transaction
+	process := func(s *Snapshotter, transaction Transaction) Transaction {
+		s.enterGTIDChunks(transaction)
+		var mutations []Mutation
+		for _, mutation := range transaction.Mutations {
+			reconciled, err := s.reconcileOngoingChunks(mutation)
+			require.NoError(t, err)
+			mutations = append(mutations, reconciled)
+		}
+		transaction.Mutations = append(mutations, s.finishGTIDChunks(transaction.FinalPosition, transaction.Partial)...)
+		s.markReceived(transaction)
+		return transaction
+	}
+
+	s := &Snapshotter{config: Replicate{SnapshotMode: SnapshotModeGTID}}
+	process(s, update(10, false, 1, "received"))
+	_, ok := s.readyGTIDChunks()
+	assert.False(t, ok)
+
+	// The chunk was read after 1-12 had been committed and 1-14 when it was read
+	s.setOngoingChunks([]*ChunkSnapshot{{
+		Rows: []*Row{
+			{Table: table, Data: []interface{}{int64(1), "at 12"}},
+			{Table: table, Data: []interface{}{int64(2), "at 14"}},
+		},
+		Chunk:   Chunk{Table: table, Start: []interface{}{int64(0)}, End: []interface{}{int64(10)}},
+		LowGset: gtids(12),
+		Gset:    gtids(14),
+	}})
+
+	// Transactions in the first GTID set are not reconciled
+	transaction := process(s, update(12, false, 1, "at 12"))
+	assert.Len(t, transaction.Mutations, 1)
+	assert.Equal(t, "at 12", s.ongoingChunks[0].Rows[0].Data[1])
+	transaction = process(s, update(11, true, 1, "piece"))
+	assert.Len(t, transaction.Mutations, 1, "no repair is added to a piece of a large transaction")
+	assert.True(t, s.receivingPieces)
+	assert.Equal(t, "piece", s.ongoingChunks[0].Rows[0].Data[1], "pieces are always reconciled")
+	transaction = process(s, update(13, false, 1, "at 13"))
+	assert.Len(t, transaction.Mutations, 1)
+	assert.False(t, s.receivingPieces)
+	assert.Equal(t, "at 13", s.ongoingChunks[0].Rows[0].Data[1])
+
+	// The repair is written with the transaction that reaches the second GTID set
+	transaction = process(s, update(14, false, 2, "at 14"))
+	require.Len(t, transaction.Mutations, 2)
+	repair := transaction.Mutations[1]
+	assert.Equal(t, Repair, repair.Type)
+	assert.Equal(t, [][]interface{}{{int64(1), "at 13"}, {int64(2), "at 14"}}, repair.Rows)
+	assert.Empty(t, s.ongoingChunks)
+
+	// Nothing has been written to the source since the chunk was read
+	s.setOngoingChunks([]*ChunkSnapshot{{
+		Rows:    []*Row{{Table: table, Data: []interface{}{int64(1), "at 13"}}},
+		Chunk:   Chunk{Table: table, Start: []interface{}{int64(0)}, End: []interface{}{int64(10)}},
+		LowGset: gtids(14),
+		Gset:    gtids(14),
+	}})
+	ready, ok := s.readyGTIDChunks()
+	require.True(t, ok)
+	assert.Equal(t, uint32(14), ready.FinalPosition.Position)
+	require.Len(t, ready.Mutations, 1)
+	assert.Equal(t, Repair, ready.Mutations[0].Type)
+	assert.Empty(t, s.ongoingChunks)
+}
@@ -0,0 +1,425 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	serverHealth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "server_health",
+			Help: "The last value read from a server health check, partitioned by server and signal.",
+		},
+		[]string{"server", "signal"},
+	)
+	serverHealthThreshold = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "server_health_threshold",
+			Help: "The threshold above which a server health check pauses reads and writes, partitioned by server and signal.",
+		},
+		[]string{"server", "signal"},
+	)
+	healthThrottled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "health_throttled",
+			Help: "1 if reads and writes are paused because of a server health check, partitioned by server and signal.",
+		},
+		[]string{"server", "signal"},
+	)
+	healthThrottlePauses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "health_throttle_pauses",
+			Help: "How many times reads and writes were paused because of a server health check, partitioned by server and signal.",
+		},
+		[]string{"server", "signal"},
+	)
+	healthThrottleDelay = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "health_throttle_delay_duration",
+			Help:    "Duration of waiting for the servers to be healthy before a read or write.",
+			Buckets: defaultBuckets,
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(serverHealth)
+	prometheus.MustRegister(serverHealthThreshold)
+	prometheus.MustRegister(healthThrottled)
+	prometheus.MustRegister(healthThrottlePauses)
+	prometheus.MustRegister(healthThrottleDelay)
+}
+
+// healthCheck is a single signal read from a server, reads and writes pause while the value is above the threshold
+type healthCheck struct {
+	server    string
+	signal    string
+	threshold float64
+	probe     func(ctx context.Context) (float64, error)
+}
+
+func (c healthCheck) String() string {
+	return fmt.Sprintf("%s %s", c.server, c.signal)
+}
+
+// HealthThrottler pauses reads and writes while the source or target is struggling, it's a generalisation of the
+// ReplicationLagReader that checks Threads_running, the InnoDB history list length, the lag of the replicas of the
+// target and custom SQL probes
+type HealthThrottler struct {
+	interval time.Duration
+	checks   []healthCheck
+	dbs      []*sql.DB
+
+	cancelFunc context.CancelFunc
+
+	healthCond *sync.Cond
+	// unhealthy is protected by healthCond.L, it holds the failing checks and when they started failing
+	unhealthy map[string]time.Time
+}
+
+// NewHealthThrottler opens connections for the health checks configured, returns nil if none are configured
+func NewHealthThrottler(config ReaderConfig) (*HealthThrottler, error) {
+	h := newHealthThrottler(config.HealthCheckInterval, nil)
+	err := h.addServerChecks(config.Source, "source",
+		config.SourceMaxThreadsRunning, config.SourceMaxHistoryListLength, config.SourceThrottleQuery)
+	if err != nil {
+		h.close()
+		return nil, errors.WithStack(err)
+	}
+	err = h.addServerChecks(config.Target, "target",
+		config.TargetMaxThreadsRunning, config.TargetMaxHistoryListLength, config.TargetThrottleQuery)
+	if err != nil {
+		h.close()
+		return nil, errors.WithStack(err)
+	}
+	for _, host := range config.TargetReplicas {
+		// Replicas of the target are connected to directly using the target credentials
+		replicaConfig := config.Target
+		replicaConfig.Type = MySQL
+		replicaConfig.MiskDatasource = ""
+		replicaConfig.Host = host
+		db, err := h.open(replicaConfig)
+		if err != nil {
+			h.close()
+			return nil, errors.WithStack(err)
+		}
+		h.checks = append(h.checks, healthCheck{
+			server:    host,
+			signal:    "replica_lag",
+			threshold: config.TargetMaxReplicaLag.Seconds(),
+			probe: func(ctx context.Context) (float64, error) {
+				return readReplicaLag(ctx, db)
+			},
+		})
+	}
+	if len(h.checks) == 0 {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// StartHealthThrottler starts the health checks configured and stores the throttler in the config so that the readers
+// and writers created from it back off while the servers are unhealthy
+func (c *ReaderConfig) StartHealthThrottler(ctx context.Context) error {
+	health, err := NewHealthThrottler(*c)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	health.Start(ctx)
+	c.Health = health
+	return nil
+}
+
+func newHealthThrottler(interval time.Duration, checks []healthCheck) *HealthThrottler {
+	m := sync.Mutex{}
+	return &HealthThrottler{
+		interval:   interval,
+		checks:     checks,
+		healthCond: sync.NewCond(&m),
+		unhealthy:  make(map[string]time.Time),
+	}
+}
+
+func (h *HealthThrottler) addServerChecks(config DBConfig, server string, maxThreadsRunning int, maxHistoryListLength int, query string) error {
+	if maxThreadsRunning <= 0 && maxHistoryListLength <= 0 && query == "" {
+		return nil
+	}
+	db, err := h.open(config)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if maxThreadsRunning > 0 {
+		h.checks = append(h.checks, healthCheck{
+			server:    server,
+			signal:    "threads_running",
+			threshold: float64(maxThreadsRunning),
+			probe: func(ctx context.Context) (float64, error) {
+				return readThreadsRunning(ctx, db)
+			},
+		})
+	}
+	if maxHistoryListLength > 0 {
+		h.checks = append(h.checks, healthCheck{
+			server:    server,
+			signal:    "history_list_length",
+			threshold: float64(maxHistoryListLength),
+			probe: func(ctx context.Context) (float64, error) {
+				return readHistoryListLength(ctx, db)
+			},
+		})
+	}
+	if query != "" {
+		h.checks = append(h.checks, healthCheck{
+			server:    server,
+			signal:    "throttle_query",
+			threshold: 0,
+			probe: func(ctx context.Context) (float64, error) {
+				return readThrottleQuery(ctx, db, query)
+			},
+		})
+	}
+	return nil
+}
+
+func (h *HealthThrottler) open(config DBConfig) (*sql.DB, error) {
+	db, err := config.DB()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// The health checks are run serially so a single connection is enough
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(time.Minute)
+	h.dbs = append(h.dbs, db)
+	return db, nil
+}
+
+func (h *HealthThrottler) close() {
+	for _, db := range h.dbs {
+		_ = db.Close()
+	}
+}
+
+// Start checks the health once and then keeps checking in the background until Stop is called
+func (h *HealthThrottler) Start(ctx context.Context) {
+	if h == nil {
+		return
+	}
+	for _, check := range h.checks {
+		serverHealthThreshold.WithLabelValues(check.server, check.signal).Set(check.threshold)
+	}
+	ctx, cancelFunc := context.WithCancel(ctx)
+	h.cancelFunc = cancelFunc
+	h.checkAll(ctx)
+	go h.mainLoop(ctx)
+}
+
+func (h *HealthThrottler) mainLoop(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(h.interval):
+		case <-ctx.Done():
+			return
+		}
+		h.checkAll(ctx)
+	}
+}
+
+func (h *HealthThrottler) checkAll(ctx context.Context) {
+	for _, check := range h.checks {
+		value, err := h.runCheck(ctx, check)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// A check that fails to run clears the pause it caused, otherwise a broken probe would stall us forever
+			logrus.WithError(err).Warnf("failed to check %v, checking again in %v", check, h.interval)
+			h.clear(check)
+			continue
+		}
+		serverHealth.WithLabelValues(check.server, check.signal).Set(value)
+		h.update(check, value)
+	}
+}
+
+func (h *HealthThrottler) runCheck(ctx context.Context, check healthCheck) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.interval+time.Second)
+	defer cancel()
+	value, err := check.probe(ctx)
+	return value, errors.WithStack(err)
+}
+
+func (h *HealthThrottler) update(check healthCheck, value float64) {
+	h.healthCond.L.Lock()
+	defer h.healthCond.L.Unlock()
+
+	key := check.String()
+	pausedAt, wasUnhealthy := h.unhealthy[key]
+	isUnhealthy := value > check.threshold
+	if isUnhealthy && !wasUnhealthy {
+		logrus.WithField("server", check.server).
+			WithField("signal", check.signal).
+			Infof("reads and writes paused, %v is %v which is above %v, checking again in %v",
+				check, value, check.threshold, h.interval)
+		h.unhealthy[key] = time.Now()
+		healthThrottled.WithLabelValues(check.server, check.signal).Set(1)
+		healthThrottlePauses.WithLabelValues(check.server, check.signal).Inc()
+	}
+	if !isUnhealthy && wasUnhealthy {
+		logrus.WithField("server", check.server).
+			WithField("signal", check.signal).
+			Infof("reads and writes resumed, %v is %v which is below %v, paused for %v",
+				check, value, check.threshold, time.Since(pausedAt))
+		delete(h.unhealthy, key)
+		healthThrottled.WithLabelValues(check.server, check.signal).Set(0)
+	}
+	h.healthCond.Broadcast()
+}
+
+// clear forgets that the check was unhealthy, it's used when the check fails to run
+func (h *HealthThrottler) clear(check healthCheck) {
+	h.healthCond.L.Lock()
+	defer h.healthCond.L.Unlock()
+
+	key := check.String()
+	pausedAt, wasUnhealthy := h.unhealthy[key]
+	if !wasUnhealthy {
+		return
+	}
+	logrus.WithField("server", check.server).
+		WithField("signal", check.signal).
+		Warnf("reads and writes resumed, %v could not be checked, paused for %v", check, time.Since(pausedAt))
+	delete(h.unhealthy, key)
+	healthThrottled.WithLabelValues(check.server, check.signal).Set(0)
+	h.healthCond.Broadcast()
+}
+
+// IsHealthy returns true if none of the health checks are above their thresholds
+func (h *HealthThrottler) IsHealthy() bool {
+	if h == nil {
+		return true
+	}
+	h.healthCond.L.Lock()
+	defer h.healthCond.L.Unlock()
+	return len(h.unhealthy) == 0
+}
+
+// WaitForGoodLag blocks the current goroutine until all servers are healthy or the context is cancelled, it makes the
+// HealthThrottler a ReplicationLagWaiter
+func (h *HealthThrottler) WaitForGoodLag(ctx context.Context) {
+	if h.IsHealthy() {
+		return
+	}
+	timer := prometheus.NewTimer(healthThrottleDelay)
+	defer timer.ObserveDuration()
+	for {
+		if h.IsHealthy() {
+			return
+		}
+		select {
+		case <-CondWaitChan(h.healthCond):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *HealthThrottler) Stop() {
+	if h == nil {
+		return
+	}
+	if h.cancelFunc != nil {
+		h.cancelFunc()
+	}
+	h.close()
+}
+
+func readThreadsRunning(ctx context.Context, db *sql.DB) (float64, error) {
+	var name string
+	var value float64
+	err := db.QueryRowContext(ctx, "SHOW GLOBAL STATUS LIKE 'Threads_running'").Scan(&name, &value)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return value, nil
+}
+
+func readHistoryListLength(ctx context.Context, db *sql.DB) (float64, error) {
+	var value float64
+	err := db.QueryRowContext(ctx,
+		"SELECT count FROM information_schema.INNODB_METRICS WHERE name = 'trx_rseg_history_len'").Scan(&value)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return value, nil
+}
+
+func readThrottleQuery(ctx context.Context, db *sql.DB, query string) (float64, error) {
+	var value sql.NullFloat64
+	err := db.QueryRowContext(ctx, query).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, errors.WithStack(err)
+	}
+	return value.Float64, nil
+}
+
+// readReplicaLag reads Seconds_Behind_Source, falling back to SHOW SLAVE STATUS for servers older than MySQL 8.0.22
+func readReplicaLag(ctx context.Context, db *sql.DB) (float64, error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		me := mysqlError(err)
+		if me == nil || me.Number != 1064 {
+			return 0, errors.WithStack(err)
+		}
+		rows, err = db.QueryContext(ctx, "SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if !rows.Next() {
+		if rows.Err() != nil {
+			return 0, errors.WithStack(rows.Err())
+		}
+		return 0, errors.Errorf("not a replica")
+	}
+	values := make([]sql.RawBytes, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	err = rows.Scan(scanArgs...)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	for i, column := range columns {
+		if !strings.EqualFold(column, "Seconds_Behind_Source") && !strings.EqualFold(column, "Seconds_Behind_Master") {
+			continue
+		}
+		if values[i] == nil {
+			return 0, errors.Errorf("replication is not running")
+		}
+		lag, err := strconv.ParseFloat(string(values[i]), 64)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		return lag, nil
+	}
+	return 0, errors.Errorf("could not find Seconds_Behind_Source in replica status")
+}
@@ -0,0 +1,89 @@
+package clone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+)
+
+func TestHealthThrottler(t *testing.T) {
+	var nilHealth *HealthThrottler
+	assert.True(t, nilHealth.IsHealthy())
+	nilHealth.WaitForGoodLag(context.Background())
+
+	threadsRunning := atomic.NewFloat64(200)
+	health := newHealthThrottler(10*time.Millisecond, []healthCheck{
+		{
+			server:    "source",
+			signal:    "threads_running",
+			threshold: 100,
+			probe: func(ctx context.Context) (float64, error) {
+				return threadsRunning.Load(), nil
+			},
+		},
+		{
+			server:    "target",
+			signal:    "throttle_query",
+			threshold: 0,
+			probe: func(ctx context.Context) (float64, error) {
+				return 0, errors.New("broken probe")
+			},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	health.Start(ctx)
+	defer health.Stop()
+
+	// A failing probe doesn't pause anything but the threads running above the threshold does
+	assert.False(t, health.IsHealthy())
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer timeoutCancel()
+	health.WaitForGoodLag(timeoutCtx)
+	assert.Error(t, timeoutCtx.Err())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		threadsRunning.Store(10)
+	}()
+	start := time.Now()
+	health.WaitForGoodLag(ctx)
+	assert.NoError(t, ctx.Err())
+	assert.True(t, health.IsHealthy())
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestHealthThrottlerProbeFailureResumes(t *testing.T) {
+	probeErr := atomic.NewBool(false)
+	health := newHealthThrottler(10*time.Millisecond, []healthCheck{
+		{
+			server:    "source",
+			signal:    "threads_running",
+			threshold: 100,
+			probe: func(ctx context.Context) (float64, error) {
+				if probeErr.Load() {
+					return 0, errors.New("broken probe")
+				}
+				return 200, nil
+			},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	health.Start(ctx)
+	defer health.Stop()
+	assert.False(t, health.IsHealthy())
+
+	// The pause doesn't outlive the probe
+	probeErr.Store(true)
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, time.Second)
+	defer timeoutCancel()
+	health.WaitForGoodLag(timeoutCtx)
+	assert.NoError(t, timeoutCtx.Err())
+	assert.True(t, health.IsHealthy())
+}
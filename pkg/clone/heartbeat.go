@@ -49,7 +49,7 @@ func NewHeartbeat(config Replicate) (*Heartbeat, error) {
 		replicationLag: time.Hour,
 	}
 
-	source, err := r.config.Source.DB()
+	source, err := r.config.sourceDB()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -0,0 +1,115 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+)
+
+// HTTPSink posts batches of transactions to a webhook as JSON Lines, one transaction per line. The checkpoint is saved
+// to a local file after each batch is acknowledged with a 2xx response, if we crash before that the batch is posted
+// again so the receiver should de-duplicate by source_gtid or file and position.
+type HTTPSink struct {
+	config  Replicate
+	client  *http.Client
+	headers http.Header
+	retry   RetryOptions
+}
+
+func NewHTTPSink(config Replicate) (*HTTPSink, error) {
+	if config.SinkURL == "" {
+		return nil, errors.Errorf("--sink-url is required for the http sink")
+	}
+	if config.SinkCheckpointFile == "" {
+		return nil, errors.Errorf("--sink-checkpoint-file is required for the http sink")
+	}
+	_, err := url.Parse(config.SinkURL)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	headers := make(http.Header)
+	for _, header := range config.SinkHeaders {
+		split := strings.SplitN(header, "=", 2)
+		if len(split) != 2 {
+			return nil, errors.Errorf("needs to be = separated key value pair: %s", header)
+		}
+		headers.Add(split[0], split[1])
+	}
+	return &HTTPSink{
+		config:  config,
+		client:  &http.Client{},
+		headers: headers,
+		retry: RetryOptions{
+			MaxRetries: config.WriteRetries,
+			Timeout:    config.WriteTimeout,
+		},
+	}, nil
+}
+
+func (s *HTTPSink) Init(ctx context.Context) error {
+	return nil
+}
+
+func (s *HTTPSink) ReadCheckpoint(ctx context.Context) (file string, position uint32, executedGtidSet string, err error) {
+	return readCheckpointFile(s.config.SinkCheckpointFile, s.config.TaskName)
+}
+
+func (s *HTTPSink) Run(ctx context.Context, b backoff.BackOff, transactions chan Transaction) error {
+	for {
+		batch, err := nextBatch(ctx, transactions, s.config.SinkBatchSize, s.config.SinkBatchTimeout)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var body bytes.Buffer
+		for _, transaction := range batch {
+			line, err := encodeTransaction(s.config, transaction)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			body.Write(line)
+		}
+		err = Retry(ctx, s.retry, func(ctx context.Context) error {
+			return s.post(ctx, body.Bytes())
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = writeCheckpointFile(s.config.SinkCheckpointFile, s.config.TaskName, batch[len(batch)-1].FinalPosition)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sinkTransactionsDelivered.WithLabelValues(s.config.TaskName, SinkHTTP).Add(float64(len(batch)))
+		sinkBytesDelivered.WithLabelValues(s.config.TaskName, SinkHTTP).Add(float64(body.Len()))
+
+		// We've delivered a batch of transactions, we can reset the backoff
+		b.Reset()
+	}
+}
+
+func (s *HTTPSink) post(ctx context.Context, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.SinkURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for name, values := range s.headers {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	response, err := s.client.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return errors.Errorf("%s responded with %s: %s", s.config.SinkURL, response.Status, message)
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	return nil
+}
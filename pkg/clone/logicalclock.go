@@ -0,0 +1,129 @@
+package clone
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ParallelApplyKeys finds the dependencies between transactions by comparing the keys of the rows they write
+	ParallelApplyKeys = "keys"
+	// ParallelApplyLogicalClock schedules transactions from the logical clock MySQL writes to each GTID event
+	ParallelApplyLogicalClock = "logical-clock"
+)
+
+var (
+	replicationParallelismEstimate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replication_parallelism_estimate",
+			Help: "The size of the last batch of transactions divided by its longest chain of dependent transactions, partitioned by the scheduler that found the dependencies. With --parallel-apply-compare both schedulers are measured.",
+		},
+		[]string{"task", "scheduler"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(replicationParallelismEstimate)
+}
+
+// LogicalClock is the last_committed and sequence_number that MySQL writes to the GTID event of each transaction. A
+// transaction can be applied once every transaction with a sequence_number up to its last_committed has been applied.
+// With binlog_transaction_dependency_tracking=WRITESET last_committed is computed from the keys (including unique
+// secondary keys) that the transactions write. The values restart in each binlog file.
+type LogicalClock struct {
+	File           string
+	LastCommitted  int64
+	SequenceNumber int64
+}
+
+func (c LogicalClock) valid() bool {
+	return c.SequenceNumber > 0
+}
+
+// appendByLogicalClock adds a transaction as a sequence of its own that waits for the sequences of the transactions it
+// depends on. Transactions without a logical clock, in a new binlog file or with snapshot repairs (which the source
+// knows nothing about) are barriers that depend on every transaction before them and every transaction after them
+// depends on them.
+func (s *transactionSet) appendByLogicalClock(transaction orderedTransaction) {
+	sequence := &transactionSequence{
+		writer: s.writer,
+		clock:  transaction.transaction.LogicalClock,
+	}
+	sequence.Append(transaction)
+
+	clock := sequence.clock
+	newFile := s.clockFile != "" && s.clockFile != clock.File
+	if !clock.valid() || hasRepair(transaction.transaction) || newFile {
+		if s.barrier != nil {
+			sequence.dependOn(s.barrier)
+		}
+		for _, seq := range s.sinceBarrier {
+			sequence.dependOn(seq)
+		}
+		s.barrier = sequence
+		s.sinceBarrier = nil
+	} else {
+		if s.barrier != nil {
+			sequence.dependOn(s.barrier)
+		}
+		for _, seq := range s.sinceBarrier {
+			if seq.clock.File == clock.File && seq.clock.SequenceNumber <= clock.LastCommitted {
+				sequence.dependOn(seq)
+			}
+		}
+		s.sinceBarrier = append(s.sinceBarrier, sequence)
+	}
+	if clock.valid() {
+		s.clockFile = clock.File
+	}
+	s.sequences = append(s.sequences, sequence)
+}
+
+// dependOn makes this sequence wait for another sequence before it runs
+func (s *transactionSequence) dependOn(other *transactionSequence) {
+	s.dependsOn = append(s.dependsOn, other)
+	if other.depth+1 > s.depth {
+		s.depth = other.depth + 1
+	}
+}
+
+func hasRepair(transaction Transaction) bool {
+	for _, mutation := range transaction.Mutations {
+		if mutation.Type == Repair {
+			return true
+		}
+	}
+	return false
+}
+
+// longestChain returns the length of the longest chain of transactions that have to be applied one after the other
+func (s *transactionSet) longestChain() int {
+	longest := 0
+	for _, sequence := range s.sequences {
+		var length int
+		if s.logicalClock {
+			length = sequence.depth + 1
+		} else {
+			length = len(sequence.transactions)
+		}
+		if length > longest {
+			longest = length
+		}
+	}
+	return longest
+}
+
+// parallelismEstimate is how many transactions could be applied at the same time on average
+func (s *transactionSet) parallelismEstimate() float64 {
+	longest := s.longestChain()
+	if longest == 0 {
+		return 0
+	}
+	return float64(s.ordinal) / float64(longest)
+}
+
+func (s *transactionSet) schedulerName() string {
+	if s.logicalClock {
+		return ParallelApplyLogicalClock
+	}
+	return ParallelApplyKeys
+}
@@ -0,0 +1,60 @@
+package clone
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionSetAppendByLogicalClock(t *testing.T) {
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	transaction := func(id int, file string, lastCommitted int64, sequenceNumber int64) Transaction {
+		return Transaction{
+			Mutations: []Mutation{{Type: Update, Table: table, Rows: [][]interface{}{{id, "name"}}}},
+			LogicalClock: LogicalClock{
+				File:           file,
+				LastCommitted:  lastCommitted,
+				SequenceNumber: sequenceNumber,
+			},
+		}
+	}
+	set := transactionSet{logicalClock: true, shadow: &transactionSet{}}
+	// 1 and 2 were committed together, 3 and 4 after them, the keys say they are all independent
+	set.Append(transaction(1, "binlog.000001", 0, 1))
+	set.Append(transaction(2, "binlog.000001", 0, 2))
+	set.Append(transaction(3, "binlog.000001", 2, 3))
+	set.Append(transaction(4, "binlog.000001", 2, 4))
+	// A new file restarts the clock so it's a barrier
+	set.Append(transaction(5, "binlog.000002", 0, 1))
+	// No clock is also a barrier
+	set.Append(Transaction{Mutations: []Mutation{{Type: Insert, Table: table, Rows: [][]interface{}{{6, "name"}}}}})
+	set.Append(transaction(7, "binlog.000002", 0, 2))
+
+	require.Len(t, set.sequences, 7)
+	dependencies := func(i int) []int {
+		var result []int
+		for _, dependency := range set.sequences[i].dependsOn {
+			for j, sequence := range set.sequences {
+				if sequence == dependency {
+					result = append(result, j)
+				}
+			}
+		}
+		return result
+	}
+	assert.Empty(t, dependencies(0))
+	assert.Empty(t, dependencies(1))
+	assert.Equal(t, []int{0, 1}, dependencies(2))
+	assert.Equal(t, []int{0, 1}, dependencies(3))
+	assert.Equal(t, []int{0, 1, 2, 3}, dependencies(4))
+	assert.Equal(t, []int{4}, dependencies(5))
+	assert.Equal(t, []int{5}, dependencies(6))
+
+	// The chain is 1 -> 3 -> 5 -> 6 -> 7
+	assert.Equal(t, 5, set.longestChain())
+	assert.InDelta(t, 7.0/5.0, set.parallelismEstimate(), 0.001)
+	// Each transaction writes a different row so the keys scheduler runs them all in parallel
+	assert.Equal(t, 1, set.shadow.longestChain())
+	assert.InDelta(t, 7.0, set.shadow.parallelismEstimate(), 0.001)
+}
@@ -0,0 +1,160 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// originSlots is the number of rows per task in the origin table, each connection writes to the row of its connection
+// id modulo this so that parallel replication doesn't contend on a single row
+const originSlots = 256
+
+func (w *TransactionWriter) createOriginTable(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, w.config.WriteTimeout)
+	defer cancel()
+	stmt := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			task      VARCHAR(255) NOT NULL,
+			slot      INT          NOT NULL,
+			timestamp TIMESTAMP(6) NOT NULL,
+			PRIMARY KEY (task, slot)
+		)
+		`, "`"+w.config.OriginTable+"`")
+	_, err := w.target.ExecContext(timeoutCtx, stmt)
+	if err != nil {
+		return errors.Wrapf(err, "could not create origin table in target database:\n%s", stmt)
+	}
+	return nil
+}
+
+// markOrigin writes to the origin table first thing in every target transaction with --loop-prevention, the
+// replication task in the other direction skips the transactions that write to it. The timestamp makes sure the row
+// changes, an unchanged row wouldn't be written to the binlog.
+func (w *TransactionWriter) markOrigin(ctx context.Context, tx *sql.Tx) error {
+	if !w.config.LoopPrevention {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx,
+		fmt.Sprintf("REPLACE INTO %s (task, slot, timestamp) VALUES (?, CONNECTION_ID() %% %d, ?)",
+			"`"+w.config.OriginTable+"`", originSlots),
+		w.config.TaskName, time.Now().UTC())
+	return errors.WithStack(err)
+}
+
+// isOriginTable returns true for the rows events of the origin table in the source schema
+func (s *TransactionStream) isOriginTable(event *replication.TableMapEvent) bool {
+	return s.config.LoopPrevention &&
+		string(event.Schema) == s.sourceSchema &&
+		string(event.Table) == s.config.OriginTable
+}
+
+// conflictDetector finds rows modified on both sides of bidirectional replication within a window. The binlogs of the
+// source have both sides: the transactions written by the replication task in the other direction are the writes of
+// the peer and the rest are the writes to the source itself.
+type conflictDetector struct {
+	window time.Duration
+	// peer and local are the last time each key was written by either side
+	peer  map[string]time.Time
+	local map[string]time.Time
+	// writes are the keys in the maps in binlog order so they can be expired
+	writes []keyWrite
+	buf    []byte
+}
+
+type keyWrite struct {
+	key  string
+	peer bool
+	time time.Time
+}
+
+// conflict is a row modified on both sides within the window
+type conflict struct {
+	table string
+	keys  []interface{}
+}
+
+func newConflictDetector(window time.Duration) *conflictDetector {
+	return &conflictDetector{
+		window: window,
+		peer:   make(map[string]time.Time),
+		local:  make(map[string]time.Time),
+	}
+}
+
+// observe records the keys written by a mutation at a time and returns the keys also written by the other side
+// within the window
+func (d *conflictDetector) observe(mutation Mutation, peer bool, at time.Time) []conflict {
+	d.expire(at)
+	if mutation.Type == Repair {
+		return nil
+	}
+	mine, theirs := d.local, d.peer
+	if peer {
+		mine, theirs = d.peer, d.local
+	}
+	var conflicts []conflict
+	for _, rows := range [][][]interface{}{mutation.Before, mutation.Rows} {
+		for _, row := range rows {
+			keys := mutation.Table.KeysOfRow(row)
+			buf := append(d.buf[:0], mutation.Table.Name...)
+			buf = append(buf, 0)
+			for _, value := range keys {
+				buf = appendEncodedValue(buf, value)
+			}
+			d.buf = buf
+			key := string(buf)
+			if last, ok := mine[key]; ok && last.Equal(at) {
+				// Already checked, the after image of an update usually has the same key as the before image
+				continue
+			}
+			if last, ok := theirs[key]; ok && at.Sub(last) <= d.window {
+				conflicts = append(conflicts, conflict{table: mutation.Table.Name, keys: keys})
+			}
+			mine[key] = at
+			d.writes = append(d.writes, keyWrite{key: key, peer: peer, time: at})
+		}
+	}
+	return conflicts
+}
+
+// expire forgets the keys written before the window
+func (d *conflictDetector) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.writes); i++ {
+		write := d.writes[i]
+		if now.Sub(write.time) <= d.window {
+			break
+		}
+		writes := d.local
+		if write.peer {
+			writes = d.peer
+		}
+		if last, ok := writes[write.key]; ok && last.Equal(write.time) {
+			delete(writes, write.key)
+		}
+	}
+	d.writes = d.writes[i:]
+}
+
+// reportConflicts checks the mutation for conflicts if conflict detection is enabled
+func (s *TransactionStream) reportConflicts(ctx context.Context, mutation Mutation, peer bool, at time.Time) {
+	if s.conflicts == nil {
+		return
+	}
+	switch mutation.Table.Name {
+	case s.config.WatermarkTable, s.config.HeartbeatTable, s.config.SnapshotRequestTable:
+		return
+	default:
+	}
+	for _, c := range s.conflicts.observe(mutation, peer, at) {
+		replicationConflicts.WithLabelValues(s.config.TaskName, c.table).Inc()
+		logrus.WithContext(ctx).WithField("task", "replicate").
+			Warnf("row %v of %s was modified on both sides within %v", c.keys, c.table, s.config.ConflictWindow)
+	}
+}
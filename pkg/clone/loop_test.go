@@ -0,0 +1,89 @@
+package clone
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTransactionsSkipsLoopedTransactions(t *testing.T) {
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	config := Replicate{TaskName: "main", OriginTable: "_cloner_origin", LoopPrevention: true, ConflictWindow: time.Minute}
+	s, err := NewTransactionStreamer(config, nil, nil)
+	require.NoError(t, err)
+	s.sourceSchema = "source"
+	s.tables = []*Table{table}
+
+	customers := &replication.TableMapEvent{TableID: 1, Schema: []byte("source"), Table: []byte("customers")}
+	origin := &replication.TableMapEvent{TableID: 2, Schema: []byte("source"), Table: []byte("_cloner_origin")}
+	//nolint:nosnakecase
+	write := func(tableMap *replication.TableMapEvent, timestamp uint32, logPos uint32, id int) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2, Timestamp: timestamp, LogPos: logPos},
+			Event:  &replication.RowsEvent{Table: tableMap, Rows: [][]interface{}{{id, "name"}}},
+		}
+	}
+	xid := func(timestamp uint32, logPos uint32) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{Timestamp: timestamp, LogPos: logPos},
+			Event:  &replication.XIDEvent{},
+		}
+	}
+	streamer := &fakeBinlogStreamer{events: []*replication.BinlogEvent{
+		{Header: &replication.EventHeader{}, Event: &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000001")}},
+		// Written to the source
+		write(customers, 1000, 100, 1),
+		xid(1000, 200),
+		// Written by the replication task in the other direction
+		write(origin, 1010, 300, 1),
+		write(customers, 1010, 400, 1),
+		write(customers, 1010, 500, 2),
+		xid(1010, 600),
+		// Written to the source long after the peer wrote the same row
+		write(customers, 2000, 700, 2),
+		xid(2000, 800),
+	}}
+
+	output := make(chan Transaction, 10)
+	start := Position{File: "binlog.000001", Position: 4}
+	err = s.readTransactions(context.Background(), backoff.NewExponentialBackOff(), streamer, start, output)
+	require.ErrorIs(t, err, io.EOF)
+	close(output)
+	var transactions []Transaction
+	for transaction := range output {
+		transactions = append(transactions, transaction)
+	}
+	require.Len(t, transactions, 2)
+	assert.Equal(t, uint32(200), transactions[0].FinalPosition.Position)
+	assert.Equal(t, uint32(800), transactions[1].FinalPosition.Position)
+	assert.Equal(t, [][]interface{}{{2, "name"}}, transactions[1].Mutations[0].Rows)
+}
+
+func TestConflictDetector(t *testing.T) {
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	d := newConflictDetector(time.Minute)
+	at := time.Unix(1000, 0)
+	insert := func(id int) Mutation {
+		return Mutation{Type: Insert, Table: table, Rows: [][]interface{}{{id, "name"}}}
+	}
+	update := func(id int) Mutation {
+		return Mutation{Type: Update, Table: table, Before: [][]interface{}{{id, "old"}}, Rows: [][]interface{}{{id, "new"}}}
+	}
+
+	assert.Empty(t, d.observe(insert(1), false, at))
+	assert.Empty(t, d.observe(update(1), false, at.Add(time.Second)))
+	// The same row from the peer within the window is reported once even though the update has it twice
+	assert.Equal(t, []conflict{{table: "customers", keys: []interface{}{1}}},
+		d.observe(update(1), true, at.Add(30*time.Second)))
+	assert.Empty(t, d.observe(insert(2), true, at.Add(30*time.Second)))
+
+	// Outside the window the writes are forgotten
+	assert.Empty(t, d.observe(update(2), false, at.Add(2*time.Minute)))
+	assert.Len(t, d.writes, 1)
+}
@@ -0,0 +1,72 @@
+package clone
+
+import (
+	"sort"
+)
+
+// ongoingTableKey identifies the table of a chunk the same way reconcileBinlogEvent matches binlog events to chunks
+type ongoingTableKey struct {
+	schema string
+	name   string
+}
+
+// ongoingChunkIndex finds the ongoing chunk a binlog row belongs to. The chunks of each table are sorted by their start,
+// they don't overlap so a binary search by key finds the only chunk that can contain the row. It's only used by the
+// replication thread.
+type ongoingChunkIndex map[ongoingTableKey][]*ChunkSnapshot
+
+func newOngoingChunkIndex(chunks []*ChunkSnapshot) ongoingChunkIndex {
+	index := make(ongoingChunkIndex)
+	for _, chunk := range chunks {
+		key := ongoingTableKey{chunk.Chunk.Table.MysqlTable.Schema, chunk.Chunk.Table.MysqlTable.Name}
+		index[key] = append(index[key], chunk)
+	}
+	for _, tableChunks := range index {
+		sort.Slice(tableChunks, func(i, j int) bool {
+			// The first chunk of a table starts at nil
+			a, b := tableChunks[i].Chunk.Start, tableChunks[j].Chunk.Start
+			if a == nil || b == nil {
+				return a == nil && b != nil
+			}
+			return genericCompareKeys(a, b) < 0
+		})
+	}
+	return index
+}
+
+// tableChunks returns the ongoing chunks of the table of the mutation
+func (index ongoingChunkIndex) tableChunks(mutation Mutation) []*ChunkSnapshot {
+	tableSchema := mutation.Table.MysqlTable
+	return index[ongoingTableKey{tableSchema.Schema, tableSchema.Name}]
+}
+
+// findOngoingChunk returns the chunk among the chunks of a table that contains the row, nil if none of them do
+func findOngoingChunk(tableChunks []*ChunkSnapshot, row []interface{}) *ChunkSnapshot {
+	keys := tableChunks[0].Chunk.Table.KeysOfRow(row)
+	i := sort.Search(len(tableChunks), func(i int) bool {
+		end := tableChunks[i].Chunk.End
+		return end == nil || genericCompareKeys(keys, end) < 0
+	})
+	if i == len(tableChunks) || !tableChunks[i].Chunk.ContainsKeys(keys) {
+		return nil
+	}
+	return tableChunks[i]
+}
+
+// remove removes the chunk from the index keeping the order of the other chunks of its table
+func (index ongoingChunkIndex) remove(chunk *ChunkSnapshot) {
+	key := ongoingTableKey{chunk.Chunk.Table.MysqlTable.Schema, chunk.Chunk.Table.MysqlTable.Name}
+	tableChunks := index[key]
+	n := 0
+	for _, x := range tableChunks {
+		if x != chunk {
+			tableChunks[n] = x
+			n++
+		}
+	}
+	if n == 0 {
+		delete(index, key)
+	} else {
+		index[key] = tableChunks[:n]
+	}
+}
@@ -0,0 +1,179 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/mightyguava/autotx"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// PurgedBinlogsHalt stops replication when the binlogs it needs have been purged from the source
+	PurgedBinlogsHalt = "halt"
+	// PurgedBinlogsSnapshot continues from the current position of the source and repairs the target with a snapshot
+	PurgedBinlogsSnapshot = "snapshot"
+)
+
+var (
+	purgedBinlogRecoveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_purged_binlog_recoveries",
+			Help: "How many times replication continued from the current position of the source with a snapshot since the binlogs it needed had been purged",
+		},
+		[]string{"task"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(purgedBinlogRecoveries)
+}
+
+// checkPurgedBinlogs checks that the binlogs from the position on are still on the source before we start streaming
+// from it, otherwise it applies --purged-binlogs and returns the position to start from instead
+func (s *TransactionStream) checkPurgedBinlogs(ctx context.Context, flavor string, position Position) (Position, error) {
+	missing, err := s.findPurged(ctx, flavor, position)
+	if err != nil {
+		return position, errors.WithStack(err)
+	}
+	if missing == "" {
+		return position, nil
+	}
+	if s.config.PurgedBinlogs != PurgedBinlogsSnapshot {
+		// Retrying won't bring the binlogs back
+		return position, backoff.Permanent(errors.Errorf("can't continue replication from %s: %s. "+
+			"Restart with --purged-binlogs=snapshot to continue from the current position of the source and repair "+
+			"the target with a snapshot, or delete the checkpoint of task %q and run a consistent clone",
+			describePosition(position), missing, s.config.TaskName))
+	}
+
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+	file, pos, executedGtidSet, err := s.readMasterPosition(ctx, flavor)
+	if err != nil {
+		return position, errors.WithStack(err)
+	}
+	recovered := Position{File: file, Position: pos}
+	if executedGtidSet != "" && position.Gset != nil {
+		recovered.Gset, err = parseGTIDSet(executedGtidSet)
+		if err != nil {
+			return position, errors.WithStack(err)
+		}
+	}
+	// The request is written after the position we read so we will stream it and start the snapshot, if we restart
+	// before it's been handled we read it again
+	err = s.requestSnapshot(ctx)
+	if err != nil {
+		return position, errors.Wrapf(err, "can't continue replication from %s (%s) since a snapshot can't be requested",
+			describePosition(position), missing)
+	}
+	purgedBinlogRecoveries.WithLabelValues(s.config.TaskName).Inc()
+	logger.Warnf("can't continue replication from %s: %s. Continuing from the current position %s and "+
+		"repairing the target with a snapshot", describePosition(position), missing, describePosition(recovered))
+	return recovered, nil
+}
+
+// findPurged describes the binlogs from the position on that have been purged from the source or returns an empty
+// string if they are all there. We stream from the GTID set if we have one so that's what we check, MariaDB doesn't
+// have gtid_purged so we fall back to checking the binlog file.
+func (s *TransactionStream) findPurged(ctx context.Context, flavor string, position Position) (string, error) {
+	if position.Gset != nil && flavor != mysql.MariaDBFlavor {
+		source, err := s.config.Source.DB()
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		defer source.Close()
+		var purged string
+		err = source.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_purged").Scan(&purged)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not read gtid_purged")
+		}
+		return missingGTIDs(position.Gset, purged)
+	}
+	if position.File == "" {
+		return "", nil
+	}
+	files, err := s.readBinaryLogs(ctx)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return missingBinlogFile(position.File, files), nil
+}
+
+// missingGTIDs describes the GTIDs purged from the source that haven't been executed
+func missingGTIDs(executed mysql.GTIDSet, purged string) (string, error) {
+	purgedSet, err := mysql.ParseMysqlGTIDSet(purged)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not parse gtid_purged: %s", purged)
+	}
+	if executed.Contain(purgedSet) {
+		return "", nil
+	}
+	executedSet, ok := executed.(*mysql.MysqlGTIDSet)
+	if !ok {
+		return "", errors.Errorf("unexpected GTID set %T: %v", executed, executed)
+	}
+	missing := purgedSet.Clone().(*mysql.MysqlGTIDSet)
+	err = missing.Minus(*executedSet)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("the source has purged the transactions %s", missing), nil
+}
+
+// missingBinlogFile describes why a binlog file isn't in the binlog files of the source, oldest first, or returns an
+// empty string if it's there
+func missingBinlogFile(file string, files []string) string {
+	for _, f := range files {
+		if f == file {
+			return ""
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Sprintf("the source has no binlog files, %s has been purged", file)
+	}
+	oldest := files[0]
+	if (mysql.Position{Name: file}).Compare(mysql.Position{Name: oldest}) < 0 {
+		return fmt.Sprintf("the source has purged %s, its oldest binlog file is %s", file, oldest)
+	}
+	return fmt.Sprintf("%s isn't one of the binlog files of the source (%s to %s)", file, oldest, files[len(files)-1])
+}
+
+// requestSnapshot inserts a snapshot request for this task into the snapshot request table of the source unless a full
+// snapshot is already pending or running. We read the purged checkpoint again each time the stream restarts before a
+// new checkpoint has been written so the request from the first time is usually there.
+func (s *TransactionStream) requestSnapshot(ctx context.Context) error {
+	source, err := s.config.Source.DB()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer source.Close()
+	return errors.WithStack(autotx.Transact(ctx, source, func(tx *sql.Tx) error {
+		var requested int
+		err := tx.QueryRowContext(ctx,
+			fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE task = ? AND completed_at IS NULL AND %s FOR UPDATE",
+				"`"+s.config.SnapshotRequestTable+"`", fullSnapshotRequests),
+			s.config.TaskName).Scan(&requested)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if requested > 0 {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx,
+			fmt.Sprintf("INSERT INTO %s (task) VALUES (?)", "`"+s.config.SnapshotRequestTable+"`"),
+			s.config.TaskName)
+		return errors.WithStack(err)
+	}))
+}
+
+func describePosition(position Position) string {
+	if position.Gset != nil {
+		return fmt.Sprintf("%s:%d gtid=%s", position.File, position.Position, position.Gset)
+	}
+	return fmt.Sprintf("%s:%d", position.File, position.Position)
+}
@@ -0,0 +1,95 @@
+package clone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingGTIDs(t *testing.T) {
+	executed, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100")
+	require.NoError(t, err)
+
+	missing, err := missingGTIDs(executed, "")
+	require.NoError(t, err)
+	assert.Equal(t, "", missing)
+
+	missing, err = missingGTIDs(executed, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-50")
+	require.NoError(t, err)
+	assert.Equal(t, "", missing)
+
+	missing, err = missingGTIDs(executed, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-150")
+	require.NoError(t, err)
+	assert.Equal(t, "the source has purged the transactions 3e11fa47-71ca-11e1-9e33-c80aa9429562:101-150", missing)
+
+	// Transactions of another server we have never seen
+	missing, err = missingGTIDs(executed, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-50,4a3b2c1d-71ca-11e1-9e33-c80aa9429562:1-5")
+	require.NoError(t, err)
+	assert.Equal(t, "the source has purged the transactions 4a3b2c1d-71ca-11e1-9e33-c80aa9429562:1-5", missing)
+}
+
+func TestMissingBinlogFile(t *testing.T) {
+	files := []string{"mysql-bin.000009", "mysql-bin.000010", "mysql-bin.000011"}
+	assert.Equal(t, "", missingBinlogFile("mysql-bin.000010", files))
+	assert.Equal(t, "the source has purged mysql-bin.000008, its oldest binlog file is mysql-bin.000009",
+		missingBinlogFile("mysql-bin.000008", files))
+	assert.Equal(t, "mysql-bin.000012 isn't one of the binlog files of the source (mysql-bin.000009 to mysql-bin.000011)",
+		missingBinlogFile("mysql-bin.000012", files))
+	assert.Equal(t, "the source has no binlog files, mysql-bin.000008 has been purged", missingBinlogFile("mysql-bin.000008", nil))
+}
+
+func TestRequestSnapshotOnlyOnce(t *testing.T) {
+	err := startTidb()
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	config := Replicate{
+		WriterConfig: WriterConfig{
+			ReaderConfig: ReaderConfig{SourceTargetConfig: SourceTargetConfig{Source: tidbContainer.Config()}},
+			WriteTimeout: time.Minute,
+		},
+		TaskName:             "purged",
+		SnapshotRequestTable: "_cloner_snapshot_request",
+	}
+	source, err := config.Source.DB()
+	require.NoError(t, err)
+	defer source.Close()
+	_, err = source.ExecContext(ctx, "DROP TABLE IF EXISTS _cloner_snapshot_request")
+	require.NoError(t, err)
+	snapshotter := &Snapshotter{config: config, source: source}
+	err = snapshotter.createSnapshotRequestTable(ctx)
+	require.NoError(t, err)
+
+	countRequests := func() int {
+		var count int
+		err := source.QueryRowContext(ctx, "SELECT COUNT(*) FROM _cloner_snapshot_request WHERE task = 'purged'").Scan(&count)
+		require.NoError(t, err)
+		return count
+	}
+
+	// Restarting from the purged checkpoint again doesn't queue another full snapshot
+	stream := &TransactionStream{config: config}
+	err = stream.requestSnapshot(ctx)
+	require.NoError(t, err)
+	err = stream.requestSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, countRequests())
+
+	// Nor does it while the snapshot is running
+	_, err = source.ExecContext(ctx, "UPDATE _cloner_snapshot_request SET started_at = NOW()")
+	require.NoError(t, err)
+	err = stream.requestSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, countRequests())
+
+	// A gap after it has completed needs another snapshot
+	_, err = source.ExecContext(ctx, "UPDATE _cloner_snapshot_request SET completed_at = NOW()")
+	require.NoError(t, err)
+	err = stream.requestSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, countRequests())
+}
@@ -0,0 +1,302 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
+)
+
+const (
+	SourceReadThrottle = "source_read"
+	TargetReadThrottle = "target_read"
+	WriteThrottle      = "write"
+)
+
+var (
+	rateLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rate_limit",
+			Help: "The configured rate limit per second (0 means unlimited), partitioned by operation, table (empty for the global limit) and unit (rows, bytes).",
+		},
+		[]string{"name", "table", "unit"},
+	)
+	rateLimitDelay = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rate_limit_delay_duration",
+			Help:    "Duration of waiting for the rows and bytes rate limits, partitioned by operation.",
+			Buckets: defaultBuckets,
+		},
+		[]string{"name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(rateLimit)
+	prometheus.MustRegister(rateLimitDelay)
+
+	http.HandleFunc("/rate-limits", handleRateLimits)
+}
+
+// activeThrottles are the throttles of the currently running command, they can be adjusted via the /rate-limits endpoint
+var activeThrottles = atomic.NewPointer[Throttles](nil)
+
+// Throttles holds the rate limits for all the throttled operations
+type Throttles struct {
+	SourceRead *Throttle
+	TargetRead *Throttle
+	Write      *Throttle
+}
+
+// NewThrottles creates the throttles from the global config and the per table config
+func NewThrottles(config ReaderConfig) *Throttles {
+	return &Throttles{
+		SourceRead: NewThrottle(SourceReadThrottle, config.SourceReadRowsPerSecond, config.SourceReadBytesPerSecond,
+			func(c TableConfig) (float64, float64) { return c.SourceReadRowsPerSecond, c.SourceReadBytesPerSecond },
+			config.Config.Tables),
+		TargetRead: NewThrottle(TargetReadThrottle, config.TargetReadRowsPerSecond, config.TargetReadBytesPerSecond,
+			func(c TableConfig) (float64, float64) { return c.TargetReadRowsPerSecond, c.TargetReadBytesPerSecond },
+			config.Config.Tables),
+		Write: NewThrottle(WriteThrottle, config.WriteRowsPerSecond, config.WriteBytesPerSecond,
+			func(c TableConfig) (float64, float64) { return c.WriteRowsPerSecond, c.WriteBytesPerSecond },
+			config.Config.Tables),
+	}
+}
+
+func (t *Throttles) get(name string) *Throttle {
+	if t == nil {
+		return nil
+	}
+	switch name {
+	case SourceReadThrottle:
+		return t.SourceRead
+	case TargetReadThrottle:
+		return t.TargetRead
+	case WriteThrottle:
+		return t.Write
+	default:
+		return nil
+	}
+}
+
+// forRead returns the throttle for reading from source or target
+func (t *Throttles) forRead(from string) *Throttle {
+	if from == "target" {
+		return t.get(TargetReadThrottle)
+	}
+	return t.get(SourceReadThrottle)
+}
+
+// Throttle is a token bucket rate limiter of rows and bytes per second, there is a global limit and optionally a
+// limit per table, both have to be satisfied. A nil Throttle doesn't limit anything.
+type Throttle struct {
+	name string
+
+	global *throughputLimit
+
+	mutex  sync.Mutex
+	tables map[string]*throughputLimit
+}
+
+type throughputLimit struct {
+	rows  *rate.Limiter
+	bytes *rate.Limiter
+}
+
+func NewThrottle(name string, rowsPerSecond float64, bytesPerSecond float64,
+	tableLimits func(TableConfig) (float64, float64), tableConfigs map[string]TableConfig) *Throttle {
+	t := &Throttle{
+		name:   name,
+		tables: make(map[string]*throughputLimit),
+	}
+	t.global = t.newThroughputLimit("", rowsPerSecond, bytesPerSecond)
+	for table, config := range tableConfigs {
+		rows, bytes := tableLimits(config)
+		if rows > 0 || bytes > 0 {
+			t.tables[table] = t.newThroughputLimit(table, rows, bytes)
+		}
+	}
+	return t
+}
+
+func (t *Throttle) newThroughputLimit(table string, rowsPerSecond float64, bytesPerSecond float64) *throughputLimit {
+	l := &throughputLimit{
+		rows:  newLimiter(rowsPerSecond),
+		bytes: newLimiter(bytesPerSecond),
+	}
+	rateLimit.WithLabelValues(t.name, table, "rows").Set(rowsPerSecond)
+	rateLimit.WithLabelValues(t.name, table, "bytes").Set(bytesPerSecond)
+	return l
+}
+
+// newLimiter creates a limiter that starts out with a full bucket, zero or less means unlimited
+func newLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst(perSecond))
+}
+
+func burst(perSecond float64) int {
+	return int(math.Max(1, math.Ceil(perSecond)))
+}
+
+// setLimit sets the limit per second with a burst of one second worth of tokens, zero or less means unlimited
+func setLimit(limiter *rate.Limiter, perSecond float64) {
+	if perSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		limiter.SetBurst(0)
+		return
+	}
+	limiter.SetLimit(rate.Limit(perSecond))
+	limiter.SetBurst(burst(perSecond))
+}
+
+// Wait blocks until the rows and bytes can be read or written within the global limit and the limit of the table
+func (t *Throttle) Wait(ctx context.Context, table *Table, rows int, bytes uint64) error {
+	if t == nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		rateLimitDelay.WithLabelValues(t.name).Observe(time.Since(start).Seconds())
+	}()
+
+	err := t.global.wait(ctx, rows, bytes)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if table == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	tableLimit, ok := t.tables[table.Name]
+	t.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return errors.WithStack(tableLimit.wait(ctx, rows, bytes))
+}
+
+func (l *throughputLimit) wait(ctx context.Context, rows int, bytes uint64) error {
+	err := waitN(ctx, l.rows, rows)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(waitN(ctx, l.bytes, int(math.Min(float64(bytes), math.MaxInt32))))
+}
+
+// waitN waits for n tokens, the rate.Limiter refuses to wait for more than the burst so we wait in burst sized steps
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	if limiter.Limit() == rate.Inf {
+		return nil
+	}
+	burst := limiter.Burst()
+	for n > 0 {
+		step := n
+		if step > burst {
+			step = burst
+		}
+		err := limiter.WaitN(ctx, step)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		n -= step
+	}
+	return nil
+}
+
+// SetLimit adjusts the limit at runtime, an empty table sets the global limit, the unit is either "rows" or "bytes"
+func (t *Throttle) SetLimit(table string, unit string, perSecond float64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	limit := t.global
+	if table != "" {
+		var ok bool
+		limit, ok = t.tables[table]
+		if !ok {
+			limit = t.newThroughputLimit(table, 0, 0)
+			t.tables[table] = limit
+		}
+	}
+	switch unit {
+	case "rows":
+		setLimit(limit.rows, perSecond)
+	case "bytes":
+		setLimit(limit.bytes, perSecond)
+	default:
+		return errors.Errorf("unknown unit %q, should be rows or bytes", unit)
+	}
+	rateLimit.WithLabelValues(t.name, table, unit).Set(perSecond)
+	return nil
+}
+
+func (t *Throttle) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	lines := []string{
+		fmt.Sprintf("%s rows=%s bytes=%s", t.name, formatLimit(t.global.rows), formatLimit(t.global.bytes)),
+	}
+	tables := make([]string, 0, len(t.tables))
+	for table := range t.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		limit := t.tables[table]
+		lines = append(lines, fmt.Sprintf("%s table=%s rows=%s bytes=%s",
+			t.name, table, formatLimit(limit.rows), formatLimit(limit.bytes)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatLimit(limiter *rate.Limiter) string {
+	if limiter.Limit() == rate.Inf {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%v/s", float64(limiter.Limit()))
+}
+
+// handleRateLimits lists the rate limits on GET and adjusts a limit on POST, for example:
+//
+//	curl -X POST 'localhost:9102/rate-limits?name=write&unit=bytes&limit=20000000'
+//	curl -X POST 'localhost:9102/rate-limits?name=source_read&table=customers&unit=rows&limit=1000'
+func handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	throttles := activeThrottles.Load()
+	if throttles == nil {
+		http.Error(w, "no rate limits configured", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		throttle := throttles.get(r.FormValue("name"))
+		if throttle == nil {
+			http.Error(w, fmt.Sprintf("unknown rate limit name %q", r.FormValue("name")), http.StatusBadRequest)
+			return
+		}
+		limit, err := strconv.ParseFloat(r.FormValue("limit"), 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid limit: %v", err), http.StatusBadRequest)
+			return
+		}
+		err = throttle.SetLimit(r.FormValue("table"), r.FormValue("unit"), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, throttle := range []*Throttle{throttles.SourceRead, throttles.TargetRead, throttles.Write} {
+		_, _ = fmt.Fprintln(w, throttle.String())
+	}
+}
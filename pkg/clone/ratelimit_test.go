@@ -0,0 +1,94 @@
+package clone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	customers := &Table{Name: "customers"}
+	transactions := &Table{Name: "transactions"}
+
+	tests := []struct {
+		name    string
+		global  float64
+		tables  map[string]TableConfig
+		table   *Table
+		rows    int
+		minWait time.Duration
+	}{
+		{
+			name:  "unlimited",
+			table: customers,
+			rows:  1_000_000,
+		},
+		{
+			name:   "within burst",
+			global: 100,
+			table:  customers,
+			rows:   100,
+		},
+		{
+			name:    "global limit",
+			global:  100,
+			table:   customers,
+			rows:    120,
+			minWait: 150 * time.Millisecond,
+		},
+		{
+			name:    "table limit",
+			tables:  map[string]TableConfig{"customers": {WriteRowsPerSecond: 100}},
+			table:   customers,
+			rows:    120,
+			minWait: 150 * time.Millisecond,
+		},
+		{
+			name:   "other table not limited",
+			tables: map[string]TableConfig{"customers": {WriteRowsPerSecond: 100}},
+			table:  transactions,
+			rows:   1_000_000,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			throttle := NewThrottle(WriteThrottle, test.global, 0,
+				func(c TableConfig) (float64, float64) { return c.WriteRowsPerSecond, c.WriteBytesPerSecond },
+				test.tables)
+			start := time.Now()
+			err := throttle.Wait(context.Background(), test.table, test.rows, 0)
+			require.NoError(t, err)
+			elapsed := time.Since(start)
+			assert.GreaterOrEqual(t, elapsed, test.minWait)
+			assert.Less(t, elapsed, test.minWait+time.Second)
+		})
+	}
+}
+
+func TestThrottleSetLimit(t *testing.T) {
+	var nilThrottle *Throttle
+	assert.NoError(t, nilThrottle.Wait(context.Background(), nil, 1_000_000, 1_000_000))
+
+	throttle := NewThrottle(SourceReadThrottle, 0, 0,
+		func(c TableConfig) (float64, float64) { return c.SourceReadRowsPerSecond, c.SourceReadBytesPerSecond },
+		nil)
+	assert.Equal(t, "source_read rows=unlimited bytes=unlimited", throttle.String())
+
+	require.NoError(t, throttle.SetLimit("", "bytes", 1000))
+	require.NoError(t, throttle.SetLimit("customers", "rows", 10))
+	assert.Error(t, throttle.SetLimit("", "widgets", 10))
+	assert.Equal(t, "source_read rows=unlimited bytes=1000/s\n"+
+		"source_read table=customers rows=10/s bytes=unlimited", throttle.String())
+
+	// The bytes limit is exhausted so the next wait is cancelled by the deadline
+	require.NoError(t, throttle.Wait(context.Background(), nil, 0, 1000))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, throttle.Wait(ctx, nil, 0, 1000))
+
+	require.NoError(t, throttle.SetLimit("", "bytes", 0))
+	assert.NoError(t, throttle.Wait(context.Background(), nil, 0, 1_000_000))
+}
@@ -255,6 +255,8 @@ func NewReader(config ReaderConfig, table *Table, speedLogger *ThroughputLogger,
 			AcquireMetric: readLimiterDelay.WithLabelValues("source"),
 			MaxRetries:    config.ReadRetries,
 			Timeout:       config.ReadTimeout,
+			Throttle:      config.Throttles.forRead("source"),
+			Health:        config.Health,
 		},
 		target: target,
 		targetRetry: RetryOptions{
@@ -262,6 +264,8 @@ func NewReader(config ReaderConfig, table *Table, speedLogger *ThroughputLogger,
 			AcquireMetric: readLimiterDelay.WithLabelValues("target"),
 			MaxRetries:    config.ReadRetries,
 			Timeout:       config.ReadTimeout,
+			Throttle:      config.Throttles.forRead("target"),
+			Health:        config.Health,
 		},
 	}
 }
@@ -0,0 +1,646 @@
+package clone
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// relayLogPrefix is the prefix of the relay log files, followed by a sequence number
+	relayLogPrefix = "relay."
+	// relayRecordHeaderSize is the size of the length and checksum before every record
+	relayRecordHeaderSize = 8
+	// relayLogPruneInterval is how often the relay log reader checks the checkpoint of the sink to delete files
+	relayLogPruneInterval = 10 * time.Second
+)
+
+var (
+	relayLogBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replication_relay_log_bytes",
+			Help: "Size of the files in --relay-log-dir",
+		},
+		[]string{"task"},
+	)
+	relayLogTransactions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_relay_log_transactions",
+			Help: "How many transactions (or pieces of large transactions) have been appended to the relay log",
+		},
+		[]string{"task"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(relayLogBytes)
+	prometheus.MustRegister(relayLogTransactions)
+}
+
+// relayRecord is a transaction in the relay log, tables are stored by name
+type relayRecord struct {
+	File     string
+	Position uint32
+	Gset     string
+	// AfterFile and AfterPosition are the position of the last complete transaction appended before this one, the
+	// reader checks it against the checkpoint to notice transactions missing from the relay log
+	AfterFile     string
+	AfterPosition uint32
+	LogicalClock  LogicalClock
+	Partial       bool
+	Piece         int
+	Mutations     []relayMutation
+}
+
+type relayMutation struct {
+	Type                MutationType
+	Table               string
+	Rows                [][]interface{}
+	Before              [][]interface{}
+	ColumnsBitmap       []bool
+	BeforeColumnsBitmap []bool
+}
+
+// RelayLog persists the transactions read from the source in numbered files in --relay-log-dir and delivers them to
+// the sink from there. Reading from the source only depends on the relay log so it continues while the target is
+// unavailable, and a restart continues reading from the source where the relay log ends instead of at the checkpoint
+// of the sink. Files are deleted once the sink has checkpointed all the transactions in them.
+type RelayLog struct {
+	config Replicate
+	dir    string
+	sink   Sink
+	stream *TransactionStream
+
+	mutex sync.Mutex
+	// segment is the number of the file appended to and size its size, the reader never reads past size
+	segment int
+	size    int64
+	file    *os.File
+	// bytes is the size of all the files
+	bytes int64
+	// last is the last complete transaction appended and pieces the number of pieces of a large transaction appended
+	// after it
+	last   *relayRecord
+	pieces int
+	// appended is closed and replaced whenever a transaction is appended
+	appended chan struct{}
+}
+
+func NewRelayLog(config Replicate, sink Sink, stream *TransactionStream) (*RelayLog, error) {
+	if config.RelayLogMaxSize <= 0 {
+		return nil, errors.Errorf("--relay-log-max-size has to be positive")
+	}
+	return &RelayLog{
+		config:   config,
+		dir:      config.RelayLogDir,
+		sink:     sink,
+		stream:   stream,
+		appended: make(chan struct{}),
+	}, nil
+}
+
+// Init finds the end of the relay log, a transaction only partially written by a previous run is truncated
+func (l *RelayLog) Init(ctx context.Context) error {
+	err := os.MkdirAll(l.dir, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	segments, err := l.segments()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(segments) == 0 {
+		l.segment = 1
+		return nil
+	}
+	l.segment = segments[len(segments)-1]
+
+	// Scan the files newest first until we find the last complete transaction
+	pieces := 0
+	for i := len(segments) - 1; i >= 0 && l.last == nil; i-- {
+		piecesAfter := 0
+		valid, err := scanRelaySegment(l.path(segments[i]), 0, -1, func(record *relayRecord, end int64) error {
+			if record.Partial {
+				piecesAfter++
+				return nil
+			}
+			last := *record
+			last.Mutations = nil
+			l.last = &last
+			piecesAfter = 0
+			return nil
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if i == len(segments)-1 {
+			l.size, err = truncateRelaySegment(l.path(segments[i]), valid)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		pieces += piecesAfter
+	}
+	l.pieces = pieces
+	for _, segment := range segments {
+		stat, err := os.Stat(l.path(segment))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		l.bytes += stat.Size()
+	}
+	relayLogBytes.WithLabelValues(l.config.TaskName).Set(float64(l.bytes))
+	if l.last != nil {
+		logrus.WithContext(ctx).WithField("task", "replicate").
+			Infof("relay log in %s ends at %s:%d", l.dir, l.last.File, l.last.Position)
+	}
+	return nil
+}
+
+// lastPosition returns the position of the last complete transaction in the relay log, reading from the source
+// continues from there
+func (l *RelayLog) lastPosition() (Position, bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.last == nil {
+		return Position{}, false, nil
+	}
+	position := Position{File: l.last.File, Position: l.last.Position}
+	if l.last.Gset != "" {
+		gset, err := parseGTIDSet(l.last.Gset)
+		if err != nil {
+			return Position{}, false, errors.WithStack(err)
+		}
+		position.Gset = gset
+	}
+	return position, true, nil
+}
+
+// Capture reads transactions from the source and appends them to the relay log. The TransactionStream restarts from
+// the last complete transaction in the relay log so the pieces of a large transaction already appended are read
+// again and skipped. The channel is unbuffered so every transaction read has been appended before Capture returns.
+func (l *RelayLog) Capture(ctx context.Context, b backoff.BackOff) error {
+	l.mutex.Lock()
+	skip := l.pieces
+	l.mutex.Unlock()
+
+	captured := make(chan Transaction)
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return errors.WithStack(l.stream.Run(ctx, b, captured))
+	})
+	g.Go(func() error {
+		for {
+			select {
+			case transaction := <-captured:
+				if transaction.Partial && skip > 0 {
+					skip--
+					continue
+				}
+				skip = 0
+				err := l.append(transaction)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+	return errors.WithStack(g.Wait())
+}
+
+// append writes a transaction to the end of the relay log
+func (l *RelayLog) append(transaction Transaction) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record := relayRecord{
+		File:         transaction.FinalPosition.File,
+		Position:     transaction.FinalPosition.Position,
+		LogicalClock: transaction.LogicalClock,
+		Partial:      transaction.Partial,
+		Piece:        transaction.Piece,
+		Mutations:    make([]relayMutation, len(transaction.Mutations)),
+	}
+	if transaction.FinalPosition.Gset != nil {
+		record.Gset = transaction.FinalPosition.Gset.String()
+	}
+	if l.last != nil {
+		record.AfterFile, record.AfterPosition = l.last.File, l.last.Position
+	}
+	for i, mutation := range transaction.Mutations {
+		record.Mutations[i] = relayMutation{
+			Type:                mutation.Type,
+			Table:               mutation.Table.Name,
+			Rows:                mutation.Rows,
+			Before:              mutation.Before,
+			ColumnsBitmap:       mutation.ColumnsBitmap,
+			BeforeColumnsBitmap: mutation.BeforeColumnsBitmap,
+		}
+	}
+	data, err := encodeRelayRecord(&record)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if l.file != nil && l.size > 0 && l.size+int64(len(data)) > l.config.RelayLogMaxSize {
+		err = l.rotate()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if l.file == nil {
+		l.file, err = os.OpenFile(l.path(l.segment), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	n, err := l.file.Write(data)
+	if err != nil {
+		// Cut off what was written so the next append starts at a record boundary
+		_ = l.file.Truncate(l.size)
+		return errors.WithStack(err)
+	}
+	l.size += int64(n)
+	l.bytes += int64(n)
+	relayLogBytes.WithLabelValues(l.config.TaskName).Set(float64(l.bytes))
+	relayLogTransactions.WithLabelValues(l.config.TaskName).Inc()
+
+	if transaction.Partial {
+		l.pieces++
+	} else {
+		record.Mutations = nil
+		l.last = &record
+		l.pieces = 0
+	}
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return nil
+}
+
+// rotate starts a new file, called with the mutex held
+func (l *RelayLog) rotate() error {
+	err := l.file.Sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = l.file.Close()
+	l.file = nil
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	l.segment++
+	l.size = 0
+	return nil
+}
+
+// end returns the file being appended to, how much of it can be read and a channel that is closed on the next append
+func (l *RelayLog) end() (segment int, size int64, appended chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.segment, l.size, l.appended
+}
+
+// Run delivers the transactions in the relay log after the checkpoint of the sink and then follows the relay log as
+// transactions are appended
+func (l *RelayLog) Run(ctx context.Context, b backoff.BackOff, output chan<- Transaction) error {
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+
+	checkpoint, err := l.readCheckpoint(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tables := make(map[string]*Table, len(l.stream.tables))
+	for _, table := range l.stream.tables {
+		tables[table.Name] = table
+	}
+	segments, err := l.segments()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	segment, _, _ := l.end()
+	if len(segments) > 0 {
+		segment = segments[0]
+	}
+
+	// finished are the files that have been read to the end, they're deleted once the sink has checkpointed them
+	var finished []relaySegment
+	lastPrune := time.Now()
+	started := checkpoint == nil
+	var offset int64
+	var last relaySegment
+	for {
+		active, size, appended := l.end()
+		end := size
+		if segment < active {
+			end = -1
+		}
+		offset, err = scanRelaySegment(l.path(segment), offset, end, func(record *relayRecord, recordEnd int64) error {
+			last = relaySegment{segment: segment, file: record.File, position: record.Position, partial: record.Partial}
+			if !started {
+				if record.before(*checkpoint) {
+					return nil
+				}
+				if record.AfterFile != "" && comparePosition(record.AfterFile, record.AfterPosition, *checkpoint) > 0 {
+					return errors.Errorf("the relay log continues after %s:%d but the checkpoint is at %s:%d, "+
+						"delete %s to read from the source again", record.AfterFile, record.AfterPosition,
+						checkpoint.File, checkpoint.Position, l.dir)
+				}
+				started = true
+				logger.Infof("delivering transactions from the relay log after %s:%d", record.AfterFile, record.AfterPosition)
+			}
+			transaction, err := record.transaction(tables)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			select {
+			case output <- transaction:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			b.Reset()
+			return nil
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if segment < active {
+			if !started {
+				// Everything in it is before the checkpoint
+				err = l.remove(segment)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			} else {
+				finished = append(finished, last)
+			}
+			segment++
+			offset = 0
+			continue
+		}
+
+		if time.Since(lastPrune) >= relayLogPruneInterval {
+			finished, err = l.prune(ctx, finished)
+			if err != nil {
+				// The sink may be unavailable, we'll try again later
+				logger.WithError(err).Warnf("could not delete relay log files: %v", err)
+			}
+			lastPrune = time.Now()
+		}
+		select {
+		case <-appended:
+		case <-time.After(relayLogPruneInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// relaySegment is a file of the relay log with the position of the last transaction in it
+type relaySegment struct {
+	segment  int
+	file     string
+	position uint32
+	partial  bool
+}
+
+// prune deletes the files read to the end whose transactions have all been checkpointed by the sink and returns the
+// files left
+func (l *RelayLog) prune(ctx context.Context, finished []relaySegment) ([]relaySegment, error) {
+	if len(finished) == 0 {
+		return finished, nil
+	}
+	checkpoint, err := l.readCheckpoint(ctx)
+	if err != nil {
+		return finished, errors.WithStack(err)
+	}
+	if checkpoint == nil {
+		return finished, nil
+	}
+	for len(finished) > 0 {
+		last := relayRecord{File: finished[0].file, Position: finished[0].position, Partial: finished[0].partial}
+		if !last.before(*checkpoint) {
+			break
+		}
+		err = l.remove(finished[0].segment)
+		if err != nil {
+			return finished, errors.WithStack(err)
+		}
+		finished = finished[1:]
+	}
+	return finished, nil
+}
+
+// before returns true if the checkpoint covers the transaction of the record. The pieces of a large transaction have
+// the position before the transaction so they're only covered by a later checkpoint.
+func (r *relayRecord) before(checkpoint Position) bool {
+	compared := comparePosition(r.File, r.Position, checkpoint)
+	if r.Partial {
+		return compared < 0
+	}
+	return compared <= 0
+}
+
+func comparePosition(file string, position uint32, other Position) int {
+	return mysql.Position{Name: file, Pos: position}.Compare(mysql.Position{Name: other.File, Pos: other.Position})
+}
+
+// readCheckpoint returns the checkpoint of the sink or nil if nothing has been delivered yet
+func (l *RelayLog) readCheckpoint(ctx context.Context) (*Position, error) {
+	file, position, _, err := l.sink.ReadCheckpoint(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Position{File: file, Position: position}, nil
+}
+
+func (l *RelayLog) remove(segment int) error {
+	path := l.path(segment)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	l.mutex.Lock()
+	l.bytes -= stat.Size()
+	relayLogBytes.WithLabelValues(l.config.TaskName).Set(float64(l.bytes))
+	l.mutex.Unlock()
+	logrus.WithField("task", "replicate").Debugf("deleted %s, the sink has checkpointed everything in it", path)
+	return nil
+}
+
+func (l *RelayLog) path(segment int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%06d", relayLogPrefix, segment))
+}
+
+// segments returns the numbers of the files of the relay log oldest first
+func (l *RelayLog) segments() ([]int, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var segments []int
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), relayLogPrefix) {
+			continue
+		}
+		segment, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), relayLogPrefix))
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	for i := 1; i < len(segments); i++ {
+		if segments[i] != segments[i-1]+1 {
+			return nil, errors.Errorf("relay log file %s is missing from %s", l.path(segments[i-1]+1), l.dir)
+		}
+	}
+	return segments, nil
+}
+
+// transaction converts the record back to a transaction with the tables of the TransactionStream
+func (r *relayRecord) transaction(tables map[string]*Table) (Transaction, error) {
+	transaction := Transaction{
+		FinalPosition: Position{File: r.File, Position: r.Position},
+		LogicalClock:  r.LogicalClock,
+		Partial:       r.Partial,
+		Piece:         r.Piece,
+		Mutations:     make([]Mutation, len(r.Mutations)),
+	}
+	if r.Gset != "" {
+		gset, err := parseGTIDSet(r.Gset)
+		if err != nil {
+			return transaction, errors.WithStack(err)
+		}
+		transaction.FinalPosition.Gset = gset
+	}
+	for i, mutation := range r.Mutations {
+		table, ok := tables[mutation.Table]
+		if !ok {
+			return transaction, errors.Errorf("the relay log has a transaction at %s:%d for table %s which isn't replicated",
+				r.File, r.Position, mutation.Table)
+		}
+		transaction.Mutations[i] = Mutation{
+			Type:                mutation.Type,
+			Table:               table,
+			Rows:                mutation.Rows,
+			Before:              mutation.Before,
+			ColumnsBitmap:       mutation.ColumnsBitmap,
+			BeforeColumnsBitmap: mutation.BeforeColumnsBitmap,
+		}
+	}
+	return transaction, nil
+}
+
+// encodeRelayRecord encodes a record with its length and checksum in front, each record is gob encoded on its own so
+// that it can be read without the records before it
+func encodeRelayRecord(record *relayRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, relayRecordHeaderSize))
+	err := gob.NewEncoder(&buf).Encode(record)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not encode the transaction at %s:%d for the relay log", record.File, record.Position)
+	}
+	data := buf.Bytes()
+	payload := data[relayRecordHeaderSize:]
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	return data, nil
+}
+
+// scanRelaySegment calls f with every complete record of a file from offset to end (or the end of the file if end is
+// negative) and returns the offset after the last complete record
+func scanRelaySegment(path string, offset int64, end int64, f func(record *relayRecord, end int64) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && offset == 0 {
+			// Nothing has been appended to it yet
+			return 0, nil
+		}
+		return offset, errors.WithStack(err)
+	}
+	defer file.Close()
+	if end < 0 {
+		stat, err := file.Stat()
+		if err != nil {
+			return offset, errors.WithStack(err)
+		}
+		end = stat.Size()
+	}
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, offset, end-offset), 64*1024)
+	header := make([]byte, relayRecordHeaderSize)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return offset, nil
+			}
+			return offset, errors.WithStack(err)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return offset, nil
+			}
+			return offset, errors.WithStack(err)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, errors.Errorf("corrupt relay log record in %s at offset %d", path, offset)
+		}
+		var record relayRecord
+		err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&record)
+		if err != nil {
+			return offset, errors.Wrapf(err, "could not decode relay log record in %s at offset %d", path, offset)
+		}
+		offset += int64(relayRecordHeaderSize + len(payload))
+		err = f(&record, offset)
+		if err != nil {
+			return offset, errors.WithStack(err)
+		}
+	}
+}
+
+// truncateRelaySegment cuts off a partially written record at the end of a file and returns its new size
+func truncateRelaySegment(path string, valid int64) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if stat.Size() == valid {
+		return valid, nil
+	}
+	logrus.WithField("task", "replicate").
+		Warnf("truncating partially written transaction at the end of %s", path)
+	return valid, errors.WithStack(os.Truncate(path, valid))
+}
@@ -0,0 +1,116 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayLog(t *testing.T) {
+	dir := t.TempDir()
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	stream := &TransactionStream{tables: []*Table{table}}
+	sink := &checkpointSink{}
+	config := Replicate{TaskName: "test", RelayLogDir: dir, RelayLogMaxSize: 300}
+
+	transaction := func(position uint32, partial bool) Transaction {
+		gset, err := mysql.ParseMysqlGTIDSet(fmt.Sprintf("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-%d", position/100))
+		require.NoError(t, err)
+		return Transaction{
+			Mutations: []Mutation{{
+				Type:          Update,
+				Table:         table,
+				Before:        [][]interface{}{{int64(position), nil, []byte("before")}},
+				Rows:          [][]interface{}{{int64(position), "name", []byte("after")}},
+				ColumnsBitmap: []bool{true, true, true},
+			}},
+			FinalPosition: Position{File: "mysql-bin.000001", Position: position, Gset: gset},
+			LogicalClock:  LogicalClock{File: "mysql-bin.000001", LastCommitted: 1, SequenceNumber: int64(position)},
+			Partial:       partial,
+		}
+	}
+
+	relay, err := NewRelayLog(config, sink, stream)
+	require.NoError(t, err)
+	require.NoError(t, relay.Init(context.Background()))
+	_, ok, err := relay.lastPosition()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	for _, position := range []uint32{100, 200, 300} {
+		require.NoError(t, relay.append(transaction(position, false)))
+	}
+	// The first pieces of a large transaction after 300
+	require.NoError(t, relay.append(transaction(300, true)))
+	require.NoError(t, relay.append(transaction(300, true)))
+	segments, err := relay.segments()
+	require.NoError(t, err)
+	assert.Greater(t, len(segments), 1, "the relay log should have been rotated")
+
+	// A restart truncates a partially written transaction and continues after the last complete transaction
+	file, err := os.OpenFile(relay.path(segments[len(segments)-1]), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	relay, err = NewRelayLog(config, sink, stream)
+	require.NoError(t, err)
+	require.NoError(t, relay.Init(context.Background()))
+	last, ok, err := relay.lastPosition()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, uint32(300), last.Position)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-3", last.Gset.String())
+	assert.Equal(t, 2, relay.pieces)
+	require.NoError(t, relay.append(transaction(400, false)))
+
+	// The sink has checkpointed 200 so delivery starts at 300
+	sink.setCheckpoint(Position{File: "mysql-bin.000001", Position: 200})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	output := make(chan Transaction)
+	done := make(chan error)
+	go func() {
+		done <- relay.Run(ctx, backoff.NewConstantBackOff(time.Millisecond), output)
+	}()
+	var delivered []Transaction
+	for i := 0; i < 4; i++ {
+		delivered = append(delivered, <-output)
+	}
+	assert.Equal(t, transaction(300, false), delivered[0])
+	assert.Equal(t, transaction(300, true), delivered[1])
+	assert.Equal(t, transaction(300, true), delivered[2])
+	assert.Equal(t, transaction(400, false), delivered[3])
+	assert.Same(t, table, delivered[0].Mutations[0].Table)
+
+	// Transactions appended later are delivered as well
+	require.NoError(t, relay.append(transaction(500, false)))
+	assert.Equal(t, transaction(500, false), <-output)
+	cancel()
+	<-done
+
+	// Each transaction has a file of its own, the reader deleted the files before the checkpoint
+	remaining, err := relay.segments()
+	require.NoError(t, err)
+	assert.Equal(t, segments[2:], remaining[:len(segments)-2])
+
+	// The others are deleted once everything in them has been checkpointed
+	sink.setCheckpoint(Position{File: "mysql-bin.000001", Position: 300})
+	finished := []relaySegment{
+		{segment: remaining[0], file: "mysql-bin.000001", position: 300},
+		{segment: remaining[1], file: "mysql-bin.000001", position: 300, partial: true},
+	}
+	finished, err = relay.prune(context.Background(), finished)
+	require.NoError(t, err)
+	assert.Len(t, finished, 1, "the pieces of the transaction after the checkpoint have to be kept")
+	_, err = os.Stat(relay.path(remaining[0]))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(relay.path(remaining[1]))
+	assert.NoError(t, err)
+}
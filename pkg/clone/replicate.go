@@ -64,6 +64,27 @@ var (
 		},
 		[]string{"task"},
 	)
+	transactionPieces = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_transaction_pieces",
+			Help: "How many pieces of transactions larger than --large-transaction-rows have been sent to the sink",
+		},
+		[]string{"task"},
+	)
+	loopedTransactions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_looped_transactions",
+			Help: "How many transactions written by the replication task in the other direction were skipped with --loop-prevention",
+		},
+		[]string{"task"},
+	)
+	replicationConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_conflicts",
+			Help: "How many rows were modified on both sides within --conflict-window",
+		},
+		[]string{"task", "table"},
+	)
 	heartbeatsRead = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "heartbeats_read",
@@ -90,6 +111,9 @@ func init() {
 	prometheus.MustRegister(replicationParallelism)
 	prometheus.MustRegister(replicationParallelismBatchSize)
 	prometheus.MustRegister(replicationParallelismApplyDuration)
+	prometheus.MustRegister(transactionPieces)
+	prometheus.MustRegister(loopedTransactions)
+	prometheus.MustRegister(replicationConflicts)
 }
 
 type Replicate struct {
@@ -111,6 +135,15 @@ type Replicate struct {
 	ChunkBufferSize      int           `help:"Size of internal queues" default:"100"`
 	ReconnectTimeout     time.Duration `help:"How long to try to reconnect after a replication failure (set to 0 to retry forever)" default:"5m"`
 
+	SnapshotMode          string        `help:"How snapshot chunks are placed in the binlogs to reconcile them: 'watermark' writes low and high watermarks to --watermark-table on the source around each chunk read, 'gtid' reads each chunk in a consistent snapshot placed by gtid_executed and writes nothing to the source (needs gtid_mode=ON and binlog_order_commits=ON)" enum:"watermark,gtid" default:"watermark"`
+	SnapshotReader        DBConfig      `help:"Database config of a replica of the source to read snapshot chunks from, the watermarks are still written to the source and each chunk is read once the replica has replicated its low watermark" prefix:"snapshot-reader-" embed:""`
+	SnapshotReaderTimeout time.Duration `help:"How long to wait for the --snapshot-reader to replicate the low watermark of a chunk" default:"5m"`
+	SnapshotProgressTable string        `help:"Name of the table on the target that records how far the snapshot of each table has come, in the same transaction as each repair, so that a snapshot interrupted by a restart is resumed" optional:"" default:"_cloner_snapshot_progress"`
+
+	SnapshotPacingLagTarget          time.Duration `help:"Replication lag (measured by the heartbeats) above which fewer snapshot chunks are read at a time, in proportion to how far the lag is above it, 0 disables" default:"0"`
+	SnapshotPacingLagCeiling         time.Duration `help:"Replication lag (measured by the heartbeats) at which snapshot chunk reads pause until it drops again, 0 disables" default:"0"`
+	SnapshotPacingApplyLatencyTarget time.Duration `help:"Average time to apply a transaction (or a batch of transactions with parallel replication) above which fewer snapshot chunks are read at a time, in proportion to how far it is above it, 0 disables" default:"0"`
+
 	DoSnapshot                               bool          `help:"Automatically starts a snapshot after running replication for 60s (configurable via --do-snapshot-delay)" default:"false"`
 	DoSnapshotTables                         []string      `help:"Snapshot only these tables"`
 	DoSnapshotMaxReplicationLag              time.Duration `help:"Start snapshot when replication lag drops below this" default:"10s"`
@@ -119,8 +152,63 @@ type Replicate struct {
 	ReplicationParallelism          int           `help:"Many transactions to apply in parallel during replication" default:"1"`
 	ParallelTransactionBatchMaxSize int           `help:"How large batch of transactions to parallelize" default:"100"`
 	ParallelTransactionBatchTimeout time.Duration `help:"How long to wait for a batch of transactions to fill up before executing them anyway" default:"5s"`
+	ParallelApply                   string        `help:"How to find the transactions that can be applied in parallel: 'keys' compares the keys of the rows written, 'logical-clock' uses the last_committed and sequence_number MySQL writes to the binlog, transactions without them are applied serially" enum:"keys,logical-clock" default:"keys"`
+	AppliedTable                    string        `help:"Name of the table on the target that parallel replication records the transactions applied since the last checkpoint in, in the same target transaction, so that a restart skips them instead of applying them again" optional:"" default:"_cloner_applied"`
+	ParallelApplyCompare            bool          `help:"Also schedule each batch with the other --parallel-apply mode to compare the parallelism they achieve in the replication_parallelism_estimate metric, costs CPU" default:"false"`
+	LargeTransactionRows            int           `help:"Transactions with more rows than this are sent to the sink in pieces as they are read instead of being buffered in memory, the MySQL sink still applies them in a single target transaction. Set to 0 to always buffer whole transactions" default:"0"`
+	SplitLargeTransactions          bool          `help:"Commit each piece of a large transaction (see --large-transaction-rows) in a separate target transaction, the target is not consistent until the last piece has been committed. A restart applies the whole transaction again" default:"false"`
 	StartingGTID                    string        `help:"When starting a new replication this GTID set as the starting point" xor:"starting_gtid"`
 	StartAtLastSourceGTID           bool          `help:"When starting a new replication use the value of the 'target_gtid' of the source checkpoint table" xor:"starting_gtid"`
+	StartingPosition                string        `help:"When starting a new replication use this binlog file and position as the starting point, in the format file:position" xor:"starting_gtid"`
+	StartAtTime                     time.Time     `help:"When starting a new replication start from the first transaction at or after this time, in RFC3339 format, found by scanning the binlogs of the source or --binlog-dir" xor:"starting_gtid"`
+
+	StopAtGTID     string    `help:"Stop replication cleanly and exit once this GTID set has been applied" optional:""`
+	StopAtPosition string    `help:"Stop replication cleanly and exit once the source binlog position in the format file:position has been applied" optional:""`
+	StopAtTime     time.Time `help:"Stop replication cleanly and exit before the first transaction committed on the source after this time, in RFC3339 format" optional:""`
+
+	LoopPrevention bool          `help:"Run replication in both directions at once: every transaction written to the target also writes to --origin-table, and transactions in the source binlogs that write to it are skipped since they were written by the replication task in the other direction" default:"false"`
+	OriginTable    string        `help:"Name of the table that marks the transactions written by replication with --loop-prevention, on the target and on the source" optional:"" default:"_cloner_origin"`
+	ConflictWindow time.Duration `help:"With --loop-prevention report rows modified on both sides within this window in the log and the 'replication_conflicts' metric, set to 0 to disable" default:"1m"`
+
+	ConflictPolicy string `help:"Verify every replicated row against the target before writing it: the before image of an update or delete has to match the target row and an inserted row must not exist with other values. 'off' doesn't verify, 'overwrite' writes the row anyway, 'skip' leaves the target row as it is, 'halt' stops replication and 'log' leaves the target row and records the conflict in --conflict-table. Conflicts are counted in the 'replication_target_conflicts' metric" enum:"off,overwrite,skip,halt,log" default:"off"`
+	ConflictTable  string `help:"Name of the table on the target that --conflict-policy=log records conflicts in" optional:"" default:"_cloner_conflict"`
+
+	DirtyChunkSize  int64  `help:"Record the key ranges of this size that replication writes to in --dirty-chunk-table, in the same target transaction as the checkpoint, so that cutover can checksum the chunks written to recently. Tables without a single integer key column are recorded as a whole. 0 disables" default:"0"`
+	DirtyChunkTable string `help:"Name of the table on the target that the key ranges written by replication are recorded in" optional:"" default:"_cloner_dirty_chunk"`
+
+	SourceCandidates       []string `help:"Source hosts to fail over to when replication can't continue from the current source host: the first reachable writable host, or else a replica with log_replica_updates, whose executed GTID set contains the checkpoint is used and replication continues on it by GTID. Checked whenever replication (re)connects and counted in the 'replication_source_failovers' metric"`
+	SourceDiscoveryCommand string   `help:"Command that prints more candidate source hosts for --source-candidates, separated by whitespace, run whenever replication (re)connects" optional:""`
+
+	PurgedBinlogs string `help:"What to do when the binlogs to continue replication from have been purged from the source, checked against gtid_purged or the binlog files of the source whenever replication (re)connects: 'halt' stops replication and 'snapshot' continues from the current position of the source and requests a snapshot in --snapshot-request-table to repair the target" enum:"halt,snapshot" default:"halt"`
+
+	BinlogDir             string        `help:"Read binlog events from the binlog files in this directory instead of streaming them from the source, starting at the oldest file unless there is a checkpoint or a starting point and following new files as they appear. Table definitions are read from the target so no source connection is needed, --source-database names the schema of the replicated events." optional:"" type:"path"`
+	BinlogDirPollInterval time.Duration `help:"How often to check for new events at the end of the newest file in --binlog-dir" default:"1s"`
+
+	Sink               string        `help:"Where to deliver the replicated transactions: 'mysql' applies them to the target, 'jsonl' appends them to a JSON Lines file and 'http' posts them to a webhook, heartbeats are only written with the mysql sink" enum:"mysql,jsonl,http" default:"mysql"`
+	SinkFile           string        `help:"Path of the JSON Lines file of the jsonl sink, rotated files get a timestamp suffix" optional:"" type:"path"`
+	SinkFileMaxSize    int64         `help:"Rotate the JSON Lines file of the jsonl sink when it grows above this many bytes, 0 disables rotation" default:"104857600"`
+	SinkURL            string        `help:"URL the http sink posts batches of transactions to as JSON Lines" name:"sink-url" optional:""`
+	SinkHeaders        []string      `help:"Extra headers sent by the http sink in the format name=value"`
+	SinkCheckpointFile string        `help:"File the http sink saves the checkpoint in after each batch is delivered" optional:"" type:"path"`
+	SinkBatchSize      int           `help:"Maximum number of transactions per batch of the jsonl and http sinks" default:"100"`
+	SinkBatchTimeout   time.Duration `help:"How long to wait for a batch of the jsonl and http sinks to fill up before delivering it anyway" default:"1s"`
+
+	RelayLogDir     string `help:"Persist the transactions read from the source in files in this directory and deliver them to the sink from there, so reading from the source continues while the sink is unavailable and a restart continues reading where the relay log ends. Files are deleted once the sink has checkpointed all the transactions in them" optional:"" type:"path"`
+	RelayLogMaxSize int64  `help:"Start a new relay log file when the current one grows above this many bytes" default:"104857600"`
+
+	// sourceHost is shared by everything that connects to the source when replication can fail over, see sourceDB
+	sourceHost *sourceHost
+}
+
+// isInternalTable returns true for the tables cloner itself writes to
+func (cmd *Replicate) isInternalTable(name string) bool {
+	switch name {
+	case cmd.SnapshotRequestTable, cmd.HeartbeatTable, cmd.WatermarkTable, cmd.CheckpointTable, cmd.OriginTable,
+		cmd.ConflictTable, cmd.AppliedTable, cmd.SnapshotProgressTable, cmd.DirtyChunkTable:
+		return true
+	default:
+		return false
+	}
 }
 
 // Run replicates from source to target
@@ -153,6 +241,26 @@ func (cmd *Replicate) Run() error {
 }
 
 func (cmd *Replicate) run(ctx context.Context) error {
+	if cmd.BinlogDir != "" && cmd.DoSnapshot {
+		return errors.Errorf("--do-snapshot can't be used with --binlog-dir since snapshots are read from the source")
+	}
+	if cmd.LoopPrevention && !cmd.usesMySQLSink() {
+		return errors.Errorf("--loop-prevention needs the mysql sink to mark the transactions it writes")
+	}
+	if cmd.failsOver() {
+		err := cmd.checkFailover()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		cmd.sourceHost = newSourceHost(cmd.Source)
+	}
+
+	err := cmd.StartHealthThrottler(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer cmd.Health.Stop()
+
 	replicator, err := NewReplicator(*cmd)
 	if err != nil {
 		return errors.WithStack(err)
@@ -179,7 +287,7 @@ func (cmd *Replicate) run(ctx context.Context) error {
 					lag, cmd.DoSnapshotMaxReplicationLag, delay)
 				time.Sleep(delay)
 			}
-			err := replicator.snapshotter.start(ctx)
+			err := replicator.snapshotter.start(ctx, nil, true)
 			if err != nil {
 				logrus.Errorf("failed to snapshot: %v", err)
 			}
@@ -212,7 +320,10 @@ type Replicator struct {
 	snapshotter         *Snapshotter
 	heartbeat           *Heartbeat
 	transactionStreamer *TransactionStream
-	transactionWriter   *TransactionWriter
+	sink                Sink
+	stop                *ReplicationStop
+	// relay is only set with --relay-log-dir
+	relay *RelayLog
 }
 
 func NewReplicator(config Replicate) (*Replicator, error) {
@@ -226,21 +337,46 @@ func NewReplicator(config Replicate) (*Replicator, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	r.heartbeat, err = NewHeartbeat(r.config)
+	// Heartbeats are read back from the target so they only work when we write to a MySQL target, they are written to
+	// the source so they don't work when we read from binlog files
+	if r.config.usesMySQLSink() && r.config.BinlogDir == "" {
+		r.heartbeat, err = NewHeartbeat(r.config)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	r.sink, err = NewSink(r.config)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	r.transactionWriter, err = NewTransactionWriter(r.config)
+	// The snapshot chunk reads are paced by the lag and how long the writer takes to apply transactions
+	if r.heartbeat != nil && r.config.HeartbeatFrequency > 0 {
+		r.snapshotter.pacer.lag = r.heartbeat.getReplicationLag
+	}
+	if writer, ok := r.sink.(*TransactionWriter); ok {
+		writer.pacer = r.snapshotter.pacer
+	}
+
+	r.stop, err = NewReplicationStop(r.config)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	r.transactionStreamer, err = NewTransactionStreamer(r.config)
+	r.transactionStreamer, err = NewTransactionStreamer(r.config, r.sink, r.stop)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	if r.config.RelayLogDir != "" {
+		r.relay, err = NewRelayLog(r.config, r.sink, r.transactionStreamer)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		r.transactionStreamer.relay = r.relay
+	}
+
 	return &r, nil
 }
 
@@ -249,13 +385,59 @@ func (r *Replicator) run(ctx context.Context) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	return restartFromCheckpoint(ctx, r.config.ReconnectBackoff(), r.replicate)
+}
+
+// errRestartFromCheckpoint is returned by a stage that can't continue from where the stream is, every stage is then
+// restarted so that the stream is read again from the checkpoint of the sink
+var errRestartFromCheckpoint = errors.New("replication has to restart from the checkpoint")
+
+// consecutiveRestartInterval is how long a replication run has to last for its restart to not back off further, it's the
+// longest interval of the default exponential backoff
+const consecutiveRestartInterval = time.Minute
+
+// restartFromCheckpoint runs replication until it fails with something other than errRestartFromCheckpoint
+func restartFromCheckpoint(ctx context.Context, b backoff.BackOff, replicate func(ctx context.Context) error) error {
+	for {
+		start := time.Now()
+		err := replicate(ctx)
+		if !errors.Is(err, errRestartFromCheckpoint) {
+			return err
+		}
+		if time.Since(start) > consecutiveRestartInterval {
+			b.Reset()
+		}
+		logrus.WithError(err).Warnf("restarting replication from the checkpoint: %+v", err)
+		sleepTime := b.NextBackOff()
+		if sleepTime == backoff.Stop {
+			return errors.Wrapf(err, "failed to restart replication after retries")
+		}
+		select {
+		case <-time.After(sleepTime):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
 
+// replicate runs every stage of replication from the checkpoint of the sink until one of them fails
+func (r *Replicator) replicate(ctx context.Context) error {
 	g, ctx := errgroup.WithContext(ctx)
 
 	transactions := make(chan Transaction, r.config.ReplicationParallelism)
-	g.Go(RestartLoop(ctx, r.config.ReconnectBackoff(), func(b backoff.BackOff) error {
-		return r.transactionStreamer.Run(ctx, b, transactions)
-	}))
+	if r.relay != nil {
+		// Reading from the source and delivering to the sink are decoupled by the relay log
+		g.Go(RestartLoop(ctx, r.config.ReconnectBackoff(), func(b backoff.BackOff) error {
+			return r.relay.Capture(ctx, b)
+		}))
+		g.Go(RestartLoop(ctx, r.config.ReconnectBackoff(), func(b backoff.BackOff) error {
+			return r.relay.Run(ctx, b, transactions)
+		}))
+	} else {
+		g.Go(RestartLoop(ctx, r.config.ReconnectBackoff(), func(b backoff.BackOff) error {
+			return r.transactionStreamer.Run(ctx, b, transactions)
+		}))
+	}
 
 	transactionsAfterSnapshot := make(chan Transaction, r.config.ReplicationParallelism)
 	g.Go(RestartLoop(ctx, r.config.ReconnectBackoff(), func(b backoff.BackOff) error {
@@ -263,15 +445,23 @@ func (r *Replicator) run(ctx context.Context) error {
 	}))
 
 	g.Go(RestartLoop(ctx, r.config.ReconnectBackoff(), func(b backoff.BackOff) error {
-		return r.transactionWriter.Run(ctx, b, transactionsAfterSnapshot)
+		return r.sink.Run(ctx, b, transactionsAfterSnapshot)
 	}))
 
-	if r.config.HeartbeatFrequency > 0 {
+	if r.heartbeat != nil && r.config.HeartbeatFrequency > 0 {
 		g.Go(RestartLoop(ctx, r.config.ReconnectBackoff(), func(b backoff.BackOff) error {
 			return r.heartbeat.Run(ctx, b)
 		}))
 	}
-	err = g.Wait()
+	if r.stop != nil {
+		g.Go(func() error {
+			return r.stop.Wait(ctx, r.sink)
+		})
+	}
+	err := g.Wait()
+	if errors.Is(err, errStopReached) {
+		return errors.WithStack(r.stop.Report(context.Background(), r.sink))
+	}
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -290,6 +480,10 @@ func RestartLoop(ctx context.Context, b backoff.BackOff, loop func(b backoff.Bac
 			if errors.Is(err, context.Canceled) {
 				return errors.WithStack(err)
 			}
+			var permanent *backoff.PermanentError
+			if errors.As(err, &permanent) {
+				return errors.WithStack(err)
+			}
 			logrus.WithError(err).Errorf("replication write loop failed, restarting: %+v", err)
 			sleepTime := b.NextBackOff()
 			if sleepTime == backoff.Stop {
@@ -305,21 +499,34 @@ func RestartLoop(ctx context.Context, b backoff.BackOff, loop func(b backoff.Bac
 }
 
 func (r *Replicator) init(ctx context.Context) error {
-	err := r.snapshotter.Init(ctx)
-	if err != nil {
-		return errors.WithStack(err)
+	var err error
+	// There is no source to snapshot from when we read from binlog files
+	if r.config.BinlogDir == "" {
+		err = r.snapshotter.Init(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	}
 
-	err = r.heartbeat.Init(ctx)
-	if err != nil {
-		return errors.WithStack(err)
+	if r.heartbeat != nil {
+		err = r.heartbeat.Init(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	}
 
-	err = r.transactionWriter.Init(ctx)
+	err = r.sink.Init(ctx)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	if r.relay != nil {
+		err = r.relay.Init(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
 	err = r.transactionStreamer.Init(ctx)
 	if err != nil {
 		return errors.WithStack(err)
@@ -328,6 +535,11 @@ func (r *Replicator) init(ctx context.Context) error {
 	return nil
 }
 
+// GetReplicationLag returns the replication lag measured by the heartbeats, it's always zero when there are no
+// heartbeats since the sink isn't MySQL
 func (r *Replicator) GetReplicationLag() time.Duration {
+	if r.heartbeat == nil {
+		return 0
+	}
 	return r.heartbeat.getReplicationLag()
 }
@@ -41,6 +41,45 @@ func TestReplicateParallel(t *testing.T) {
 	})
 }
 
+func TestReplicateSnapshotReader(t *testing.T) {
+	doTestReplicate(t, func(replicate *Replicate) {
+		replicate.ReplicationParallelism = 1
+		// The source is a replica of itself, the chunks are still only read once the low watermark can be read back
+		replicate.SnapshotReader = replicate.Source
+	})
+}
+
+func TestReplicateGTIDSnapshot(t *testing.T) {
+	doTestReplicate(t, func(replicate *Replicate) {
+		replicate.ReplicationParallelism = 1
+		replicate.SnapshotMode = SnapshotModeGTID
+	})
+}
+
+func TestRestartFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	runs := 0
+	err := restartFromCheckpoint(ctx, backoff.NewConstantBackOff(time.Millisecond), func(ctx context.Context) error {
+		runs++
+		if runs < 3 {
+			return backoff.Permanent(errors.Wrapf(errRestartFromCheckpoint, "run %d", runs))
+		}
+		return errRollback
+	})
+	assert.Equal(t, 3, runs)
+	assert.Equal(t, errRollback, err)
+
+	// Restarts give up with the backoff
+	runs = 0
+	err = restartFromCheckpoint(ctx, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), 1),
+		func(ctx context.Context) error {
+			runs++
+			return errRestartFromCheckpoint
+		})
+	assert.Equal(t, 2, runs)
+	assert.True(t, errors.Is(err, errRestartFromCheckpoint))
+}
+
 func TestReverseReplication(t *testing.T) {
 	var err error
 	ctx, cancel := context.WithCancel(context.Background())
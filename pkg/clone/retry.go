@@ -17,6 +17,11 @@ type RetryOptions struct {
 	AcquireMetric prometheus.Observer
 	MaxRetries    uint64
 	Timeout       time.Duration
+	// Throttle limits the rows and bytes per second, it's not applied by Retry itself since the size is only known
+	// after a read, see bufferChunk and Writer.writeBatch
+	Throttle *Throttle
+	// Health is waited on before each attempt so that reads and writes back off while the servers are unhealthy
+	Health *HealthThrottler
 }
 
 // Retry retries with back off
@@ -36,6 +41,8 @@ func Retry(ctx context.Context, options RetryOptions, f func(context.Context) er
 			}
 		}()
 
+		options.Health.WaitForGoodLag(ctx)
+
 		if options.Limiter != nil {
 			acquireTimer := prometheus.NewTimer(options.AcquireMetric)
 			token, ok := options.Limiter.Acquire(ctx)
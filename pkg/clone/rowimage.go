@@ -0,0 +1,198 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// transactionPayloadEvent is the TRANSACTION_PAYLOAD_EVENT MySQL 8.0.20+ writes with binlog_transaction_compression=ON,
+// the events of the transaction are compressed inside it. The binlog parser we use reads it as a GenericEvent.
+//
+//nolint:nosnakecase
+const transactionPayloadEvent replication.EventType = 40
+
+// errCompressedTransaction explains why we can't replicate from binlogs with compressed transactions
+var errCompressedTransaction = errors.New("the binlogs contain compressed transactions " +
+	"(binlog_transaction_compression=ON) which cloner can't decode, turn it off on the source with " +
+	"SET GLOBAL binlog_transaction_compression = OFF and restart replication from before the compressed transactions")
+
+// checkBinlogTransactionCompression refuses to replicate from a source with binlog_transaction_compression=ON, the
+// variable doesn't exist before MySQL 8.0.20 in which case transactions are never compressed
+func checkBinlogTransactionCompression(ctx context.Context, source *sql.DB) error {
+	var compression int
+	err := source.QueryRowContext(ctx, "SELECT @@GLOBAL.binlog_transaction_compression").Scan(&compression)
+	if err != nil {
+		if mysqlError(err) != nil {
+			// Unknown system variable
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	if compression != 0 {
+		return errors.WithStack(errCompressedTransaction)
+	}
+	return nil
+}
+
+// columnsBitmap converts the column bitmap of a rows event to a bitmap of the columns present in the row image, it
+// returns nil for a full row image (binlog_row_image=FULL) which is the common case
+func columnsBitmap(bitmap []byte, columnCount int) []bool {
+	full := true
+	result := make([]bool, columnCount)
+	for i := range result {
+		if i/8 < len(bitmap) && bitmap[i/8]&(1<<(uint(i)%8)) != 0 {
+			result[i] = true
+		} else {
+			full = false
+		}
+	}
+	if full {
+		return nil
+	}
+	return result
+}
+
+// hasColumn returns true if the column is present in the rows of the mutation
+func (m *Mutation) hasColumn(i int) bool {
+	return m.ColumnsBitmap == nil || m.ColumnsBitmap[i]
+}
+
+// fillKeyColumns copies the key columns from the before image to an after image that is missing them, with
+// binlog_row_image=MINIMAL the after image of an update only has the columns that changed. The key columns are always
+// in the before image since that is how MySQL identifies the row.
+func fillKeyColumns(table *Table, beforeBitmap []bool, afterBitmap []bool, before [][]interface{}, after [][]interface{}) ([]bool, error) {
+	var keyColumns []int
+	keyColumns = append(keyColumns, table.KeyColumnIndexes...)
+	if table.MysqlTable != nil {
+		keyColumns = append(keyColumns, table.MysqlTable.PKColumns...)
+	}
+	for _, i := range keyColumns {
+		if beforeBitmap != nil && !beforeBitmap[i] {
+			return nil, errors.Errorf("the partial row images of %s are missing the key column %s, "+
+				"cloner needs the columns the table is chunked by in every row image, use binlog_row_image=FULL",
+				table.Name, table.Columns[i])
+		}
+	}
+	if afterBitmap == nil {
+		return nil, nil
+	}
+	for _, i := range keyColumns {
+		if afterBitmap[i] {
+			continue
+		}
+		for j := range after {
+			after[j][i] = before[j][i]
+		}
+		afterBitmap[i] = true
+	}
+	return afterBitmap, nil
+}
+
+// mergeRow returns a copy of row with the columns present in the partial row image replaced
+func mergeRow(row []interface{}, image []interface{}, bitmap []bool) []interface{} {
+	if bitmap == nil {
+		return image
+	}
+	result := make([]interface{}, len(row))
+	copy(result, row)
+	for i, present := range bitmap {
+		if present {
+			result[i] = image[i]
+		}
+	}
+	return result
+}
+
+// errPartialRowImage is returned when a partial row image has to be reconciled with a chunk being snapshotted but
+// there is no row in the chunk to fill in the missing columns from
+func errPartialRowImage(mutation Mutation) error {
+	return errors.Errorf("can't reconcile a partial row image of %s with the chunk being snapshotted since the row isn't "+
+		"in the chunk, snapshot with binlog_row_image=FULL on the source", mutation.Table.Name)
+}
+
+// update writes a partial after image with an UPDATE of the columns present in it, a REPLACE would overwrite the
+// missing columns
+func (m *Mutation) update(ctx context.Context, tx DBWriter) (err error) {
+	tableSchema := m.Table.MysqlTable
+	tableName := tableSchema.Name
+	writeType := m.Type.String()
+	timer := prometheus.NewTimer(writeDuration.WithLabelValues(tableName, writeType))
+	defer timer.ObserveDuration()
+	defer func() {
+		if err == nil {
+			writesSucceeded.WithLabelValues(tableName, writeType).Add(float64(len(m.Rows)))
+		} else {
+			mySQLError := mysqlError(err)
+			var errorCode uint16
+			if mySQLError != nil {
+				errorCode = mySQLError.Number
+			}
+			writesFailed.WithLabelValues(tableName, writeType, strconv.Itoa(int(errorCode))).
+				Add(float64(len(m.Rows)))
+		}
+	}()
+
+	isKey := make(map[int]bool, len(tableSchema.PKColumns))
+	for _, i := range tableSchema.PKColumns {
+		isKey[i] = true
+	}
+	var columns []int
+	for i := range tableSchema.Columns {
+		if m.hasColumn(i) && !isKey[i] && !m.Table.IgnoredColumnsBitmap[i] {
+			columns = append(columns, i)
+		}
+	}
+	if len(columns) == 0 {
+		// Only key or ignored columns changed, the key columns can't change so there's nothing to write
+		return nil
+	}
+
+	var stmt strings.Builder
+	stmt.WriteString("UPDATE `")
+	stmt.WriteString(tableName)
+	stmt.WriteString("` SET ")
+	for j, i := range columns {
+		if j > 0 {
+			stmt.WriteString(", ")
+		}
+		stmt.WriteString("`")
+		stmt.WriteString(tableSchema.Columns[i].Name)
+		stmt.WriteString("` = ?")
+	}
+	stmt.WriteString(" WHERE ")
+	for j, i := range tableSchema.PKColumns {
+		if j > 0 {
+			stmt.WriteString(" AND ")
+		}
+		stmt.WriteString("`")
+		stmt.WriteString(tableSchema.Columns[i].Name)
+		stmt.WriteString("` = ?")
+	}
+	stmtString := stmt.String()
+
+	for _, row := range m.Rows {
+		if len(row) != len(m.Table.Columns) {
+			panic(fmt.Sprintf("row column count %d doesn't match the cached table schema columns: %v (%v)",
+				len(row), m.Table.Name, m.Table.ColumnList))
+		}
+		args := make([]interface{}, 0, len(columns)+len(tableSchema.PKColumns))
+		for _, i := range columns {
+			args = append(args, row[i])
+		}
+		for _, i := range tableSchema.PKColumns {
+			args = append(args, row[i])
+		}
+		_, err = tx.ExecContext(ctx, stmtString, args...)
+		if err != nil {
+			return errors.Wrapf(err, "could not execute: %s", stmtString)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package clone
+
+import (
+	"context"
+	"testing"
+
+	mysqlschema "github.com/go-mysql-org/go-mysql/schema"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnsBitmap(t *testing.T) {
+	assert.Nil(t, columnsBitmap([]byte{0xff, 0x01}, 9))
+	assert.Equal(t, []bool{true, false, true}, columnsBitmap([]byte{0x05}, 3))
+}
+
+func TestPartialRowImages(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	table := &Table{
+		Name:             "customers",
+		Columns:          []string{"id", "name", "bio"},
+		KeyColumnIndexes: []int{0},
+		MysqlTable: &mysqlschema.Table{
+			Name:      "customers",
+			PKColumns: []int{0},
+			Columns:   []mysqlschema.TableColumn{{Name: "id"}, {Name: "name"}, {Name: "bio"}},
+		},
+	}
+	table.IgnoredColumnsBitmap = ignoredColumnsBitmap(ReaderConfig{}, table.MysqlTable)
+
+	// binlog_row_image=MINIMAL: the before image has the key and the after image only the changed columns
+	before := [][]interface{}{{1, nil, nil}, {2, nil, nil}}
+	after := [][]interface{}{{nil, "one", nil}, {nil, "two", nil}}
+	afterBitmap, err := fillKeyColumns(table, []bool{true, false, false}, []bool{false, true, false}, before, after)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, afterBitmap)
+	assert.Equal(t, [][]interface{}{{1, "one", nil}, {2, "two", nil}}, after)
+
+	_, err = fillKeyColumns(table, []bool{false, true, true}, nil, before, nil)
+	assert.Error(t, err)
+
+	mutation := Mutation{Type: Update, Table: table, Before: before, Rows: after, ColumnsBitmap: afterBitmap}
+	writer := NewMockDBWriter(ctrl)
+	var args [][]interface{}
+	writer.EXPECT().ExecContext(gomock.Any(), gomock.Any(), gomock.Any()).Times(2).
+		Do(func(ctx context.Context, query string, values ...interface{}) {
+			assert.Equal(t, "UPDATE `customers` SET `name` = ? WHERE `id` = ?", query)
+			args = append(args, values)
+		})
+	_, _, err = mutation.Write(context.Background(), writer)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"one", 1}, {"two", 2}}, args)
+
+	// A partial insert only sets the columns in the image
+	mutation = Mutation{Type: Insert, Table: table, Rows: [][]interface{}{{3, "three", nil}}, ColumnsBitmap: []bool{true, true, false}}
+	writer = NewMockDBWriter(ctrl)
+	writer.EXPECT().ExecContext(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(func(ctx context.Context, query string, values ...interface{}) {
+			assert.Equal(t, "REPLACE INTO customers (`id`,`name`) VALUES (?,?)", query)
+			assert.Equal(t, []interface{}{3, "three"}, values)
+		})
+	_, _, err = mutation.Write(context.Background(), writer)
+	require.NoError(t, err)
+
+	// Reconciling with a chunk fills in the missing columns from the snapshot
+	assert.Equal(t, []interface{}{1, "one", "bio"}, mergeRow([]interface{}{1, "name", "bio"}, after[0], afterBitmap))
+}
@@ -0,0 +1,263 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	SinkMySQL = "mysql"
+	SinkJSONL = "jsonl"
+	SinkHTTP  = "http"
+)
+
+var (
+	sinkTransactionsDelivered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_transactions_delivered",
+			Help: "How many transactions have been delivered to a jsonl or http sink, partitioned by task and sink.",
+		},
+		[]string{"task", "sink"},
+	)
+	sinkBytesDelivered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_bytes_delivered",
+			Help: "How many bytes of encoded transactions have been delivered to a jsonl or http sink, partitioned by task and sink.",
+		},
+		[]string{"task", "sink"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sinkTransactionsDelivered)
+	prometheus.MustRegister(sinkBytesDelivered)
+}
+
+// Sink delivers the transactions produced by the TransactionStream and the Snapshotter in order. A sink is responsible
+// for saving the position of the last transaction it delivered so that replication can continue from there, the
+// TransactionWriter (the MySQL sink) saves it in the checkpoint table in the same transaction as the writes.
+type Sink interface {
+	Init(ctx context.Context) error
+	// ReadCheckpoint returns the position of the last transaction delivered, sql.ErrNoRows if nothing has been delivered
+	ReadCheckpoint(ctx context.Context) (file string, position uint32, executedGtidSet string, err error)
+	Run(ctx context.Context, b backoff.BackOff, transactions chan Transaction) error
+}
+
+// NewSink creates the sink configured by --sink
+func NewSink(config Replicate) (Sink, error) {
+	switch config.Sink {
+	case "", SinkMySQL:
+		return NewTransactionWriter(config)
+	case SinkJSONL:
+		return NewFileSink(config)
+	case SinkHTTP:
+		return NewHTTPSink(config)
+	default:
+		return nil, errors.Errorf("unknown sink: %s", config.Sink)
+	}
+}
+
+// usesMySQLSink returns true if the transactions are applied to the target database
+func (cmd *Replicate) usesMySQLSink() bool {
+	return cmd.Sink == "" || cmd.Sink == SinkMySQL
+}
+
+// sinkTransaction is how a Transaction is encoded as a line of JSON by the jsonl and http sinks
+type sinkTransaction struct {
+	Task       string         `json:"task"`
+	File       string         `json:"file"`
+	Position   uint32         `json:"position"`
+	SourceGTID string         `json:"source_gtid,omitempty"`
+	Mutations  []sinkMutation `json:"mutations"`
+	// Partial is set on every piece of a large transaction except the last one, a transaction is any partial lines and
+	// the line without partial that follows them. Partial lines have the position of the transaction before them.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// sinkMutation is how a Mutation is encoded, rows are objects keyed by the column names
+type sinkMutation struct {
+	Type  string                   `json:"type"`
+	Table string                   `json:"table"`
+	Rows  []map[string]interface{} `json:"rows"`
+	// Before is the rows before they were updated, only for update
+	Before []map[string]interface{} `json:"before,omitempty"`
+	// ChunkStart and ChunkEnd are the key bounds of a repair, the rows of a repair are the full content of the chunk so
+	// any rows within the bounds that are not in rows should be deleted
+	ChunkStart []interface{} `json:"chunk_start,omitempty"`
+	ChunkEnd   []interface{} `json:"chunk_end,omitempty"`
+}
+
+// encodeTransaction encodes a transaction as a single line of JSON including the trailing newline, internal tables
+// like the watermark and heartbeat tables are left out since they only make sense to a MySQL target
+func encodeTransaction(config Replicate, transaction Transaction) ([]byte, error) {
+	t := sinkTransaction{
+		Task:     config.TaskName,
+		File:     transaction.FinalPosition.File,
+		Position: transaction.FinalPosition.Position,
+		Partial:  transaction.Partial,
+	}
+	if transaction.FinalPosition.Gset != nil {
+		t.SourceGTID = transaction.FinalPosition.Gset.String()
+	}
+	t.Mutations = make([]sinkMutation, 0, len(transaction.Mutations))
+	for _, mutation := range transaction.Mutations {
+		if config.isInternalTable(mutation.Table.Name) {
+			continue
+		}
+		m := sinkMutation{
+			Type:   mutation.Type.String(),
+			Table:  mutation.Table.Name,
+			Rows:   encodeRows(mutation.Table, mutation.ColumnsBitmap, mutation.Rows),
+			Before: encodeRows(mutation.Table, mutation.BeforeColumnsBitmap, mutation.Before),
+		}
+		if mutation.Type == Repair {
+			m.ChunkStart = encodeValues(mutation.Chunk.Start)
+			m.ChunkEnd = encodeValues(mutation.Chunk.End)
+		}
+		t.Mutations = append(t.Mutations, m)
+	}
+	line, err := json.Marshal(t)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return append(line, '\n'), nil
+}
+
+// encodeRows encodes rows as objects, with partial row images the columns missing from the image are left out
+func encodeRows(table *Table, columnsBitmap []bool, rows [][]interface{}) []map[string]interface{} {
+	if rows == nil {
+		return nil
+	}
+	result := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		encoded := make(map[string]interface{}, len(row))
+		for j, value := range row {
+			if j >= len(table.Columns) || table.IgnoredColumnsBitmap[j] || (columnsBitmap != nil && !columnsBitmap[j]) {
+				continue
+			}
+			encoded[table.Columns[j]] = encodeValue(value)
+		}
+		result[i] = encoded
+	}
+	return result
+}
+
+func encodeValues(values []interface{}) []interface{} {
+	if values == nil {
+		return nil
+	}
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = encodeValue(value)
+	}
+	return result
+}
+
+// encodeValue encodes text as JSON strings, binary data that isn't valid UTF-8 is encoded as base64 by encoding/json
+func encodeValue(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok && utf8.Valid(b) {
+		return string(b)
+	}
+	return value
+}
+
+// nextBatch waits for the first transaction and then collects transactions until the batch is full or the timeout
+func nextBatch(ctx context.Context, transactions chan Transaction, maxSize int, timeout time.Duration) ([]Transaction, error) {
+	var batch []Transaction
+	select {
+	case transaction := <-transactions:
+		batch = append(batch, transaction)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	batchTimeout := time.After(timeout)
+	for len(batch) < maxSize {
+		select {
+		case transaction := <-transactions:
+			batch = append(batch, transaction)
+		case <-batchTimeout:
+			return batch, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return batch, nil
+}
+
+// fileCheckpoint is the checkpoint saved by sinks that don't have a checkpoint table, the fields mirror the table
+type fileCheckpoint struct {
+	Task       string    `json:"task"`
+	File       string    `json:"file"`
+	Position   uint32    `json:"position"`
+	SourceGTID string    `json:"source_gtid"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func readCheckpointFile(path string, task string) (file string, position uint32, executedGtidSet string, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errors.WithStack(sql.ErrNoRows)
+			return
+		}
+		err = errors.WithStack(err)
+		return
+	}
+	var checkpoint fileCheckpoint
+	err = json.Unmarshal(content, &checkpoint)
+	if err != nil {
+		err = errors.Wrapf(err, "could not parse checkpoint file %s", path)
+		return
+	}
+	if checkpoint.Task != task {
+		err = errors.Errorf("checkpoint file %s belongs to task %q, not %q", path, checkpoint.Task, task)
+		return
+	}
+	return checkpoint.File, checkpoint.Position, checkpoint.SourceGTID, nil
+}
+
+// writeCheckpointFile atomically replaces the checkpoint file by writing to a temporary file and renaming it
+func writeCheckpointFile(path string, task string, position Position) error {
+	checkpoint := fileCheckpoint{
+		Task:      task,
+		File:      position.File,
+		Position:  position.Position,
+		Timestamp: time.Now().UTC(),
+	}
+	if position.Gset != nil {
+		checkpoint.SourceGTID = position.Gset.String()
+	}
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err != nil {
+		_ = tmp.Close()
+		return errors.WithStack(err)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		_ = tmp.Close()
+		return errors.WithStack(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
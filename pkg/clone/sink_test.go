@@ -0,0 +1,216 @@
+package clone
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sinkTestTransaction(t *testing.T, id int64, name string, gtid string) Transaction {
+	customers := &Table{
+		Name:                 "customers",
+		Columns:              []string{"id", "name", "secret"},
+		IgnoredColumnsBitmap: []bool{false, false, true},
+	}
+	gset, err := mysql.ParseGTIDSet("mysql", gtid)
+	require.NoError(t, err)
+	return Transaction{
+		Mutations: []Mutation{
+			{
+				Type:   Update,
+				Table:  customers,
+				Before: [][]interface{}{{id, []byte("before"), "x"}},
+				Rows:   [][]interface{}{{id, []byte(name), "x"}},
+			},
+			{
+				Type:  Insert,
+				Table: &Table{Name: "_cloner_heartbeat"},
+				Rows:  [][]interface{}{{"main"}},
+			},
+		},
+		FinalPosition: Position{File: "binlog.000001", Position: uint32(id * 100), Gset: gset},
+	}
+}
+
+func sinkTestConfig() Replicate {
+	return Replicate{
+		TaskName:         "main",
+		HeartbeatTable:   "_cloner_heartbeat",
+		WatermarkTable:   "_cloner_watermark",
+		SinkBatchSize:    10,
+		SinkBatchTimeout: 10 * time.Millisecond,
+	}
+}
+
+func TestEncodeTransaction(t *testing.T) {
+	line, err := encodeTransaction(sinkTestConfig(),
+		sinkTestTransaction(t, 1, "after", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"task": "main",
+		"file": "binlog.000001",
+		"position": 100,
+		"source_gtid": "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5",
+		"mutations": [
+			{"type": "update", "table": "customers", "rows": [{"id": 1, "name": "after"}], "before": [{"id": 1, "name": "before"}]}
+		]
+	}`, string(line))
+	assert.Equal(t, byte('\n'), line[len(line)-1])
+}
+
+// runSink runs the sink until the timeout, long enough to deliver all the transactions
+func runSink(t *testing.T, sink Sink, timeout time.Duration, transactions []Transaction) {
+	ch := make(chan Transaction, len(transactions))
+	for _, transaction := range transactions {
+		ch <- transaction
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := sink.Run(ctx, backoff.NewExponentialBackOff(), ch)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFileSink(t *testing.T) {
+	config := sinkTestConfig()
+	config.SinkFile = filepath.Join(t.TempDir(), "events", "customers.jsonl")
+	// Small enough that every transaction ends up in its own file
+	config.SinkFileMaxSize = 10
+
+	sink, err := NewFileSink(config)
+	require.NoError(t, err)
+	require.NoError(t, sink.Init(context.Background()))
+
+	_, _, _, err = sink.ReadCheckpoint(context.Background())
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	runSink(t, sink, 200*time.Millisecond, []Transaction{
+		sinkTestTransaction(t, 1, "a", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1"),
+		sinkTestTransaction(t, 2, "b", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-2"),
+	})
+
+	rotated, err := sink.rotatedFiles()
+	require.NoError(t, err)
+	assert.Len(t, rotated, 1)
+
+	file, position, gtid, err := sink.ReadCheckpoint(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "binlog.000001", file)
+	assert.Equal(t, uint32(200), position)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-2", gtid)
+
+	// A crash half way through a line is truncated and the checkpoint is the last complete line
+	f, err := os.OpenFile(config.SinkFile, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"task":"main","file":"binlog.000001","posi`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, sink.Init(context.Background()))
+	_, position, _, err = sink.ReadCheckpoint(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(200), position)
+
+	// After a rotation with nothing written yet the checkpoint is read from the newest rotated file
+	config.SinkFileMaxSize = 0
+	sink, err = NewFileSink(config)
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(config.SinkFile, config.SinkFile+"."+time.Now().UTC().Format(rotatedFileTimeFormat)))
+	require.NoError(t, os.WriteFile(config.SinkFile, nil, 0o644))
+	_, position, _, err = sink.ReadCheckpoint(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(200), position)
+
+	runSink(t, sink, 200*time.Millisecond, []Transaction{
+		sinkTestTransaction(t, 3, "c", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-3"),
+		sinkTestTransaction(t, 4, "d", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-4"),
+	})
+	f, err = os.Open(config.SinkFile)
+	require.NoError(t, err)
+	defer f.Close()
+	var positions []uint32
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var transaction sinkTransaction
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &transaction))
+		positions = append(positions, transaction.Position)
+	}
+	assert.Equal(t, []uint32{300, 400}, positions)
+}
+
+func TestHTTPSink(t *testing.T) {
+	var mutex sync.Mutex
+	var requests int
+	var received []sinkTransaction
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if requests == 1 {
+			// The first request fails and should be retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var transaction sinkTransaction
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &transaction))
+			received = append(received, transaction)
+		}
+	}))
+	defer server.Close()
+
+	config := sinkTestConfig()
+	config.SinkURL = server.URL
+	config.SinkHeaders = []string{"Authorization=secret"}
+	config.SinkCheckpointFile = filepath.Join(t.TempDir(), "checkpoint.json")
+	config.WriteRetries = 5
+	config.WriteTimeout = time.Second
+
+	sink, err := NewHTTPSink(config)
+	require.NoError(t, err)
+	require.NoError(t, sink.Init(context.Background()))
+	_, _, _, err = sink.ReadCheckpoint(context.Background())
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	runSink(t, sink, 3*time.Second, []Transaction{
+		sinkTestTransaction(t, 1, "a", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1"),
+		sinkTestTransaction(t, 2, "b", "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-2"),
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, received, 2)
+	assert.Equal(t, uint32(100), received[0].Position)
+	assert.Equal(t, uint32(200), received[1].Position)
+
+	file, position, gtid, err := sink.ReadCheckpoint(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "binlog.000001", file)
+	assert.Equal(t, uint32(200), position)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-2", gtid)
+
+	config.TaskName = "other"
+	sink, err = NewHTTPSink(config)
+	require.NoError(t, err)
+	_, _, _, err = sink.ReadCheckpoint(context.Background())
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, sql.ErrNoRows))
+}
@@ -0,0 +1,135 @@
+package clone
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// applyLatencyWeight is the weight of the latest apply in the moving average of the apply latency
+const applyLatencyWeight = 0.2
+
+var (
+	snapshotPacingParallelism = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "snapshot_pacing_chunk_parallelism",
+			Help: "How many snapshot chunks were read at a time the last time chunks were read, 0 while paused.",
+		},
+		[]string{"task"},
+	)
+	snapshotPacingPaused = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "snapshot_pacing_paused",
+			Help: "1 while snapshot chunk reads are paused because the replication lag is above --snapshot-pacing-lag-ceiling.",
+		},
+		[]string{"task"},
+	)
+	snapshotPacingPauses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "snapshot_pacing_pauses",
+			Help: "How many times snapshot chunk reads were paused because the replication lag was above --snapshot-pacing-lag-ceiling.",
+		},
+		[]string{"task"},
+	)
+	snapshotPacingApplyLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "snapshot_pacing_apply_latency_seconds",
+			Help: "Moving average of the time it takes the sink to apply a transaction, or a batch of transactions with parallel replication.",
+		},
+		[]string{"task"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(snapshotPacingParallelism)
+	prometheus.MustRegister(snapshotPacingPaused)
+	prometheus.MustRegister(snapshotPacingPauses)
+	prometheus.MustRegister(snapshotPacingApplyLatency)
+}
+
+// snapshotPacer decides how many snapshot chunks are read at a time from the replication lag and the time it takes to
+// apply transactions to the target, so that snapshot reads and repairs don't push the lag further up
+type snapshotPacer struct {
+	config Replicate
+	// lag returns the replication lag measured by the heartbeats, nil without heartbeats
+	lag func() time.Duration
+
+	mutex        sync.Mutex
+	applyLatency time.Duration
+	paused       bool
+}
+
+func newSnapshotPacer(config Replicate) *snapshotPacer {
+	return &snapshotPacer{config: config}
+}
+
+// observeApply adds the time it took to apply a transaction (or a batch of them) to the moving average, the sink has no
+// pacer when it's used without a snapshotter
+func (p *snapshotPacer) observeApply(duration time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.applyLatency == 0 {
+		p.applyLatency = duration
+	} else {
+		p.applyLatency = time.Duration((1-applyLatencyWeight)*float64(p.applyLatency) + applyLatencyWeight*float64(duration))
+	}
+	snapshotPacingApplyLatency.WithLabelValues(p.config.TaskName).Set(p.applyLatency.Seconds())
+}
+
+// parallelism returns how many chunks to read now, 0 means chunk reads are paused
+func (p *snapshotPacer) parallelism(ctx context.Context) int {
+	var lag time.Duration
+	if p.lag != nil {
+		lag = p.lag()
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	parallelism := paceChunks(p.config.ChunkParallelism, lag, p.config.SnapshotPacingLagTarget,
+		p.config.SnapshotPacingLagCeiling, p.applyLatency, p.config.SnapshotPacingApplyLatencyTarget)
+	paused := parallelism == 0
+	if paused != p.paused {
+		logger := logrus.WithContext(ctx).WithField("task", "snapshot")
+		if paused {
+			logger.Infof("pausing snapshot chunk reads, replication lag %v is above %v", lag, p.config.SnapshotPacingLagCeiling)
+			snapshotPacingPauses.WithLabelValues(p.config.TaskName).Inc()
+		} else {
+			logger.Infof("resuming snapshot chunk reads, replication lag is %v", lag)
+		}
+		p.paused = paused
+	}
+	if paused {
+		snapshotPacingPaused.WithLabelValues(p.config.TaskName).Set(1)
+	} else {
+		snapshotPacingPaused.WithLabelValues(p.config.TaskName).Set(0)
+	}
+	snapshotPacingParallelism.WithLabelValues(p.config.TaskName).Set(float64(parallelism))
+	return parallelism
+}
+
+// paceChunks scales the chunk parallelism down by how far the lag and the apply latency are above their targets, it
+// returns 0 when the lag is at the ceiling and at least 1 otherwise. Zero targets and ceiling are disabled.
+func paceChunks(maxParallelism int, lag, lagTarget, lagCeiling, applyLatency, applyLatencyTarget time.Duration) int {
+	if lagCeiling > 0 && lag >= lagCeiling {
+		return 0
+	}
+	factor := 1.0
+	if lagTarget > 0 && lag > lagTarget {
+		factor = math.Min(factor, float64(lagTarget)/float64(lag))
+	}
+	if applyLatencyTarget > 0 && applyLatency > applyLatencyTarget {
+		factor = math.Min(factor, float64(applyLatencyTarget)/float64(applyLatency))
+	}
+	parallelism := int(math.Floor(float64(maxParallelism) * factor))
+	if parallelism < 1 {
+		return 1
+	}
+	return parallelism
+}
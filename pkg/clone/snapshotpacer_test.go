@@ -0,0 +1,49 @@
+package clone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaceChunks(t *testing.T) {
+	// Pacing is disabled by default
+	assert.Equal(t, 10, paceChunks(10, time.Hour, 0, 0, time.Minute, 0))
+
+	// The parallelism is scaled down by how far the lag is above the target
+	assert.Equal(t, 10, paceChunks(10, 5*time.Second, 10*time.Second, time.Minute, 0, 0))
+	assert.Equal(t, 5, paceChunks(10, 20*time.Second, 10*time.Second, time.Minute, 0, 0))
+	assert.Equal(t, 1, paceChunks(10, 59*time.Second, time.Second, time.Minute, 0, 0))
+	assert.Equal(t, 0, paceChunks(10, time.Minute, 10*time.Second, time.Minute, 0, 0))
+
+	// and by how far the apply latency is above its target, whichever is further
+	assert.Equal(t, 2, paceChunks(10, 20*time.Second, 10*time.Second, 0, 500*time.Millisecond, 100*time.Millisecond))
+	assert.Equal(t, 5, paceChunks(10, 0, 10*time.Second, 0, 200*time.Millisecond, 100*time.Millisecond))
+}
+
+func TestSnapshotPacer(t *testing.T) {
+	lag := time.Duration(0)
+	pacer := newSnapshotPacer(Replicate{
+		ChunkParallelism:                 8,
+		SnapshotPacingLagCeiling:         time.Minute,
+		SnapshotPacingApplyLatencyTarget: 100 * time.Millisecond,
+	})
+	pacer.lag = func() time.Duration { return lag }
+	ctx := context.Background()
+
+	assert.Equal(t, 8, pacer.parallelism(ctx))
+	pacer.observeApply(400 * time.Millisecond)
+	assert.Equal(t, 2, pacer.parallelism(ctx))
+	// The apply latency is a moving average
+	pacer.observeApply(0)
+	assert.Equal(t, 320*time.Millisecond, pacer.applyLatency)
+
+	lag = time.Hour
+	assert.Equal(t, 0, pacer.parallelism(ctx))
+	assert.True(t, pacer.paused)
+	lag = time.Second
+	assert.Equal(t, 2, pacer.parallelism(ctx))
+	assert.False(t, pacer.paused)
+}
@@ -0,0 +1,213 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mightyguava/autotx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// snapshotProgress is how far the snapshot of a table has come, end is the end of the chunks repaired so far
+type snapshotProgress struct {
+	end  []interface{}
+	done bool
+}
+
+func (w *TransactionWriter) createSnapshotProgressTable(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, w.config.WriteTimeout)
+	defer cancel()
+	// The row with an empty table_name marks a snapshot that has been started and not completed, the other rows are the
+	// chunks repaired so far. chunk_start and chunk_end are encoded with encodeChunkKey.
+	stmt := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			task        VARCHAR(255) NOT NULL,
+			table_name  VARCHAR(255) NOT NULL,
+			chunk_start VARCHAR(255) NOT NULL,
+			chunk_end   VARCHAR(255) NULL,
+			PRIMARY KEY (task, table_name, chunk_start)
+		)
+		`, "`"+w.config.SnapshotProgressTable+"`")
+	_, err := w.target.ExecContext(timeoutCtx, stmt)
+	if err != nil {
+		return errors.Wrapf(err, "could not create snapshot progress table in target database:\n%s", stmt)
+	}
+	return nil
+}
+
+// recordSnapshotProgress records the chunk in the target transaction that repairs it. Parallel replication can commit
+// the chunks of a table out of order, so each chunk is recorded on its own and the progress of the table is the end of
+// the chunks recorded from its start without a gap, see snapshotProgressOf.
+func (w *TransactionWriter) recordSnapshotProgress(ctx context.Context, tx *sql.Tx, chunk Chunk) error {
+	if chunk.targeted() {
+		return nil
+	}
+	start, err := encodeChunkKey(chunk.Start)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	end, err := encodeChunkKey(chunk.End)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf("REPLACE INTO %s (task, table_name, chunk_start, chunk_end) VALUES (?, ?, ?, ?)",
+			"`"+w.config.SnapshotProgressTable+"`"),
+		w.config.TaskName, chunk.Table.Name, start, end)
+	return errors.WithStack(err)
+}
+
+// snapshotProgressOf returns the progress of a table from its repaired chunks, which map the encoded start of each
+// chunk to its encoded end. It's the end of the chunks from the start of the table up to the first chunk that hasn't
+// been repaired, the chunks after it are repaired again when the snapshot is resumed.
+func snapshotProgressOf(chunks map[string]string) (snapshotProgress, bool, error) {
+	// The first chunk of a table starts at nil
+	end, ok := chunks["null"]
+	if !ok {
+		return snapshotProgress{}, false, nil
+	}
+	// The last chunk ends at nil, each chunk is followed at most once in case a chunk ends where it starts
+	for i := 0; i < len(chunks) && end != "null"; i++ {
+		next, ok := chunks[end]
+		if !ok {
+			break
+		}
+		end = next
+	}
+	key, err := decodeChunkKey(end)
+	if err != nil {
+		return snapshotProgress{}, false, errors.WithStack(err)
+	}
+	return snapshotProgress{end: key, done: key == nil}, true, nil
+}
+
+// readSnapshotProgress reads the progress of the snapshot per table, it returns false if there is no snapshot to
+// resume
+func (s *Snapshotter) readSnapshotProgress(ctx context.Context) (map[string]snapshotProgress, bool, error) {
+	if s.target == nil {
+		return nil, false, nil
+	}
+	rows, err := s.target.QueryContext(ctx,
+		fmt.Sprintf("SELECT table_name, chunk_start, chunk_end FROM %s WHERE task = ?",
+			"`"+s.config.SnapshotProgressTable+"`"),
+		s.config.TaskName)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	defer rows.Close()
+	chunks := make(map[string]map[string]string)
+	started := false
+	for rows.Next() {
+		var tableName string
+		var start string
+		var end sql.NullString
+		err = rows.Scan(&tableName, &start, &end)
+		if err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+		if tableName == "" {
+			started = true
+			continue
+		}
+		if chunks[tableName] == nil {
+			chunks[tableName] = make(map[string]string)
+		}
+		chunks[tableName][start] = end.String
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	progress := make(map[string]snapshotProgress)
+	for tableName, tableChunks := range chunks {
+		tableProgress, ok, err := snapshotProgressOf(tableChunks)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "could not read the snapshot progress of %s", tableName)
+		}
+		if ok {
+			progress[tableName] = tableProgress
+		}
+	}
+	return progress, started, nil
+}
+
+// startSnapshotProgress forgets the progress of earlier snapshots and marks a new snapshot as started
+func (s *Snapshotter) startSnapshotProgress(ctx context.Context) error {
+	if s.target == nil {
+		return nil
+	}
+	return errors.WithStack(Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
+		return autotx.Transact(ctx, s.target, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx,
+				fmt.Sprintf("DELETE FROM %s WHERE task = ?", "`"+s.config.SnapshotProgressTable+"`"),
+				s.config.TaskName)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			_, err = tx.ExecContext(ctx,
+				fmt.Sprintf("INSERT INTO %s (task, table_name, chunk_start) VALUES (?, '', '')",
+					"`"+s.config.SnapshotProgressTable+"`"),
+				s.config.TaskName)
+			return errors.WithStack(err)
+		})
+	}))
+}
+
+// finishSnapshotProgress deletes the progress of a completed snapshot so that it isn't resumed
+func (s *Snapshotter) finishSnapshotProgress(ctx context.Context) error {
+	if s.target == nil {
+		return nil
+	}
+	return errors.WithStack(Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
+		_, err := s.target.ExecContext(ctx,
+			fmt.Sprintf("DELETE FROM %s WHERE task = ?", "`"+s.config.SnapshotProgressTable+"`"),
+			s.config.TaskName)
+		return errors.WithStack(err)
+	}))
+}
+
+// resumeSnapshot starts a snapshot if one was started and not completed before we restarted
+func (s *Snapshotter) resumeSnapshot(ctx context.Context) error {
+	_, started, err := s.readSnapshotProgress(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !started || s.isSnapshotting.Load() {
+		return nil
+	}
+	logrus.WithContext(ctx).WithField("task", "snapshot").Infof("resuming the snapshot that was running before the restart")
+	// An error means a snapshot has been started since
+	_ = s.start(ctx, nil, true)
+	return nil
+}
+
+// encodeChunkKey encodes the start or end of a chunk as JSON, the chunker only supports integer keys. The end of the
+// last chunk is nil which is encoded as null.
+func encodeChunkKey(key []interface{}) (string, error) {
+	b, err := json.Marshal(key)
+	return string(b), errors.WithStack(err)
+}
+
+func decodeChunkKey(value string) ([]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewBufferString(value))
+	decoder.UseNumber()
+	var key []interface{}
+	err := decoder.Decode(&key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode chunk key: %s", value)
+	}
+	for i, value := range key {
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, errors.Errorf("unexpected chunk key: %s", value)
+		}
+		key[i], err = number.Int64()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unexpected chunk key: %s", value)
+		}
+	}
+	return key, nil
+}
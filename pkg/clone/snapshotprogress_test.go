@@ -0,0 +1,67 @@
+package clone
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkKeyEncoding(t *testing.T) {
+	for _, key := range [][]interface{}{
+		{int64(0)},
+		{int64(9007199254740993)},
+		{int64(-5), int64(12)},
+	} {
+		encoded, err := encodeChunkKey(key)
+		require.NoError(t, err)
+		decoded, err := decodeChunkKey(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, key, decoded)
+	}
+
+	// The end of the last chunk of a table is nil, which means the table is done
+	encoded, err := encodeChunkKey(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "null", encoded)
+	decoded, err := decodeChunkKey(encoded)
+	require.NoError(t, err)
+	assert.Nil(t, decoded)
+
+	_, err = decodeChunkKey(`["a"]`)
+	assert.Error(t, err)
+}
+
+func TestSnapshotProgressOfChunksCommittedOutOfOrder(t *testing.T) {
+	chunks := make(map[string]string)
+	commit := func(start, end []interface{}) {
+		encodedStart, err := encodeChunkKey(start)
+		require.NoError(t, err)
+		encodedEnd, err := encodeChunkKey(end)
+		require.NoError(t, err)
+		chunks[encodedStart] = encodedEnd
+	}
+	progress := func() (snapshotProgress, bool) {
+		p, ok, err := snapshotProgressOf(chunks)
+		require.NoError(t, err)
+		return p, ok
+	}
+
+	// Nothing counts until the first chunk of the table has been committed
+	commit([]interface{}{int64(100)}, []interface{}{int64(200)})
+	_, ok := progress()
+	assert.False(t, ok)
+
+	commit(nil, []interface{}{int64(100)})
+	p, ok := progress()
+	assert.True(t, ok)
+	assert.Equal(t, snapshotProgress{end: []interface{}{int64(200)}}, p)
+
+	// A gap holds the progress back until the chunk in it commits
+	commit([]interface{}{int64(300)}, nil)
+	p, _ = progress()
+	assert.Equal(t, snapshotProgress{end: []interface{}{int64(200)}}, p)
+	commit([]interface{}{int64(200)}, []interface{}{int64(300)})
+	p, _ = progress()
+	assert.Equal(t, snapshotProgress{end: nil, done: true}, p)
+}
@@ -0,0 +1,250 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/mightyguava/autotx"
+	"github.com/pkg/errors"
+)
+
+// snapshotRequestColumns are the optional columns of the snapshot request table, they're added to request tables
+// created before they existed
+var snapshotRequestColumns = []struct {
+	name       string
+	definition string
+}{
+	{"table_names", "TEXT NULL"},
+	{"key_start", "BIGINT(20) NULL"},
+	{"key_end", "BIGINT(20) NULL"},
+	{"where_clause", "TEXT NULL"},
+	{"priority", "INT NOT NULL DEFAULT 0"},
+	{"status", "TEXT NULL"},
+}
+
+// fullSnapshotRequests matches the requests that aren't targeted at part of the tables or rows
+const fullSnapshotRequests = "COALESCE(table_names, '') = '' AND key_start IS NULL AND key_end IS NULL AND COALESCE(where_clause, '') = ''"
+
+// snapshotRequest is a row of the snapshot request table. A request with tables, a key range or a where clause is a
+// targeted re-sync of part of the data, the others snapshot every table.
+type snapshotRequest struct {
+	id       int64
+	tables   []string
+	keyStart sql.NullInt64
+	keyEnd   sql.NullInt64
+	where    string
+	priority int64
+}
+
+// targeted returns false for a request of a full snapshot and for snapshots that weren't requested (a nil request)
+func (r *snapshotRequest) targeted() bool {
+	return r != nil && (len(r.tables) > 0 || r.keyStart.Valid || r.keyEnd.Valid || r.where != "")
+}
+
+// keyRange returns the start and end of the requested keys as chunk keys, nil when unbounded
+func (r *snapshotRequest) keyRange() (start []interface{}, end []interface{}) {
+	if r == nil {
+		return nil, nil
+	}
+	if r.keyStart.Valid {
+		start = []interface{}{r.keyStart.Int64}
+	}
+	if r.keyEnd.Valid {
+		end = []interface{}{r.keyEnd.Int64}
+	}
+	return start, end
+}
+
+func (r *snapshotRequest) String() string {
+	if !r.targeted() {
+		return fmt.Sprintf("request %d", r.id)
+	}
+	var parts []string
+	if len(r.tables) > 0 {
+		parts = append(parts, "tables="+strings.Join(r.tables, ","))
+	}
+	if r.keyStart.Valid || r.keyEnd.Valid {
+		start, end := r.keyRange()
+		parts = append(parts, fmt.Sprintf("keys=[%v-%v)", start, end))
+	}
+	if r.where != "" {
+		parts = append(parts, "where="+r.where)
+	}
+	return fmt.Sprintf("request %d (%s)", r.id, strings.Join(parts, " "))
+}
+
+// addSnapshotRequestColumns adds the optional columns a snapshot request table doesn't have yet
+func (s *Snapshotter) addSnapshotRequestColumns(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, s.config.WriteTimeout)
+	defer cancel()
+	rows, err := s.source.QueryContext(timeoutCtx,
+		fmt.Sprintf("SELECT * FROM %s LIMIT 0", "`"+s.config.SnapshotRequestTable+"`"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	existing := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		existing[strings.ToLower(column)] = true
+	}
+	for _, column := range snapshotRequestColumns {
+		if existing[column.name] {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s",
+			"`"+s.config.SnapshotRequestTable+"`", column.name, column.definition)
+		_, err = s.source.ExecContext(timeoutCtx, stmt)
+		if err != nil {
+			return errors.Wrapf(err, "could not add column to snapshot request table:\n%s", stmt)
+		}
+	}
+	return nil
+}
+
+// nextSnapshotRequest reads the pending request with the highest priority, the oldest one first if several have the
+// same priority. It returns nil if there are no pending requests.
+func (s *Snapshotter) nextSnapshotRequest(ctx context.Context) (*snapshotRequest, error) {
+	var request snapshotRequest
+	var tables, where sql.NullString
+	err := s.source.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT id, table_names, key_start, key_end, where_clause, priority FROM %s "+
+			"WHERE task = ? AND started_at IS NULL ORDER BY priority DESC, id LIMIT 1",
+			s.config.SnapshotRequestTable),
+		s.config.TaskName).
+		Scan(&request.id, &tables, &request.keyStart, &request.keyEnd, &where, &request.priority)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	request.tables = strings.FieldsFunc(tables.String, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	request.where = strings.TrimSpace(where.String)
+	return &request, nil
+}
+
+// requestCondition matches the rows of the snapshot request table a snapshot is running for, a full snapshot serves
+// every full snapshot request
+func requestCondition(request *snapshotRequest) (string, []interface{}) {
+	if request.targeted() {
+		return "id = ?", []interface{}{request.id}
+	}
+	return fullSnapshotRequests, nil
+}
+
+func (s *Snapshotter) markSnapshotStarted(ctx context.Context, request *snapshotRequest) error {
+	if request == nil {
+		return nil
+	}
+	condition, args := requestCondition(request)
+	return errors.WithStack(Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
+		return autotx.Transact(ctx, s.source, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx,
+				fmt.Sprintf("UPDATE %s SET started_at = NOW(), status = 'running' WHERE started_at IS NULL AND task = ? AND %s",
+					s.config.SnapshotRequestTable, condition),
+				append([]interface{}{s.config.TaskName}, args...)...)
+			return errors.WithStack(err)
+		})
+	}))
+}
+
+func (s *Snapshotter) markSnapshotCompleted(ctx context.Context, request *snapshotRequest) error {
+	return s.markSnapshotFinished(ctx, request, "completed")
+}
+
+func (s *Snapshotter) markSnapshotFailed(ctx context.Context, request *snapshotRequest, cause error) error {
+	return s.markSnapshotFinished(ctx, request, fmt.Sprintf("failed: %v", cause))
+}
+
+// markSnapshotFinished sets completed_at of the started requests the snapshot ran for, the status tells whether it
+// completed or failed
+func (s *Snapshotter) markSnapshotFinished(ctx context.Context, request *snapshotRequest, status string) error {
+	condition, args := requestCondition(request)
+	return errors.WithStack(Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
+		return autotx.Transact(ctx, s.source, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx,
+				fmt.Sprintf("UPDATE %s SET completed_at = NOW(), status = ? WHERE completed_at IS NULL AND started_at IS NOT NULL AND task = ? AND %s",
+					s.config.SnapshotRequestTable, condition),
+				append([]interface{}{status, s.config.TaskName}, args...)...)
+			return errors.WithStack(err)
+		})
+	}))
+}
+
+// requeueSnapshotRequests makes the targeted requests that were running when we restarted pending again so they are
+// run from the start, an interrupted full snapshot is resumed instead
+func (s *Snapshotter) requeueSnapshotRequests(ctx context.Context) error {
+	return errors.WithStack(Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
+		_, err := s.source.ExecContext(ctx,
+			fmt.Sprintf("UPDATE %s SET started_at = NULL, status = NULL "+
+				"WHERE completed_at IS NULL AND started_at IS NOT NULL AND task = ? AND NOT (%s)",
+				s.config.SnapshotRequestTable, fullSnapshotRequests),
+			s.config.TaskName)
+		return errors.WithStack(err)
+	}))
+}
+
+// snapshotTables selects the tables to snapshot for the request. The tables of a targeted request replace
+// --do-snapshot-tables and its where clause is added to the where clauses of each table on both sides.
+func (s *Snapshotter) snapshotTables(allTables []*Table, request *snapshotRequest) ([]*Table, error) {
+	var tables []*Table
+	if request == nil || len(request.tables) == 0 {
+		for _, table := range allTables {
+			if s.shouldSnapshot(table.Name) {
+				tables = append(tables, table)
+			}
+		}
+	} else {
+		tablesByName := make(map[string]*Table, len(allTables))
+		for _, table := range allTables {
+			tablesByName[table.Name] = table
+		}
+		for _, name := range request.tables {
+			table, ok := tablesByName[name]
+			if !ok || s.isInternalTable(name) {
+				return nil, errors.Errorf("%v: unknown table %s", request, name)
+			}
+			tables = append(tables, table)
+		}
+	}
+	if request == nil {
+		return tables, nil
+	}
+
+	if request.keyStart.Valid || request.keyEnd.Valid {
+		for _, table := range tables {
+			if len(table.KeyColumns) != 1 {
+				return nil, errors.Errorf("%v: a key range needs a single key column but %s has %s",
+					request, table.Name, strings.Join(table.KeyColumns, ", "))
+			}
+		}
+	}
+	if request.where != "" {
+		for i, table := range tables {
+			filtered := *table
+			filtered.Config.SourceWhere = andWhere(table.Config.SourceWhere, request.where)
+			filtered.Config.TargetWhere = andWhere(table.Config.TargetWhere, request.where)
+			tables[i] = &filtered
+		}
+	}
+	return tables, nil
+}
+
+func andWhere(a string, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return fmt.Sprintf("(%s) AND (%s)", a, b)
+}
@@ -0,0 +1,88 @@
+package clone
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotTables(t *testing.T) {
+	customer := &Table{Name: "customer", KeyColumns: []string{"id"}, Config: TableConfig{SourceWhere: "shard = 1"}}
+	transaction := &Table{Name: "transaction", KeyColumns: []string{"customer_id", "id"}}
+	allTables := []*Table{customer, transaction, {Name: "_cloner_checkpoint", KeyColumns: []string{"name"}}}
+	s := &Snapshotter{config: Replicate{
+		CheckpointTable:  "_cloner_checkpoint",
+		DoSnapshotTables: []string{"transaction"},
+	}}
+
+	tables, err := s.snapshotTables(allTables, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []*Table{transaction}, tables)
+
+	full := &snapshotRequest{id: 1}
+	assert.False(t, full.targeted())
+	tables, err = s.snapshotTables(allTables, full)
+	require.NoError(t, err)
+	assert.Equal(t, []*Table{transaction}, tables)
+
+	// The tables of the request replace --do-snapshot-tables
+	request := &snapshotRequest{
+		id:       2,
+		tables:   []string{"customer"},
+		keyStart: sql.NullInt64{Int64: 100, Valid: true},
+		where:    "name LIKE 'a%'",
+	}
+	assert.True(t, request.targeted())
+	start, end := request.keyRange()
+	assert.Equal(t, []interface{}{int64(100)}, start)
+	assert.Nil(t, end)
+	tables, err = s.snapshotTables(allTables, request)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "customer", tables[0].Name)
+	assert.Equal(t, "(shard = 1) AND (name LIKE 'a%')", tables[0].Config.SourceWhere)
+	assert.Equal(t, "name LIKE 'a%'", tables[0].Config.TargetWhere)
+	assert.Equal(t, "shard = 1", customer.Config.SourceWhere, "the loaded table is left as it is")
+
+	_, err = s.snapshotTables(allTables, &snapshotRequest{id: 3, tables: []string{"_cloner_checkpoint"}})
+	assert.ErrorContains(t, err, "unknown table _cloner_checkpoint")
+
+	_, err = s.snapshotTables(allTables, &snapshotRequest{
+		id:     4,
+		tables: []string{"transaction"},
+		keyEnd: sql.NullInt64{Int64: 100, Valid: true},
+	})
+	assert.ErrorContains(t, err, "a key range needs a single key column")
+}
+
+func TestReconcileDeleteOutsideWhereClause(t *testing.T) {
+	table := &Table{
+		Name: "customer",
+		MysqlTable: &schema.Table{
+			Name:      "customer",
+			PKColumns: []int{0},
+			Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}},
+		},
+		KeyColumns:       []string{"id"},
+		KeyColumnIndexes: []int{0},
+		Config:           TableConfig{SourceWhere: "name LIKE 'a%'", TargetWhere: "name LIKE 'a%'"},
+	}
+	chunk := &ChunkSnapshot{
+		InsideWatermarks: true,
+		Rows:             []*Row{{Table: table, Data: []interface{}{int64(5), "alice"}}},
+		Chunk:            Chunk{Table: table, Start: []interface{}{int64(0)}, End: []interface{}{int64(10)}},
+	}
+
+	// The deleted row wasn't read with the chunk, it may exist on the target without matching the where clause
+	mutation, err := chunk.reconcileBinlogEvent(Mutation{
+		Type:  Delete,
+		Table: table,
+		Rows:  [][]interface{}{{int64(5), "alice"}, {int64(6), "bob"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{int64(6), "bob"}}, mutation.Rows)
+	assert.Empty(t, chunk.Rows)
+}
@@ -7,11 +7,13 @@ import (
 	_ "net/http/pprof"
 	"sort"
 	"strings"
+	"time"
 
 	mapset "github.com/deckarep/golang-set/v2"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/dlmiddlecote/sqlstats"
+	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/mightyguava/autotx"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -30,6 +32,9 @@ var (
 	)
 )
 
+// snapshotReaderPollInterval is how often we check if the --snapshot-reader has replicated a low watermark
+const snapshotReaderPollInterval = 50 * time.Millisecond
+
 func init() {
 	prometheus.MustRegister(snapshotChunkReconciles)
 }
@@ -43,15 +48,29 @@ type Snapshotter struct {
 
 	sourceRetry RetryOptions
 
+	// reader is the --snapshot-reader chunks are read from, it's the source unless a replica has been configured
+	reader *sql.DB
+	// target is where the progress of the snapshot is saved, it's only set with the mysql sink
+	target *sql.DB
+
 	isSnapshotting *atomic.Bool
 	tablesLeft     mapset.Set[string]
+	// pacer decides how many chunks are read at a time
+	pacer *snapshotPacer
 
 	// chunks receives chunks from the chunker, they are processed on the main replication thread and appended to ongoingChunks below
 	chunks chan Chunk
 
-	// ongoingChunks holds the currently ongoing chunks, only access from the replication thread
+	// ongoingChunks holds the currently ongoing chunks and ongoingIndex indexes them by table and key range, only
+	// access from the replication thread and only change them with setOngoingChunks and removeOngoingChunk
 	ongoingChunks []*ChunkSnapshot
+	ongoingIndex  ongoingChunkIndex
 	readLogger    *ThroughputLogger
+
+	// received is the position of the last whole transaction the replication thread has received and receivingPieces
+	// is set while it's receiving the pieces of a large transaction, only used with --snapshot-mode=gtid
+	received        Position
+	receivingPieces bool
 }
 
 func NewSnapshotter(config Replicate) (*Snapshotter, error) {
@@ -63,23 +82,41 @@ func NewSnapshotter(config Replicate) (*Snapshotter, error) {
 			AcquireMetric: readLimiterDelay.WithLabelValues("source"),
 			MaxRetries:    config.ReadRetries,
 			Timeout:       config.ReadTimeout,
+			Throttle:      config.Throttles.forRead("source"),
+			Health:        config.Health,
 		},
 		isSnapshotting: atomic.NewBool(false),
 		chunks:         make(chan Chunk, config.ChunkParallelism),
 		tablesLeft:     mapset.NewSet[string](),
+		pacer:          newSnapshotPacer(config),
 	}
 	s.sourceSchema, err = s.config.Source.Schema()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	source, err := s.config.Source.DB()
+	source, err := s.config.sourceDB()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	s.source = source
 	s.sourceCollector = sqlstats.NewStatsCollector("source", source)
 
+	s.reader = source
+	if config.SnapshotReader.Host != "" || config.SnapshotReader.MiskDatasource != "" {
+		s.reader, err = config.SnapshotReader.ReaderDB()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if config.usesMySQLSink() {
+		s.target, err = config.Target.DB()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
 	return &s, nil
 }
 
@@ -88,8 +125,18 @@ func (s *Snapshotter) Init(ctx context.Context) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	err = s.reader.PingContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to the snapshot reader")
+	}
 
-	if s.config.CreateTables {
+	if s.config.SnapshotMode == SnapshotModeGTID {
+		// Nothing is written to the source, the snapshot request table has to be created by hand to request snapshots
+		err = s.checkGTIDSnapshots(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if s.config.CreateTables {
 		err = s.createWatermarkTable(ctx)
 		if err != nil {
 			return errors.WithStack(err)
@@ -100,6 +147,12 @@ func (s *Snapshotter) Init(ctx context.Context) error {
 		}
 	}
 
+	// Only when the process starts, a snapshot keeps running when Run is restarted
+	err = s.requeueSnapshotRequests(ctx)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to requeue the interrupted snapshot requests")
+	}
+
 	return nil
 }
 
@@ -107,9 +160,19 @@ func (s *Snapshotter) Run(ctx context.Context, b backoff.BackOff, source <-chan
 	prometheus.MustRegister(s.sourceCollector)
 	defer prometheus.Unregister(s.sourceCollector)
 
-	err := s.checkSnapshotStartRequested(ctx)
-	if err != nil {
-		logrus.WithError(err).Errorf("failed to check if snapshot has been requested")
+	// Snapshots are requested on the source which we don't have when reading from binlog files
+	if s.config.BinlogDir == "" {
+		// --do-snapshot resumes the snapshot when it starts it
+		if !s.config.DoSnapshot {
+			err := s.resumeSnapshot(ctx)
+			if err != nil {
+				logrus.WithError(err).Errorf("failed to check if a snapshot has to be resumed")
+			}
+		}
+		err := s.checkSnapshotStartRequested(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to check if snapshot has been requested")
+		}
 	}
 
 	for {
@@ -117,6 +180,14 @@ func (s *Snapshotter) Run(ctx context.Context, b backoff.BackOff, source <-chan
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		if ready, ok := s.readyGTIDChunks(); ok {
+			select {
+			case sink <- ready:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			s.repaired(ctx, ready)
+		}
 
 		var transaction Transaction
 		select {
@@ -127,8 +198,11 @@ func (s *Snapshotter) Run(ctx context.Context, b backoff.BackOff, source <-chan
 
 		transaction, _ = s.handleSnapshotRequest(ctx, transaction)
 
-		// If we have chunks to process then we will process the watermarks in the transactions
+		// If we have chunks to process then we will process the watermarks in the transactions. The pieces of a large
+		// transaction are reconciled one by one in binlog order just like whole transactions, the watermarks are
+		// written in transactions of their own so a repair is never added to a partial piece.
 		if len(s.ongoingChunks) > 0 {
+			s.enterGTIDChunks(transaction)
 			newMutations := make([]Mutation, 0, len(transaction.Mutations))
 			for _, mutation := range transaction.Mutations {
 				newMutation, err := s.reconcileOngoingChunks(mutation)
@@ -143,8 +217,9 @@ func (s *Snapshotter) Run(ctx context.Context, b backoff.BackOff, source <-chan
 					return errors.WithStack(err)
 				}
 			}
-			transaction.Mutations = newMutations
+			transaction.Mutations = append(newMutations, s.finishGTIDChunks(transaction.FinalPosition, transaction.Partial)...)
 		}
+		s.markReceived(transaction)
 
 		select {
 		case sink <- transaction:
@@ -152,25 +227,30 @@ func (s *Snapshotter) Run(ctx context.Context, b backoff.BackOff, source <-chan
 			return ctx.Err()
 		}
 
-		for _, mutation := range transaction.Mutations {
-			if mutation.Type == Repair {
-				if mutation.Chunk.Last {
-					s.tablesLeft.Remove(mutation.Table.Name)
-					logrus.WithContext(ctx).
-						WithField("task", "snapshot").
-						WithField("table", mutation.Table.Name).
-						Infof("table done: %v tables left: %v", mutation.Table.Name, strings.Join(s.tablesLeft.ToSlice(), ","))
+		s.repaired(ctx, transaction)
 
-					if s.tablesLeft.Cardinality() == 0 {
-						// We're done with all tables
-						s.snapshotDone(ctx)
-					}
+		// We've committed a transaction, we can reset the backoff
+		b.Reset()
+	}
+}
+
+// repaired keeps track of the tables that are done once the transaction has been sent
+func (s *Snapshotter) repaired(ctx context.Context, transaction Transaction) {
+	for _, mutation := range transaction.Mutations {
+		if mutation.Type == Repair {
+			if mutation.Chunk.Last {
+				s.tablesLeft.Remove(mutation.Table.Name)
+				logrus.WithContext(ctx).
+					WithField("task", "snapshot").
+					WithField("table", mutation.Table.Name).
+					Infof("table done: %v tables left: %v", mutation.Table.Name, strings.Join(s.tablesLeft.ToSlice(), ","))
+
+				if s.tablesLeft.Cardinality() == 0 {
+					// We're done with all tables
+					s.snapshotDone(ctx, mutation.Chunk.request)
 				}
 			}
 		}
-
-		// We've committed a transaction, we can reset the backoff
-		b.Reset()
 	}
 }
 
@@ -211,6 +291,12 @@ func (s *Snapshotter) createSnapshotRequestTable(ctx context.Context) error {
       requested_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		  started_at   TIMESTAMP    NULL DEFAULT NULL,
 		  completed_at TIMESTAMP    NULL DEFAULT NULL,
+			table_names  TEXT         NULL,
+			key_start    BIGINT(20)   NULL,
+			key_end      BIGINT(20)   NULL,
+			where_clause TEXT         NULL,
+			priority     INT          NOT NULL DEFAULT 0,
+			status       TEXT         NULL,
 			PRIMARY KEY (id)
 		)
 		`, "`"+s.config.SnapshotRequestTable+"`")
@@ -218,7 +304,7 @@ func (s *Snapshotter) createSnapshotRequestTable(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrapf(err, "could not create checkpoint table in target database:\n%s", stmt)
 	}
-	return nil
+	return errors.WithStack(s.addSnapshotRequestColumns(ctx))
 }
 
 // ChunkSnapshot is a mutable struct for representing the current reconciliation state of a chunk, it is used single
@@ -227,10 +313,29 @@ type ChunkSnapshot struct {
 	InsideWatermarks bool
 	Rows             []*Row
 	Chunk            Chunk
+
+	// LowGset and Gset are only set with --snapshot-mode=gtid, the chunk was read after LowGset and is written once the
+	// binlogs reach Gset
+	LowGset mysql.GTIDSet
+	Gset    mysql.GTIDSet
+}
+
+// repair returns the mutation that writes the reconciled chunk
+func (c *ChunkSnapshot) repair() Mutation {
+	rows := make([][]interface{}, len(c.Rows))
+	for i, row := range c.Rows {
+		rows[i] = row.Data
+	}
+	return Mutation{
+		Type:  Repair,
+		Table: c.Chunk.Table,
+		Rows:  rows,
+		Chunk: c.Chunk,
+	}
 }
 
+// findRow finds the row using binary chop, the rows have to be sorted (see sort)
 func (c *ChunkSnapshot) findRow(row []interface{}) (*Row, int, error) {
-	c.assertSorted()
 	n := len(c.Rows)
 	i := sort.Search(n, func(i int) bool {
 		return c.Rows[i].PkMoreOrEqual(row)
@@ -247,15 +352,6 @@ func (c *ChunkSnapshot) findRow(row []interface{}) (*Row, int, error) {
 	return candidate, i, nil
 }
 
-func (c *ChunkSnapshot) assertSorted() {
-	isSorted := sort.SliceIsSorted(c.Rows, func(i, j int) bool {
-		return c.Rows[i].PkLess(c.Rows[j].Data)
-	})
-	if !isSorted {
-		panic(fmt.Sprintf("rows are not sorted! %v", c.Chunk.String()))
-	}
-}
-
 // sort sorts the buffer using genericCompare. The order in the database can be different from the order in Golang (see
 // bufferStream.sort for an explanation why) and findRow doesn't work properly unless the snapshot has been sorted with
 // genericCompare.
@@ -286,16 +382,36 @@ func (c *ChunkSnapshot) insertRow(i int, row []interface{}) {
 	}
 }
 
-// reconcileOngoingChunks reconciles any ongoing chunks with the changes in the binlog event
-func (s *Snapshotter) reconcileOngoingChunks(mutation Mutation) (newMutation Mutation, err error) {
-	newMutation = mutation
-	// should be O(<rows in the RowsEvent> * lg <rows in the chunk>) given that we can binary chop into chunk
-	// RowsEvent is usually not that large so I don't think we need to index anything, that will probably be slower
-	for _, chunk := range s.ongoingChunks {
-		newMutation, err = chunk.reconcileBinlogEvent(mutation)
-		if err != nil {
-			return newMutation, errors.WithStack(err)
+// reconcileOngoingChunks reconciles any ongoing chunks with the changes in the binlog event, the rows that aren't in
+// any ongoing chunk are returned in the new mutation. Each row is looked up in the index of the ongoing chunks so this
+// is O(<rows in the RowsEvent> * (lg <ongoing chunks of the table> + lg <rows in the chunk>)).
+func (s *Snapshotter) reconcileOngoingChunks(mutation Mutation) (Mutation, error) {
+	tableChunks := s.ongoingIndex.tableChunks(mutation)
+	if len(tableChunks) == 0 {
+		return mutation, nil
+	}
+	newMutation := mutation
+	newMutation.Before = nil
+	newMutation.Rows = nil
+	for i, row := range mutation.Rows {
+		rowMutation := mutation
+		rowMutation.Rows = mutation.Rows[i : i+1]
+		rowMutation.Before = nil
+		if mutation.Type == Update {
+			// The key of an update can't change so the before image is in the same chunk
+			row = mutation.Before[i]
+			rowMutation.Before = mutation.Before[i : i+1]
+		}
+		chunk := findOngoingChunk(tableChunks, row)
+		if chunk != nil {
+			var err error
+			rowMutation, err = chunk.reconcileBinlogEvent(rowMutation)
+			if err != nil {
+				return newMutation, errors.WithStack(err)
+			}
 		}
+		newMutation.Before = append(newMutation.Before, rowMutation.Before...)
+		newMutation.Rows = append(newMutation.Rows, rowMutation.Rows...)
 	}
 	return newMutation, nil
 }
@@ -331,6 +447,11 @@ func (c *ChunkSnapshot) reconcileBinlogEvent(mutation Mutation) (Mutation, error
 			// find the row using binary chop (the chunk rows are sorted)
 			existingRow, index, err := c.findRow(row)
 			if existingRow == nil {
+				if c.Chunk.Table.Config.SourceWhere != "" {
+					// The row may not have matched the where clause when the chunk was read, then the repair doesn't
+					// read it from the target either so the delete has to be written
+					newMutation.Rows = append(newMutation.Rows, row)
+				}
 				// Row already deleted, this event probably happened after the low watermark but before the chunk read
 				continue
 			} else {
@@ -347,6 +468,9 @@ func (c *ChunkSnapshot) reconcileBinlogEvent(mutation Mutation) (Mutation, error
 				newMutation.Rows = append(newMutation.Rows, row)
 				continue
 			}
+			if mutation.ColumnsBitmap != nil {
+				return newMutation, errors.WithStack(errPartialRowImage(mutation))
+			}
 			snapshotChunkReconciles.WithLabelValues(mutation.Table.Name, mutation.Type.String()).Inc()
 			existingRow, index, err := c.findRow(row)
 			if err != nil {
@@ -365,7 +489,7 @@ func (c *ChunkSnapshot) reconcileBinlogEvent(mutation Mutation) (Mutation, error
 			after := mutation.Rows[i]
 			if !c.Chunk.ContainsRow(before) {
 				// The row is outside of our range, we can skip it
-				newMutation.Rows = append(newMutation.Before, before)
+				newMutation.Before = append(newMutation.Before, before)
 				newMutation.Rows = append(newMutation.Rows, after)
 				continue
 			}
@@ -377,9 +501,13 @@ func (c *ChunkSnapshot) reconcileBinlogEvent(mutation Mutation) (Mutation, error
 			if existingRow == nil {
 				// This must be an update of a row that is deleted after the low watermark but before
 				// the chunk read, we just insert it and if the delete event comes we take it away again
+				if mutation.ColumnsBitmap != nil {
+					return newMutation, errors.WithStack(errPartialRowImage(mutation))
+				}
 				c.insertRow(index, after)
 			} else {
-				c.updateRow(index, after)
+				// A partial after image only has the columns that changed
+				c.updateRow(index, mergeRow(existingRow.Data, after, mutation.ColumnsBitmap))
 			}
 		}
 	default:
@@ -414,7 +542,14 @@ func (s *Snapshotter) findOngoingChunkFromWatermark(mutation Mutation) (*ChunkSn
 	return nil, nil
 }
 
+// setOngoingChunks replaces the ongoing chunks and indexes them
+func (s *Snapshotter) setOngoingChunks(chunks []*ChunkSnapshot) {
+	s.ongoingChunks = chunks
+	s.ongoingIndex = newOngoingChunkIndex(chunks)
+}
+
 func (s *Snapshotter) removeOngoingChunk(chunk *ChunkSnapshot) {
+	s.ongoingIndex.remove(chunk)
 	n := 0
 	for _, x := range s.ongoingChunks {
 		if x != chunk {
@@ -425,8 +560,10 @@ func (s *Snapshotter) removeOngoingChunk(chunk *ChunkSnapshot) {
 	s.ongoingChunks = s.ongoingChunks[:n]
 }
 
-// start a snapshot asynchronously unless a snapshot is already running (in which case an error is returned)
-func (s *Snapshotter) start(ctx context.Context) error {
+// start a snapshot asynchronously unless a snapshot is already running (in which case an error is returned). The
+// request is nil for snapshots that weren't requested through the request table. A full snapshot only resumes the
+// saved progress when resume is set, a request taken from the pending requests starts over.
+func (s *Snapshotter) start(ctx context.Context, request *snapshotRequest, resume bool) error {
 	swapped := s.isSnapshotting.CompareAndSwap(false, true)
 
 	if !swapped {
@@ -435,49 +572,83 @@ func (s *Snapshotter) start(ctx context.Context) error {
 
 	go func() {
 		logger := logrus.WithContext(ctx)
-		logger.Infof("starting snapshot")
+		if request != nil {
+			logger.Infof("starting snapshot for %v", request)
+		} else {
+			logger.Infof("starting snapshot")
+		}
 
-		err := s.clearWatermarkTable(ctx)
+		err := s.markSnapshotStarted(ctx, request)
 		if err != nil {
-			logger.WithError(err).Errorf("failed to clear watermark table ahead of snapshot: %v", err)
+			logger.WithError(err).Errorf("could not mark snapshot as started in the database, won't start snapshots")
+			s.isSnapshotting.Store(false)
 			return
 		}
 
+		if s.config.SnapshotMode != SnapshotModeGTID {
+			err := s.clearWatermarkTable(ctx)
+			if err != nil {
+				s.snapshotFailed(ctx, request, errors.Wrapf(err, "failed to clear watermark table ahead of snapshot"))
+				return
+			}
+		}
+
+		// Targeted snapshots are small re-syncs which start over if they are interrupted
+		var progress map[string]snapshotProgress
+		resuming := false
+		if !request.targeted() {
+			if resume {
+				progress, resuming, err = s.readSnapshotProgress(ctx)
+				if err != nil {
+					s.snapshotFailed(ctx, request, errors.Wrapf(err, "failed to read the progress of the snapshot"))
+					return
+				}
+			}
+			if !resuming {
+				progress = nil
+				err = s.startSnapshotProgress(ctx)
+				if err != nil {
+					s.snapshotFailed(ctx, request, errors.Wrapf(err, "failed to save the start of the snapshot"))
+					return
+				}
+			}
+		}
+
 		allTables, err := LoadTables(ctx, s.config.ReaderConfig)
 		if err != nil {
-			logger.WithError(err).Errorf("failed to load tables: %v", err)
+			s.snapshotFailed(ctx, request, errors.Wrapf(err, "failed to load tables"))
 			return
 		}
 
-		var tables []*Table
-		tableNames := make([]string, len(allTables))
-		for i, table := range allTables {
-			tableNames[i] = table.Name
-		}
-		for _, table := range allTables {
-			if s.shouldSnapshot(table.Name) {
-				tables = append(tables, table)
-			}
+		tables, err := s.snapshotTables(allTables, request)
+		if err != nil {
+			s.snapshotFailed(ctx, request, errors.WithStack(err))
+			return
 		}
 
-		if len(s.config.DoSnapshotTables) > 0 {
-			var tablesToSnapshot []*Table
+		if resuming {
+			var tablesLeft []*Table
 			for _, table := range tables {
-				for _, doSnapshotTable := range s.config.DoSnapshotTables {
-					if doSnapshotTable == table.Name {
-						tablesToSnapshot = append(tablesToSnapshot, table)
-						break
-					}
+				if progress[table.Name].done {
+					continue
+				}
+				if end := progress[table.Name].end; end != nil {
+					logger.Infof("resuming the snapshot of %s at %v", table.Name, end)
 				}
+				tablesLeft = append(tablesLeft, table)
 			}
-			tables = tablesToSnapshot
+			tables = tablesLeft
 		}
 
-		tableNames = make([]string, len(tables))
+		tableNames := make([]string, len(tables))
 		for i, table := range tables {
 			tableNames[i] = table.Name
 		}
 		logger.Infof("tables to snapshot: %v", tableNames)
+		if len(tables) == 0 {
+			s.snapshotDone(ctx, request)
+			return
+		}
 
 		var estimatedRows int64
 		tablesTotalMetric.Set(float64(len(tables)))
@@ -490,9 +661,13 @@ func (s *Snapshotter) start(ctx context.Context) error {
 
 		logger = logger.WithField("task", "snapshot")
 		s.tablesLeft.Append(tableNames...)
-		err = s.chunkTables(ctx, tables)
+		err = s.chunkTables(ctx, tables, progress, request)
 		if err != nil {
 			logger.WithError(err).Errorf("failed to chunk tables: %v", err)
+			err = s.markSnapshotFailed(ctx, request, err)
+			if err != nil {
+				logger.WithError(err).Errorf("failed to update the status of the snapshot request")
+			}
 		}
 	}()
 
@@ -551,16 +726,7 @@ func (s *Snapshotter) handleWatermark(ctx context.Context, watermark Mutation, r
 		}
 
 		ongoingChunk.InsideWatermarks = false
-		rows := make([][]interface{}, len(ongoingChunk.Rows))
-		for i, row := range ongoingChunk.Rows {
-			rows[i] = row.Data
-		}
-		result = append(result, Mutation{
-			Type:  Repair,
-			Table: ongoingChunk.Chunk.Table,
-			Rows:  rows,
-			Chunk: ongoingChunk.Chunk,
-		})
+		result = append(result, ongoingChunk.repair())
 		s.removeOngoingChunk(ongoingChunk)
 		err = s.deleteWatermark(ctx, watermark)
 		if err != nil {
@@ -570,7 +736,9 @@ func (s *Snapshotter) handleWatermark(ctx context.Context, watermark Mutation, r
 	return result, nil
 }
 
-func (s *Snapshotter) chunkTables(ctx context.Context, tables []*Table) error {
+// chunkTables chunks the tables, starting after the progress of an earlier run of the snapshot if it's resumed or only
+// the key range of a targeted request
+func (s *Snapshotter) chunkTables(ctx context.Context, tables []*Table, progress map[string]snapshotProgress, request *snapshotRequest) error {
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(s.config.TableParallelism)
 
@@ -579,7 +747,11 @@ func (s *Snapshotter) chunkTables(ctx context.Context, tables []*Table) error {
 	for _, t := range tables {
 		table := t
 		g.Go(func() error {
-			err := generateTableChunksAsync(ctx, table, s.source, s.chunks, s.sourceRetry)
+			start, end := request.keyRange()
+			if progress[table.Name].end != nil {
+				start = progress[table.Name].end
+			}
+			err := generateTableChunksFrom(ctx, table, s.reader, s.chunks, s.sourceRetry, start, end, request)
 			if err != nil {
 				return errors.Wrapf(err, "failed to chunk: '%s'", table.Name)
 			}
@@ -594,26 +766,37 @@ func (s *Snapshotter) chunkTables(ctx context.Context, tables []*Table) error {
 }
 
 func (s *Snapshotter) snapshotChunk(ctx context.Context, chunk Chunk) (*ChunkSnapshot, error) {
+	if s.config.SnapshotMode == SnapshotModeGTID {
+		return s.snapshotChunkAtGTID(ctx, chunk)
+	}
+
 	//   1. insert the low watermark
 	//   2. read the entire chunk
 	//   3. insert the high watermark
+	//
+	// With a --snapshot-reader the watermarks are still written to the source but the chunk is read from the replica
+	// once it has replicated the low watermark. The replica can't get ahead of the source so the chunk it reads is
+	// between the watermarks in the binlogs just as if we had read it from the source.
 
-	_, err := s.source.ExecContext(ctx,
-		fmt.Sprintf("INSERT INTO %s (task, table_name, chunk_seq, low) VALUES (?, ?, ?, 1)",
+	result, err := s.source.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (task, table_name, chunk_seq, low, high) VALUES (?, ?, ?, 1, 0)",
 			s.config.WatermarkTable),
 		s.config.TaskName, chunk.Table.Name, chunk.Seq)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if s.reader != s.source {
+		lowWatermark, err := result.LastInsertId()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		err = s.waitForReplicatedWatermark(ctx, lowWatermark)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to snapshot %s", chunk.String())
+		}
+	}
 
-	// TODO does not support snapshotting from a replica because it writes to the same source as it reads the chunk
-	//      if we want to support snapshotting from a replica we need to do this:
-	//        1) write low watermark to master
-	//        2) observe binlogs out of replica
-	//        3) when we receive low watermark in replica -> read the chunk snapshot
-	//        4) write high watermark to master
-
-	stream, sizeBytes, err := bufferChunk(ctx, s.sourceRetry, s.source, "source", chunk)
+	stream, sizeBytes, err := bufferChunk(ctx, s.sourceRetry, s.reader, "source", chunk)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -630,7 +813,7 @@ func (s *Snapshotter) snapshotChunk(ctx context.Context, chunk Chunk) (*ChunkSna
 	s.readLogger.Record(chunk.Table.Name, len(rows), sizeBytes)
 
 	_, err = s.source.ExecContext(ctx,
-		fmt.Sprintf("INSERT INTO %s (task, table_name, chunk_seq, high) VALUES (?, ?, ?, 1)",
+		fmt.Sprintf("INSERT INTO %s (task, table_name, chunk_seq, low, high) VALUES (?, ?, ?, 0, 1)",
 			s.config.WatermarkTable),
 		s.config.TaskName, chunk.Table.Name, chunk.Seq)
 	if err != nil {
@@ -640,15 +823,55 @@ func (s *Snapshotter) snapshotChunk(ctx context.Context, chunk Chunk) (*ChunkSna
 	return snapshot, nil
 }
 
+// waitForReplicatedWatermark waits until the --snapshot-reader has replicated the watermark row with this id, we
+// identify it by id since a watermark row left behind by an earlier snapshot can still be on the replica
+func (s *Snapshotter) waitForReplicatedWatermark(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.SnapshotReaderTimeout)
+	defer cancel()
+	ticker := time.NewTicker(snapshotReaderPollInterval)
+	defer ticker.Stop()
+	for {
+		var count int
+		err := s.reader.QueryRowContext(ctx,
+			fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ?", s.config.WatermarkTable), id).Scan(&count)
+		if err == nil && count > 0 {
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return errors.WithStack(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.Errorf("the snapshot reader hasn't replicated the low watermark within %v",
+					s.config.SnapshotReaderTimeout)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
 func (s *Snapshotter) maybeSnapshotChunks(ctx context.Context) error {
 	// We read new snapshots when we have finished processing all of the ongoing chunks
 	if len(s.ongoingChunks) > 0 {
 		return nil
 	}
+	if s.config.SnapshotMode == SnapshotModeGTID && s.receivingPieces {
+		return nil
+	}
+	if len(s.chunks) == 0 {
+		return nil
+	}
+	parallelism := s.pacer.parallelism(ctx)
+	if parallelism == 0 {
+		// The replication lag is too high, the chunks stay queued until it drops
+		return nil
+	}
 
 	// Grab as many chunks as is available
 	var chunks []Chunk
-	for i := 0; i < s.config.ChunkParallelism; i++ {
+	for i := 0; i < parallelism; i++ {
 		select {
 		case chunk := <-s.chunks:
 			chunks = append(chunks, chunk)
@@ -690,22 +913,47 @@ func (s *Snapshotter) maybeSnapshotChunks(ctx context.Context) error {
 	for snapshot := range snapshotCh {
 		snapshots = append(snapshots, snapshot)
 	}
-	s.ongoingChunks = snapshots
+	s.setOngoingChunks(snapshots)
 	return nil
 }
 
-func (s *Snapshotter) snapshotDone(ctx context.Context) {
+func (s *Snapshotter) snapshotDone(ctx context.Context, request *snapshotRequest) {
 	logrus.WithField("task", "snapshot").Infof("snapshot done")
 
+	// The requests are marked completed and the progress deleted before a pending request can start a new snapshot
+	if !request.targeted() {
+		err := s.finishSnapshotProgress(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to delete the progress of the snapshot")
+		}
+	}
+	err := s.markSnapshotCompleted(ctx, request)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to update completed_at")
+	}
+
 	s.isSnapshotting.Store(false)
 
-	err := s.checkSnapshotStartRequested(ctx)
+	err = s.checkSnapshotStartRequested(ctx)
 	if err != nil {
 		logrus.WithError(err).Errorf("failed to check if snapshot has been requested")
 	}
-	err = s.markSnapshotCompleted(ctx)
+}
+
+// snapshotFailed gives up on a snapshot before it has chunked any tables and moves on to the next request
+func (s *Snapshotter) snapshotFailed(ctx context.Context, request *snapshotRequest, cause error) {
+	logger := logrus.WithContext(ctx).WithField("task", "snapshot")
+	logger.WithError(cause).Errorf("snapshot failed: %v", cause)
+	err := s.markSnapshotFailed(ctx, request, cause)
+	if err != nil {
+		logger.WithError(err).Errorf("failed to update the status of the snapshot request")
+	}
+
+	s.isSnapshotting.Store(false)
+
+	err = s.checkSnapshotStartRequested(ctx)
 	if err != nil {
-		logrus.WithError(err).Errorf("failed to update completed_at")
+		logger.WithError(err).Errorf("failed to check if snapshot has been requested")
 	}
 }
 
@@ -795,72 +1043,40 @@ func (s *Snapshotter) handleSnapshotRequest(ctx context.Context, transaction Tra
 	transaction.Mutations = newMutations
 
 	if startSnapshot {
-		err := s.markSnapshotStarted(ctx)
+		err := s.checkSnapshotStartRequested(ctx)
 		if err != nil {
-			logrus.WithError(err).Errorf("could not mark snapshot as started in the database, won't start snapshots")
-			return transaction, nil
-		}
-		err = s.start(ctx)
-		if err != nil { //nolint:staticcheck
-			// This means a snapshot is already running, we do a poll on the table after the snapshot is done instead
+			logrus.WithError(err).Errorf("failed to check if snapshot has been requested")
 		}
 	}
 
 	return transaction, nil
 }
 
-func (s *Snapshotter) markSnapshotStarted(ctx context.Context) error {
-	return errors.WithStack(Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
-		return autotx.Transact(ctx, s.source, func(tx *sql.Tx) error {
-			_, err := tx.ExecContext(ctx,
-				fmt.Sprintf("UPDATE %s SET started_at = NOW() WHERE started_at IS NULL AND task = ?",
-					s.config.SnapshotRequestTable),
-				s.config.TaskName)
-			return errors.WithStack(err)
-		})
-	}))
-}
-
-func (s *Snapshotter) markSnapshotCompleted(ctx context.Context) error {
-	return errors.WithStack(Retry(ctx, s.sourceRetry, func(ctx context.Context) error {
-		return autotx.Transact(ctx, s.source, func(tx *sql.Tx) error {
-			_, err := tx.ExecContext(ctx,
-				fmt.Sprintf("UPDATE %s SET completed_at = NOW() WHERE completed_at IS NULL AND started_at IS NOT NULL AND task = ?",
-					s.config.SnapshotRequestTable),
-				s.config.TaskName)
-			return errors.WithStack(err)
-		})
-	}))
-}
-
+// checkSnapshotStartRequested starts a snapshot for the pending request with the highest priority unless a snapshot is
+// already running, in which case it's called again once that snapshot is done
 func (s *Snapshotter) checkSnapshotStartRequested(ctx context.Context) error {
-	row := s.source.QueryRowContext(ctx,
-		fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE task = ? AND started_at IS NULL", s.config.SnapshotRequestTable),
-		s.config.TaskName)
-	var count int
-	err := row.Scan(&count)
+	if s.isSnapshotting.Load() {
+		return nil
+	}
+	request, err := s.nextSnapshotRequest(ctx)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if count > 1 {
-		err := s.markSnapshotStarted(ctx)
-		if err != nil {
-			return errors.Wrapf(err, "could not mark snapshot as started in the database, won't start snapshots")
-		}
-		err = s.start(ctx)
-		if err != nil {
-			// This means a snapshot is already running, we do a poll on the table after the snapshot is done instead
-			return nil //nolint:nilerr
-		}
+	if request == nil {
+		return nil
+	}
+	// A pending request hasn't run yet, any saved progress is from before it was requested
+	err = s.start(ctx, request, false)
+	if err != nil {
+		// This means a snapshot has just been started, we do a poll on the table after the snapshot is done instead
+		return nil //nolint:nilerr
 	}
 	return nil
 }
 
 func (s *Snapshotter) shouldSnapshot(name string) bool {
-	switch name {
-	case s.config.SnapshotRequestTable, s.config.HeartbeatTable, s.config.WatermarkTable, s.config.CheckpointTable:
+	if s.isInternalTable(name) {
 		return false
-	default:
 	}
 	if len(s.config.DoSnapshotTables) > 0 {
 		for _, doSnapshotTable := range s.config.DoSnapshotTables {
@@ -872,3 +1088,8 @@ func (s *Snapshotter) shouldSnapshot(name string) bool {
 	}
 	return true
 }
+
+// isInternalTable returns true for the tables cloner itself writes to
+func (s *Snapshotter) isInternalTable(name string) bool {
+	return s.config.isInternalTable(name)
+}
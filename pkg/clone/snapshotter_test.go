@@ -208,6 +208,63 @@ func TestOngoingChunkReconcileBinlogEvents(t *testing.T) {
 	}
 }
 
+func TestReconcileOngoingChunks(t *testing.T) {
+	newTable := func(name string) *Table {
+		return &Table{
+			Name: name,
+			MysqlTable: &schema.Table{
+				Name:      name,
+				PKColumns: []int{0},
+				Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}},
+			},
+			KeyColumns:       []string{"id"},
+			KeyColumnIndexes: []int{0},
+		}
+	}
+	customer := newTable("customer")
+	transaction := newTable("transaction")
+	newChunk := func(table *Table, start []interface{}, end []interface{}, ids ...int64) *ChunkSnapshot {
+		chunk := &ChunkSnapshot{
+			InsideWatermarks: true,
+			Chunk:            Chunk{Table: table, Start: start, End: end},
+		}
+		for _, id := range ids {
+			chunk.Rows = append(chunk.Rows, &Row{Table: table, Data: []interface{}{id, "before"}})
+		}
+		return chunk
+	}
+	last := newChunk(customer, []interface{}{int64(20)}, nil, 25)
+	first := newChunk(customer, nil, []interface{}{int64(10)}, 5)
+	// There is no ongoing chunk for 10-20
+	other := newChunk(transaction, []interface{}{int64(0)}, []interface{}{int64(100)}, 5, 15)
+	s := &Snapshotter{}
+	s.setOngoingChunks([]*ChunkSnapshot{last, first, other})
+
+	mutation, err := s.reconcileOngoingChunks(Mutation{
+		Type:   Update,
+		Table:  customer,
+		Before: [][]interface{}{{int64(25), "before"}, {int64(15), "before"}, {int64(5), "before"}},
+		Rows:   [][]interface{}{{int64(25), "after"}, {int64(15), "after"}, {int64(5), "after"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{int64(15), "before"}}, mutation.Before)
+	assert.Equal(t, [][]interface{}{{int64(15), "after"}}, mutation.Rows)
+	assert.Equal(t, "after", first.Rows[0].Data[1])
+	assert.Equal(t, "after", last.Rows[0].Data[1])
+	assert.Equal(t, "before", other.Rows[0].Data[1], "chunks of other tables are left as they are")
+
+	s.removeOngoingChunk(first)
+	mutation, err = s.reconcileOngoingChunks(Mutation{
+		Type:  Delete,
+		Table: customer,
+		Rows:  [][]interface{}{{int64(5), "after"}, {int64(25), "after"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{int64(5), "after"}}, mutation.Rows)
+	assert.Empty(t, last.Rows)
+	assert.Equal(t, []*ChunkSnapshot{last, other}, s.ongoingChunks)
+}
+
 func TestChunkSortAndFind(t *testing.T) {
 	table := &Table{
 		KeyColumnIndexes: []int{0, 1, 2},
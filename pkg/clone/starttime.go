@@ -0,0 +1,210 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// openBinlogFunc opens a stream of binlog events from the start of a binlog file, the returned function closes it
+type openBinlogFunc func(ctx context.Context, file string) (BinlogEventStreamer, func(), error)
+
+// findPositionAtTime finds the first transaction at or after a time for --start-at-time. It binary searches the binlog
+// files for the newest file that starts at or before the time and then scans it (and the files after it if needed)
+// for the first transaction with a timestamp at or after the time. If the binlogs have GTIDs the position includes the
+// GTID set executed before that transaction.
+func findPositionAtTime(ctx context.Context, files []string, open openBinlogFunc, at time.Time) (Position, error) {
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+	if len(files) == 0 {
+		return Position{}, errors.Errorf("no binlog files to search for %v", at)
+	}
+
+	// Find the first file that starts after the time, the transaction we're looking for is in the file before it
+	lo, hi := 0, len(files)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		start, err := firstEventTime(ctx, open, files[mid])
+		if err != nil {
+			return Position{}, errors.WithStack(err)
+		}
+		if start.After(at) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	file := files[0]
+	if lo > 0 {
+		file = files[lo-1]
+	} else {
+		logger.Warnf("the oldest binlog file %s starts after %v, starting from the start of it", file, at)
+	}
+
+	logger.Infof("scanning %s for the first transaction at or after %v", file, at)
+	streamer, closeStreamer, err := open(ctx, file)
+	if err != nil {
+		return Position{}, errors.WithStack(err)
+	}
+	defer closeStreamer()
+	return scanForTime(ctx, streamer, file, at)
+}
+
+// firstEventTime returns the timestamp of the first event in a binlog file
+func firstEventTime(ctx context.Context, open openBinlogFunc, file string) (time.Time, error) {
+	streamer, closeStreamer, err := open(ctx, file)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	defer closeStreamer()
+	for {
+		e, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return time.Time{}, errors.WithStack(err)
+		}
+		// The rotate event sent before the file starts has no timestamp
+		if e.Header.Timestamp == 0 {
+			continue
+		}
+		return time.Unix(int64(e.Header.Timestamp), 0), nil
+	}
+}
+
+// scanForTime reads events until the first event of a transaction at or after the time and returns the position
+// where that transaction starts
+func scanForTime(ctx context.Context, streamer BinlogEventStreamer, file string, at time.Time) (Position, error) {
+	var gset mysql.GTIDSet
+	pos := mysql.Position{Name: file, Pos: binlogFileHeaderSize}
+	inTransaction := false
+	for {
+		e, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return Position{}, errors.WithStack(err)
+		}
+		start := pos
+		if e.Header.LogPos > 0 {
+			pos.Pos = e.Header.LogPos
+		}
+		timestamp := time.Unix(int64(e.Header.Timestamp), 0)
+
+		switch event := e.Event.(type) {
+		case *replication.RotateEvent:
+			pos = mysql.Position{Name: string(event.NextLogName), Pos: uint32(event.Position)}
+		case *replication.PreviousGTIDsEvent:
+			if event.GTIDSets != "" {
+				gset, err = mysql.ParseMysqlGTIDSet(event.GTIDSets)
+				if err != nil {
+					return Position{}, errors.WithStack(err)
+				}
+			}
+		case *replication.GTIDEvent:
+			if !timestamp.Before(at) {
+				return Position{File: start.Name, Position: start.Pos, Gset: gset}, nil
+			}
+			inTransaction = true
+			if gset != nil {
+				err = gset.Update(fmt.Sprintf("%s:%d", formatSID(event.SID), event.GNO))
+				if err != nil {
+					return Position{}, errors.WithStack(err)
+				}
+			}
+		case *replication.MariadbGTIDListEvent:
+			gset = mariadbGTIDListSet(event)
+		case *replication.MariadbGTIDEvent:
+			if !timestamp.Before(at) {
+				return Position{File: start.Name, Position: start.Pos, Gset: gset}, nil
+			}
+			inTransaction = true
+			if gset != nil {
+				err = gset.Update(event.GTID.String())
+				if err != nil {
+					return Position{}, errors.WithStack(err)
+				}
+			}
+		case *replication.QueryEvent:
+			// Without GTIDs a transaction starts with a BEGIN query, a DDL is a transaction of its own
+			if !inTransaction && !timestamp.Before(at) {
+				return Position{File: start.Name, Position: start.Pos, Gset: gset}, nil
+			}
+			inTransaction = string(event.Query) == "BEGIN"
+		case *replication.XIDEvent:
+			inTransaction = false
+		default:
+		}
+	}
+}
+
+// findSourcePositionAtTime finds the position of --start-at-time in the binlogs of the source
+func (s *TransactionStream) findSourcePositionAtTime(ctx context.Context, syncerCfg replication.BinlogSyncerConfig) (Position, error) {
+	files, err := s.readBinaryLogs(ctx)
+	if err != nil {
+		return Position{}, errors.WithStack(err)
+	}
+	open := func(ctx context.Context, file string) (BinlogEventStreamer, func(), error) {
+		syncer := replication.NewBinlogSyncer(syncerCfg)
+		streamer, err := syncer.StartSync(mysql.Position{Name: file, Pos: binlogFileHeaderSize})
+		if err != nil {
+			syncer.Close()
+			return nil, nil, errors.WithStack(err)
+		}
+		return streamer, syncer.Close, nil
+	}
+	return findPositionAtTime(ctx, files, open, s.config.StartAtTime)
+}
+
+// findBinlogDirPositionAtTime finds the position of --start-at-time in the files in --binlog-dir
+func (s *TransactionStream) findBinlogDirPositionAtTime(ctx context.Context) (Position, error) {
+	files, err := listBinlogFiles(s.config.BinlogDir, "")
+	if err != nil {
+		return Position{}, errors.WithStack(err)
+	}
+	open := func(ctx context.Context, file string) (BinlogEventStreamer, func(), error) {
+		streamer, err := NewBinlogFileStreamer(ctx, s.config.BinlogDir, s.config.BinlogDirPollInterval,
+			Position{File: file, Position: binlogFileHeaderSize})
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return streamer, streamer.Close, nil
+	}
+	return findPositionAtTime(ctx, files, open, s.config.StartAtTime)
+}
+
+// readBinaryLogs lists the binlog files of the source oldest first
+func (s *TransactionStream) readBinaryLogs(ctx context.Context) ([]string, error) {
+	source, err := s.config.Source.DB()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer source.Close()
+
+	rows, err := source.QueryContext(ctx, "SHOW BINARY LOGS")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var files []string
+	for rows.Next() {
+		// Newer versions have more columns than Log_name and File_size
+		values := make([]interface{}, len(columns))
+		var name string
+		values[0] = &name
+		for i := 1; i < len(values); i++ {
+			values[i] = new(sql.RawBytes)
+		}
+		err = rows.Scan(values...)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		files = append(files, name)
+	}
+	return files, errors.WithStack(rows.Err())
+}
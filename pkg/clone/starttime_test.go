@@ -0,0 +1,101 @@
+package clone
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBinlogStreamer returns the events of the binlog files starting at a file, then io.EOF
+type fakeBinlogStreamer struct {
+	events []*replication.BinlogEvent
+}
+
+func (s *fakeBinlogStreamer) GetEvent(ctx context.Context) (*replication.BinlogEvent, error) {
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+	e := s.events[0]
+	s.events = s.events[1:]
+	return e, nil
+}
+
+func TestFindPositionAtTime(t *testing.T) {
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	base := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	at := func(minutes int) uint32 {
+		return uint32(base.Add(time.Duration(minutes) * time.Minute).Unix())
+	}
+	event := func(timestamp uint32, logPos uint32, e replication.Event) *replication.BinlogEvent {
+		return &replication.BinlogEvent{Header: &replication.EventHeader{Timestamp: timestamp, LogPos: logPos}, Event: e}
+	}
+	// Each file has a transaction every 10 minutes, binlog.000002 starts at 02:30
+	files := map[string][]*replication.BinlogEvent{
+		"binlog.000001": {
+			event(0, 0, &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000001")}),
+			event(at(0), 120, &replication.FormatDescriptionEvent{}),
+			event(at(0), 200, &replication.PreviousGTIDsEvent{GTIDSets: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10"}),
+			event(at(0), 300, &replication.GTIDEvent{SID: sid, GNO: 11}),
+			event(at(0), 400, &replication.QueryEvent{Query: []byte("BEGIN")}),
+			event(at(0), 500, &replication.XIDEvent{}),
+			event(at(10), 600, &replication.GTIDEvent{SID: sid, GNO: 12}),
+			event(at(10), 700, &replication.QueryEvent{Query: []byte("BEGIN")}),
+			event(at(10), 800, &replication.XIDEvent{}),
+			event(at(20), 900, &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000002")}),
+		},
+		"binlog.000002": {
+			event(0, 0, &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000002")}),
+			event(at(30), 120, &replication.FormatDescriptionEvent{}),
+			event(at(30), 200, &replication.PreviousGTIDsEvent{GTIDSets: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-12"}),
+			event(at(30), 300, &replication.GTIDEvent{SID: sid, GNO: 13}),
+			event(at(30), 400, &replication.QueryEvent{Query: []byte("ALTER TABLE customers ADD COLUMN age INT")}),
+			event(at(40), 500, &replication.GTIDEvent{SID: sid, GNO: 14}),
+			event(at(40), 600, &replication.QueryEvent{Query: []byte("BEGIN")}),
+			event(at(40), 700, &replication.XIDEvent{}),
+		},
+	}
+	order := []string{"binlog.000001", "binlog.000002"}
+	open := func(ctx context.Context, file string) (BinlogEventStreamer, func(), error) {
+		var events []*replication.BinlogEvent
+		found := false
+		for _, name := range order {
+			if name == file {
+				found = true
+			}
+			if found {
+				events = append(events, files[name]...)
+			}
+		}
+		return &fakeBinlogStreamer{events: events}, func() {}, nil
+	}
+
+	position, err := findPositionAtTime(context.Background(), order, open, base.Add(5*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "binlog.000001", position.File)
+	assert.Equal(t, uint32(500), position.Position)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-11", position.Gset.String())
+
+	// The DDL at 02:30 is the first transaction of the second file
+	position, err = findPositionAtTime(context.Background(), order, open, base.Add(25*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "binlog.000002", position.File)
+	assert.Equal(t, uint32(200), position.Position)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-12", position.Gset.String())
+
+	position, err = findPositionAtTime(context.Background(), order, open, base.Add(35*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "binlog.000002", position.File)
+	assert.Equal(t, uint32(400), position.Position)
+	assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-13", position.Gset.String())
+
+	// Before the oldest file we start at its first transaction
+	position, err = findPositionAtTime(context.Background(), order, open, base.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "binlog.000001", position.File)
+	assert.Equal(t, uint32(200), position.Position)
+}
@@ -0,0 +1,144 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// errStopReached is returned when replication has reached the --stop-at-* condition and everything before it has been
+// delivered by the sink, it is not a failure so the process exits 0
+var errStopReached = errors.New("replication stop condition reached")
+
+// ReplicationStop is the condition configured by --stop-at-gtid, --stop-at-position and --stop-at-time. The
+// TransactionStream halts right after the matching transaction (or right before the first transaction committed after
+// --stop-at-time) and records the position of the last transaction it emitted. The Replicator then waits for the sink
+// to checkpoint that position before it exits.
+type ReplicationStop struct {
+	gset     mysql.GTIDSet
+	position *mysql.Position
+	time     time.Time
+
+	once    sync.Once
+	reached chan struct{}
+	reason  string
+	// final is the position of the last transaction emitted, nil if nothing was emitted by this process
+	final *Position
+}
+
+// NewReplicationStop parses the stop options, it returns nil if there are none
+func NewReplicationStop(config Replicate) (*ReplicationStop, error) {
+	if config.StopAtGTID == "" && config.StopAtPosition == "" && config.StopAtTime.IsZero() {
+		return nil, nil
+	}
+	stop := &ReplicationStop{
+		time:    config.StopAtTime,
+		reached: make(chan struct{}),
+	}
+	if config.StopAtGTID != "" {
+		gset, err := parseGTIDSet(config.StopAtGTID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse --stop-at-gtid")
+		}
+		stop.gset = gset
+	}
+	if config.StopAtPosition != "" {
+		file, position, err := parseBinlogPosition(config.StopAtPosition)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse --stop-at-position")
+		}
+		stop.position = &mysql.Position{Name: file, Pos: position}
+	}
+	return stop, nil
+}
+
+// reachedAfter returns a reason if replication should stop after the transaction that ends at this position
+func (s *ReplicationStop) reachedAfter(position Position) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	if s.gset != nil && position.Gset != nil && position.Gset.Contain(s.gset) {
+		return "gtid " + s.gset.String(), true
+	}
+	if s.position != nil && position.File != "" &&
+		(mysql.Position{Name: position.File, Pos: position.Position}).Compare(*s.position) >= 0 {
+		return fmt.Sprintf("position %s:%d", s.position.Name, s.position.Pos), true
+	}
+	return "", false
+}
+
+// reachedBefore returns a reason if replication should stop before a transaction committed at this time
+func (s *ReplicationStop) reachedBefore(timestamp time.Time) (string, bool) {
+	if s == nil || s.time.IsZero() {
+		return "", false
+	}
+	if timestamp.After(s.time) {
+		return "time " + s.time.Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+// markReached is called by the TransactionStream once it has stopped emitting transactions
+func (s *ReplicationStop) markReached(reason string, final *Position) {
+	s.once.Do(func() {
+		s.reason = reason
+		s.final = final
+		close(s.reached)
+	})
+}
+
+// Wait waits for the stop condition to be reached and for the sink to checkpoint the last transaction emitted, then it
+// returns errStopReached
+func (s *ReplicationStop) Wait(ctx context.Context, sink Sink) error {
+	select {
+	case <-s.reached:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+	if s.final == nil {
+		logger.Infof("reached stop %s, nothing left to deliver", s.reason)
+		return errStopReached
+	}
+	logger.Infof("reached stop %s, waiting for %s:%d to be delivered", s.reason, s.final.File, s.final.Position)
+	for {
+		file, position, _, err := sink.ReadCheckpoint(ctx)
+		if err == nil && file != "" &&
+			(mysql.Position{Name: file, Pos: position}).Compare(mysql.Position{Name: s.final.File, Pos: s.final.Position}) >= 0 {
+			return errStopReached
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logger.WithError(err).Debugf("could not read checkpoint, retrying")
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Report logs the position replication stopped at as read from the checkpoint of the sink
+func (s *ReplicationStop) Report(ctx context.Context, sink Sink) error {
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+	file, position, executedGtidSet, err := sink.ReadCheckpoint(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			logger.Infof("replication stopped at %s: nothing has been applied", s.reason)
+			return nil
+		}
+		return errors.Wrapf(err, "could not read final checkpoint")
+	}
+	logger.
+		WithField("file", file).
+		WithField("position", position).
+		WithField("gtid", executedGtidSet).
+		Infof("replication stopped at %s: applied up to %s:%d gtid=%s", s.reason, file, position, executedGtidSet)
+	return nil
+}
@@ -0,0 +1,109 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkpointSink is a Sink that only has a checkpoint
+type checkpointSink struct {
+	mutex    sync.Mutex
+	position *Position
+}
+
+func (s *checkpointSink) Init(ctx context.Context) error {
+	return nil
+}
+
+func (s *checkpointSink) ReadCheckpoint(ctx context.Context) (string, uint32, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.position == nil {
+		return "", 0, "", errors.WithStack(sql.ErrNoRows)
+	}
+	return s.position.File, s.position.Position, "", nil
+}
+
+func (s *checkpointSink) Run(ctx context.Context, b backoff.BackOff, transactions chan Transaction) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *checkpointSink) setCheckpoint(position Position) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.position = &position
+}
+
+func TestReplicationStop(t *testing.T) {
+	stop, err := NewReplicationStop(Replicate{})
+	require.NoError(t, err)
+	assert.Nil(t, stop)
+	_, ok := stop.reachedAfter(Position{File: "binlog.000001", Position: 100})
+	assert.False(t, ok)
+
+	stop, err = NewReplicationStop(Replicate{
+		StopAtGTID:     "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5",
+		StopAtPosition: "binlog.000002:400",
+		StopAtTime:     time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, err)
+
+	gset := func(s string) mysql.GTIDSet {
+		gset, err := mysql.ParseGTIDSet(mysql.MySQLFlavor, s)
+		require.NoError(t, err)
+		return gset
+	}
+	_, ok = stop.reachedAfter(Position{File: "binlog.000001", Position: 900, Gset: gset("3E11FA47-71CA-11E1-9E33-C80AA9429562:1-4")})
+	assert.False(t, ok)
+	reason, ok := stop.reachedAfter(Position{File: "binlog.000001", Position: 1000, Gset: gset("3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5")})
+	assert.True(t, ok)
+	assert.Equal(t, "gtid 3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5", reason)
+	reason, ok = stop.reachedAfter(Position{File: "binlog.000002", Position: 400})
+	assert.True(t, ok)
+	assert.Equal(t, "position binlog.000002:400", reason)
+	_, ok = stop.reachedAfter(Position{File: "binlog.000002", Position: 300})
+	assert.False(t, ok)
+
+	_, ok = stop.reachedBefore(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	assert.False(t, ok)
+	_, ok = stop.reachedBefore(time.Date(2024, 1, 1, 12, 0, 1, 0, time.UTC))
+	assert.True(t, ok)
+
+	_, err = NewReplicationStop(Replicate{StopAtPosition: "binlog.000002"})
+	assert.Error(t, err)
+}
+
+func TestReplicationStopWaitsForCheckpoint(t *testing.T) {
+	stop, err := NewReplicationStop(Replicate{StopAtPosition: "binlog.000002:400"})
+	require.NoError(t, err)
+	sink := &checkpointSink{}
+	sink.setCheckpoint(Position{File: "binlog.000001", Position: 100})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- stop.Wait(ctx, sink)
+	}()
+
+	stop.markReached("position binlog.000002:400", &Position{File: "binlog.000002", Position: 400})
+	select {
+	case err := <-done:
+		t.Fatalf("stopped before the last transaction was checkpointed: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	sink.setCheckpoint(Position{File: "binlog.000002", Position: 400})
+	require.ErrorIs(t, <-done, errStopReached)
+	require.NoError(t, stop.Report(ctx, sink))
+}
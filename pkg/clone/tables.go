@@ -68,6 +68,35 @@ func (t *Table) KeysOfRow(row []interface{}) []interface{} {
 	return keys
 }
 
+// UniqueKeyColumns returns the columns of the unique secondary index with the given name, returns false if there is no
+// such unique index or if any of its columns are ignored
+func (t *Table) UniqueKeyColumns(indexName string) ([]string, bool) {
+	if t.MysqlTable == nil {
+		return nil, false
+	}
+	for _, index := range t.MysqlTable.Indexes {
+		if index.Name != indexName || index.Name == "PRIMARY" || index.NoneUnique != 0 {
+			continue
+		}
+		for _, column := range index.Columns {
+			if !contains(t.Columns, column) {
+				return nil, false
+			}
+		}
+		return index.Columns, true
+	}
+	return nil, false
+}
+
+// ValuesOfColumns returns the values of the named columns in the row
+func (t *Table) ValuesOfColumns(columns []string, row []interface{}) []interface{} {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		values[i] = row[findIndex(t.Columns, func(c string) bool { return c == column })]
+	}
+	return values
+}
+
 func LoadTables(ctx context.Context, config ReaderConfig) ([]*Table, error) {
 	var err error
 
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"hash/fnv"
 	_ "net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/go-mysql-org/go-mysql/mysql"
@@ -24,6 +27,11 @@ type Mutation struct {
 
 	// Chunk is only sent with a Repair mutation type
 	Chunk Chunk
+
+	// ColumnsBitmap has the columns present in Rows and BeforeColumnsBitmap the columns present in Before when the
+	// binlogs have partial row images (binlog_row_image=MINIMAL or NOBLOB), they're nil when all columns are present
+	ColumnsBitmap       []bool
+	BeforeColumnsBitmap []bool
 }
 
 func (m *Mutation) assertNoPkUpdates() {
@@ -43,6 +51,15 @@ func (m *Mutation) assertNoPkUpdates() {
 type Transaction struct {
 	Mutations     []Mutation
 	FinalPosition Position
+	// LogicalClock is read from the GTID event, it's zero if the binlogs have no GTIDs
+	LogicalClock LogicalClock
+	// Partial is set on every piece of a large transaction except the last one, see --large-transaction-rows. The
+	// FinalPosition of a partial piece is the position before the transaction so a checkpoint written with it replays
+	// the whole transaction.
+	Partial bool
+	// Piece numbers the pieces of a large transaction from 1 including the last one, it's 0 for a transaction that
+	// wasn't split
+	Piece int
 }
 
 type Position struct {
@@ -55,51 +72,106 @@ type Position struct {
 // TransactionStream consumes binlog events and emits full transactions
 type TransactionStream struct {
 	config       Replicate
+	sink         Sink
+	stop         *ReplicationStop
 	sourceSchema string
 	tables       []*Table
 
 	schemaCache map[uint64]*Table
+
+	// lastEmitted is the position of the last transaction emitted, it's kept across restarts for the stop condition
+	lastEmitted *Position
+	// relay is only set with --relay-log-dir, reading continues from the end of it
+	relay *RelayLog
+	// conflicts is only set with --loop-prevention and a --conflict-window
+	conflicts *conflictDetector
 }
 
-func NewTransactionStreamer(config Replicate) (*TransactionStream, error) {
+// NewTransactionStreamer creates a TransactionStream that starts from the checkpoint of the sink and halts at the stop
+// condition, stop can be nil
+func NewTransactionStreamer(config Replicate, sink Sink, stop *ReplicationStop) (*TransactionStream, error) {
 	r := TransactionStream{
 		config:      config,
+		sink:        sink,
+		stop:        stop,
 		schemaCache: make(map[uint64]*Table),
 	}
+	if config.LoopPrevention && config.ConflictWindow > 0 {
+		r.conflicts = newConflictDetector(config.ConflictWindow)
+	}
 	return &r, nil
 }
 
 func (s *TransactionStream) Run(ctx context.Context, b backoff.BackOff, output chan<- Transaction) error {
 	var err error
-
-	syncerCfg, err := s.config.Source.BinlogSyncerConfig(ctx, s.config.ServerID)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	position, err := s.readStartingPosition(ctx, syncerCfg.Flavor)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	syncer := replication.NewBinlogSyncer(syncerCfg)
-	defer syncer.Close()
-
-	var streamer *replication.BinlogStreamer
-	if position.Gset != nil {
-		streamer, err = syncer.StartSyncGTID(position.Gset)
+	var position Position
+	var streamer BinlogEventStreamer
+	if s.config.BinlogDir != "" {
+		position, err = s.readStartingPosition(ctx, replication.BinlogSyncerConfig{Flavor: mysql.MySQLFlavor})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if reason, ok := s.stop.reachedAfter(position); ok {
+			return s.halt(ctx, reason)
+		}
+		fileStreamer, err := NewBinlogFileStreamer(ctx, s.config.BinlogDir, s.config.BinlogDirPollInterval, position)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		defer fileStreamer.Close()
+		streamer = fileStreamer
 	} else {
-		streamer, err = syncer.StartSync(mysql.Position{Pos: position.Position, Name: position.File})
+		err = s.failOver(ctx)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		syncerCfg, err := s.config.Source.BinlogSyncerConfig(ctx, s.config.ServerID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		position, err = s.readStartingPosition(ctx, syncerCfg)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		position, err = s.checkPurgedBinlogs(ctx, syncerCfg.Flavor, position)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if reason, ok := s.stop.reachedAfter(position); ok {
+			return s.halt(ctx, reason)
+		}
+
+		syncer := replication.NewBinlogSyncer(syncerCfg)
+		defer syncer.Close()
+
+		if position.Gset != nil {
+			streamer, err = syncer.StartSyncGTID(position.Gset)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		} else {
+			streamer, err = syncer.StartSync(mysql.Position{Pos: position.Position, Name: position.File})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
 	}
 
+	return s.readTransactions(ctx, b, streamer, position, output)
+}
+
+// readTransactions reads the events from the streamer starting at position and emits a transaction for each XID event,
+// or pieces of it if it's larger than --large-transaction-rows
+func (s *TransactionStream) readTransactions(ctx context.Context, b backoff.BackOff, streamer BinlogEventStreamer, position Position, output chan<- Transaction) error {
 	var nextPos mysql.Position
 	currentTransaction := &Transaction{}
+	// lastPosition is the position before the current transaction, pieces counts the pieces of it that were sent
+	lastPosition := position
+	currentRows := 0
+	pieces := 0
+	// looped is set when the current transaction was written by the replication task in the other direction
+	looped := false
 
 	for {
 		e, err := streamer.GetEvent(ctx)
@@ -122,27 +194,104 @@ func (s *TransactionStream) Run(ctx context.Context, b backoff.BackOff, output c
 			nextPos.Name = string(event.NextLogName)
 			nextPos.Pos = uint32(event.Position)
 		case *replication.RowsEvent:
+			if s.isOriginTable(event.Table) {
+				// The writer marks the transaction before writing anything else to it
+				looped = true
+				continue
+			}
 			if !s.shouldReplicate(event.Table) {
 				ignored = true
 				continue
 			}
-			currentTransaction.Mutations = append(currentTransaction.Mutations, s.toMutation(e, event))
+			mutation, err := s.toMutation(e, event)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			s.reportConflicts(ctx, mutation, looped, time.Unix(int64(e.Header.Timestamp), 0))
+			if looped {
+				continue
+			}
+			currentTransaction.Mutations = append(currentTransaction.Mutations, mutation)
+			currentRows += len(mutation.Rows)
+			if s.config.LargeTransactionRows > 0 && currentRows > s.config.LargeTransactionRows {
+				if pieces == 0 {
+					if reason, ok := s.stop.reachedBefore(time.Unix(int64(e.Header.Timestamp), 0)); ok {
+						return s.halt(ctx, reason)
+					}
+					s.warnLargeTransaction(ctx, lastPosition)
+				}
+				// The pieces share the logical clock of the transaction so they can't be scheduled by it
+				currentTransaction.LogicalClock = LogicalClock{}
+				currentTransaction.Partial = true
+				currentTransaction.Piece = pieces + 1
+				currentTransaction.FinalPosition = lastPosition
+				select {
+				case output <- *currentTransaction:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				transactionPieces.WithLabelValues(s.config.TaskName).Inc()
+				pieces++
+				currentTransaction = &Transaction{}
+				currentRows = 0
+			}
+		case *replication.GTIDEvent:
+			looped = false
+			currentTransaction.LogicalClock = LogicalClock{
+				File:           nextPos.Name,
+				LastCommitted:  event.LastCommitted,
+				SequenceNumber: event.SequenceNumber,
+			}
 		case *replication.XIDEvent:
+			if reason, ok := s.stop.reachedBefore(time.Unix(int64(e.Header.Timestamp), 0)); ok {
+				return s.halt(ctx, reason)
+			}
 			gset := event.GSet
-			currentTransaction.FinalPosition = Position{
+			finalPosition := Position{
 				File:     nextPos.Name,
 				Position: nextPos.Pos,
 				Gset:     gset,
 			}
+			if looped {
+				// Not emitted so the checkpoint only moves past it with the next transaction, writing a checkpoint
+				// would be a write for the other direction to skip in turn
+				loopedTransactions.WithLabelValues(s.config.TaskName).Inc()
+				lastPosition = finalPosition
+				currentTransaction = &Transaction{}
+				looped = false
+				if reason, ok := s.stop.reachedAfter(finalPosition); ok {
+					return s.halt(ctx, reason)
+				}
+				b.Reset()
+				continue
+			}
+			currentTransaction.FinalPosition = finalPosition
+			if pieces > 0 {
+				currentTransaction.LogicalClock = LogicalClock{}
+				currentTransaction.Piece = pieces + 1
+				transactionPieces.WithLabelValues(s.config.TaskName).Inc()
+				logrus.WithContext(ctx).WithField("task", "replicate").
+					Infof("sent the last of %d pieces of the large transaction ending at %s:%d", pieces+1, finalPosition.File, finalPosition.Position)
+			}
 			select {
 			case output <- *currentTransaction:
 			case <-ctx.Done():
 				return ctx.Err()
 			}
+			s.lastEmitted = &finalPosition
+			lastPosition = finalPosition
 			currentTransaction = &Transaction{}
+			currentRows = 0
+			pieces = 0
+			if reason, ok := s.stop.reachedAfter(finalPosition); ok {
+				return s.halt(ctx, reason)
+			}
 			// We've received a full transaction, we can reset the backoff
 			b.Reset()
 		default:
+			if e.Header.EventType == transactionPayloadEvent {
+				return errors.WithStack(errCompressedTransaction)
+			}
 			ignored = true
 		}
 
@@ -154,8 +303,36 @@ func (s *TransactionStream) Run(ctx context.Context, b backoff.BackOff, output c
 	}
 }
 
-func (s *TransactionStream) toMutation(e *replication.BinlogEvent, event *replication.RowsEvent) Mutation {
+// warnLargeTransaction is logged when a transaction starts being sent in pieces
+func (s *TransactionStream) warnLargeTransaction(ctx context.Context, after Position) {
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+	if s.config.SplitLargeTransactions && s.config.usesMySQLSink() {
+		logger.Warnf("the transaction after %s:%d has more than %d rows, it will be committed to the target in pieces "+
+			"and the target is inconsistent until the last piece has been committed",
+			after.File, after.Position, s.config.LargeTransactionRows)
+		return
+	}
+	logger.Infof("the transaction after %s:%d has more than %d rows, sending it to the sink in pieces",
+		after.File, after.Position, s.config.LargeTransactionRows)
+}
+
+// halt stops emitting transactions once the stop condition has been reached, the sink keeps running until it has
+// delivered everything emitted so far and then the Replicator exits
+func (s *TransactionStream) halt(ctx context.Context, reason string) error {
+	logrus.WithContext(ctx).WithField("task", "replicate").Infof("reached stop %s, no more transactions will be read", reason)
+	s.stop.markReached(reason, s.lastEmitted)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *TransactionStream) toMutation(e *replication.BinlogEvent, event *replication.RowsEvent) (Mutation, error) {
 	mutationType := toMutationType(e.Header.EventType)
+	table := s.getTableSchema(event.Table)
+	columnCount := int(event.ColumnCount)
+	err := convertMariaDBValues(table, event.Rows)
+	if err != nil {
+		return Mutation{}, errors.WithStack(err)
+	}
 	switch mutationType {
 	case Update:
 		if len(event.Rows)%2 != 0 {
@@ -170,25 +347,39 @@ func (s *TransactionStream) toMutation(e *replication.BinlogEvent, event *replic
 				after[i/2] = row
 			}
 		}
+		beforeBitmap := columnsBitmap(event.ColumnBitmap1, columnCount)
+		afterBitmap, err := fillKeyColumns(table, beforeBitmap, columnsBitmap(event.ColumnBitmap2, columnCount), before, after)
+		if err != nil {
+			return Mutation{}, errors.WithStack(err)
+		}
 		mutation := Mutation{
-			Type:   Update,
-			Table:  s.getTableSchema(event.Table),
-			Before: before,
-			Rows:   after,
+			Type:                Update,
+			Table:               table,
+			Before:              before,
+			Rows:                after,
+			ColumnsBitmap:       afterBitmap,
+			BeforeColumnsBitmap: beforeBitmap,
 		}
-		return mutation
+		return mutation, nil
 	case Insert:
 		return Mutation{
-			Type:  Insert,
-			Table: s.getTableSchema(event.Table),
-			Rows:  event.Rows,
-		}
+			Type:          Insert,
+			Table:         table,
+			Rows:          event.Rows,
+			ColumnsBitmap: columnsBitmap(event.ColumnBitmap1, columnCount),
+		}, nil
 	case Delete:
-		return Mutation{
-			Type:  Delete,
-			Table: s.getTableSchema(event.Table),
-			Rows:  event.Rows,
+		bitmap := columnsBitmap(event.ColumnBitmap1, columnCount)
+		_, err := fillKeyColumns(table, bitmap, nil, event.Rows, nil)
+		if err != nil {
+			return Mutation{}, errors.WithStack(err)
 		}
+		return Mutation{
+			Type:          Delete,
+			Table:         table,
+			Rows:          event.Rows,
+			ColumnsBitmap: bitmap,
+		}, nil
 	default:
 		panic(fmt.Sprintf("unsupported mutation type: %v", mutationType))
 	}
@@ -255,6 +446,10 @@ func (s *TransactionStream) Init(ctx context.Context) error {
 		return errors.WithStack(err)
 	}
 
+	if s.config.BinlogDir != "" {
+		return s.initFromTarget(ctx)
+	}
+
 	s.tables, err = LoadTables(ctx, s.config.ReaderConfig)
 	if err != nil {
 		return errors.WithStack(err)
@@ -266,12 +461,21 @@ func (s *TransactionStream) Init(ctx context.Context) error {
 	}
 	defer source.Close()
 
+	err = checkBinlogTransactionCompression(ctx, source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	// TODO adding this table to the list of tables to replicate should be moved to the Heartbeat
 	heartbeatTable, err := loadTable(ctx, s.config.ReaderConfig, s.config.Source.Type, source, s.sourceSchema, s.config.HeartbeatTable, TableConfig{})
 	if err != nil {
-		return errors.WithStack(err)
+		// Heartbeats are only written with the mysql sink so the table may be missing otherwise
+		if s.config.usesMySQLSink() {
+			return errors.WithStack(err)
+		}
+	} else {
+		s.tables = append(s.tables, heartbeatTable)
 	}
-	s.tables = append(s.tables, heartbeatTable)
 
 	// TODO adding this table to the list of tables to replicate should be moved to the Snapshotter
 	watermarkTable, err := loadTable(ctx, s.config.ReaderConfig, s.config.Source.Type, source, s.sourceSchema, s.config.WatermarkTable, TableConfig{})
@@ -289,10 +493,67 @@ func (s *TransactionStream) Init(ctx context.Context) error {
 	return nil //nolint:nilerr
 }
 
-func (s *TransactionStream) readStartingPosition(ctx context.Context, flavor string) (Position, error) {
+// initFromTarget loads the table definitions from the target when reading from binlog files since there may be no
+// source server, the tables need to have the same columns in the same order on the target as when the binlogs were
+// written. The source schema is only used to match the schema of the events.
+func (s *TransactionStream) initFromTarget(ctx context.Context) error {
+	var err error
+	if s.sourceSchema == "" {
+		s.sourceSchema, err = s.config.Target.Schema()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	config := s.config.ReaderConfig
+	config.Source = DBConfig{}
+	s.tables, err = LoadTables(ctx, config)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	targetSchema, err := s.config.Target.Schema()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	target, err := s.config.Target.DB()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer target.Close()
+
+	// The internal tables are only in the binlogs if they were written by a previous replication from the same source
+	for _, tableName := range []string{s.config.HeartbeatTable, s.config.WatermarkTable, s.config.SnapshotRequestTable} {
+		table, err := loadTable(ctx, config, s.config.Target.Type, target, targetSchema, tableName, TableConfig{})
+		if err != nil {
+			continue
+		}
+		s.tables = append(s.tables, table)
+	}
+	return nil
+}
+
+// readStartingPosition reads the position to start replicating from, syncerCfg is used to scan the binlogs of the
+// source for --start-at-time
+func (s *TransactionStream) readStartingPosition(ctx context.Context, syncerCfg replication.BinlogSyncerConfig) (Position, error) {
 	logger := logrus.WithContext(ctx).WithField("task", "replicate")
 
-	file, position, executedGtidSet, err := s.readCheckpoint(ctx)
+	if s.relay != nil {
+		relayed, ok, err := s.relay.lastPosition()
+		if err != nil {
+			return Position{}, errors.WithStack(err)
+		}
+		if ok {
+			logger.Infof("continuing replication from the end of the relay log at %s:%d", relayed.File, relayed.Position)
+			if s.lastEmitted == nil {
+				// Everything in the relay log has to be delivered before a stop condition is reached
+				s.lastEmitted = &relayed
+			}
+			return relayed, nil
+		}
+	}
+
+	file, position, executedGtidSet, err := s.sink.ReadCheckpoint(ctx)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			if s.config.StartingGTID != "" {
@@ -305,8 +566,34 @@ func (s *TransactionStream) readStartingPosition(ctx context.Context, flavor str
 					return Position{}, errors.WithStack(err)
 				}
 				logger.Infof("starting new replication from last source gtid=%s", executedGtidSet)
+			} else if s.config.StartingPosition != "" {
+				file, position, err = parseBinlogPosition(s.config.StartingPosition)
+				if err != nil {
+					return Position{}, errors.WithStack(err)
+				}
+				executedGtidSet = ""
+				logger.Infof("starting new replication from %s:%d", file, position)
+			} else if !s.config.StartAtTime.IsZero() {
+				var found Position
+				if s.config.BinlogDir != "" {
+					found, err = s.findBinlogDirPositionAtTime(ctx)
+				} else {
+					found, err = s.findSourcePositionAtTime(ctx, syncerCfg)
+				}
+				if err != nil {
+					return Position{}, errors.WithStack(err)
+				}
+				file, position, executedGtidSet = found.File, found.Position, ""
+				if found.Gset != nil {
+					executedGtidSet = found.Gset.String()
+				}
+				logger.Infof("starting new replication from %s:%d gtid=%s, the first transaction at or after %v",
+					file, position, executedGtidSet, s.config.StartAtTime)
+			} else if s.config.BinlogDir != "" {
+				file, position, executedGtidSet = "", 0, ""
+				logger.Infof("starting new replication from the oldest binlog file in %s", s.config.BinlogDir)
 			} else {
-				file, position, executedGtidSet, err = s.readMasterPosition(ctx)
+				file, position, executedGtidSet, err = s.readMasterPosition(ctx, syncerCfg.Flavor)
 				logger.Infof("starting new replication from current master position %s:%d gtid=%s", file, position, executedGtidSet)
 				if err != nil {
 					if errors.Is(err, sql.ErrNoRows) {
@@ -318,8 +605,10 @@ func (s *TransactionStream) readStartingPosition(ctx context.Context, flavor str
 		} else {
 			return Position{}, errors.WithStack(err)
 		}
+	} else if s.config.BinlogDir != "" {
+		logger.Infof("re-starting replication from %s:%d gtid=%s", file, position, executedGtidSet)
 	} else {
-		masterFile, masterPos, masterGtidSet, err := s.readMasterPosition(ctx)
+		masterFile, masterPos, masterGtidSet, err := s.readMasterPosition(ctx, syncerCfg.Flavor)
 		if err != nil {
 			return Position{}, errors.WithStack(err)
 		}
@@ -330,7 +619,7 @@ func (s *TransactionStream) readStartingPosition(ctx context.Context, flavor str
 	// We sometimes have a GTIDSet, if not we return nil
 	var gset mysql.GTIDSet
 	if executedGtidSet != "" {
-		parsed, err := mysql.ParseGTIDSet(flavor, executedGtidSet)
+		parsed, err := parseGTIDSet(executedGtidSet)
 		if err != nil {
 			return Position{}, errors.WithStack(err)
 		}
@@ -343,44 +632,27 @@ func (s *TransactionStream) readStartingPosition(ctx context.Context, flavor str
 	}, nil
 }
 
-func (s *TransactionStream) readMasterPosition(ctx context.Context) (file string, position uint32, executedGtidSet string, err error) {
-	source, err := s.config.Source.DB()
+// parseBinlogPosition parses a binlog position in the format file:position
+func parseBinlogPosition(value string) (file string, position uint32, err error) {
+	colon := strings.LastIndex(value, ":")
+	if colon <= 0 {
+		return "", 0, errors.Errorf("binlog position needs to be in the format file:position: %s", value)
+	}
+	parsed, err := strconv.ParseUint(value[colon+1:], 10, 32)
 	if err != nil {
-		return
+		return "", 0, errors.Wrapf(err, "could not parse binlog position: %s", value)
 	}
-	defer source.Close()
-
-	row := source.QueryRowContext(ctx, "SHOW MASTER STATUS")
-	var binlogDoDB string
-	var binlogIgnoreDB string
-	err = row.Scan(
-		&file,
-		&position,
-		&binlogDoDB,
-		&binlogIgnoreDB,
-		&executedGtidSet,
-	)
-	return
+	return value[:colon], uint32(parsed), nil
 }
 
-func (s *TransactionStream) readCheckpoint(ctx context.Context) (file string, position uint32, executedGtidSet string, err error) {
-	target, err := s.config.Target.DB()
+func (s *TransactionStream) readMasterPosition(ctx context.Context, flavor string) (file string, position uint32, executedGtidSet string, err error) {
+	source, err := s.config.Source.DB()
 	if err != nil {
-		err = errors.WithStack(err)
 		return
 	}
-	defer target.Close()
+	defer source.Close()
 
-	row := target.QueryRowContext(ctx,
-		fmt.Sprintf("SELECT file, position, source_gtid FROM %s WHERE task = ?",
-			s.config.CheckpointTable),
-		s.config.TaskName)
-	err = errors.WithStack(row.Scan(
-		&file,
-		&position,
-		&executedGtidSet,
-	))
-	return
+	return readMasterStatus(ctx, source, flavor)
 }
 
 // readLastTargetGTID reads the last "target_gtid" from the source database
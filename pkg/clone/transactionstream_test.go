@@ -0,0 +1,91 @@
+package clone
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTransactionsSendsLargeTransactionsInPieces(t *testing.T) {
+	table := &Table{Name: "customers", KeyColumnIndexes: []int{0}}
+	config := Replicate{TaskName: "main"}
+	config.LargeTransactionRows = 2
+	s := &TransactionStream{
+		config:       config,
+		sourceSchema: "source",
+		tables:       []*Table{table},
+		schemaCache:  make(map[uint64]*Table),
+	}
+	tableMap := &replication.TableMapEvent{TableID: 1, Schema: []byte("source"), Table: []byte("customers")}
+	//nolint:nosnakecase
+	insert := func(logPos uint32, ids ...int) *replication.BinlogEvent {
+		var rows [][]interface{}
+		for _, id := range ids {
+			rows = append(rows, []interface{}{id, "name"})
+		}
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2, LogPos: logPos},
+			Event:  &replication.RowsEvent{Table: tableMap, Rows: rows},
+		}
+	}
+	xid := func(logPos uint32) *replication.BinlogEvent {
+		return &replication.BinlogEvent{Header: &replication.EventHeader{LogPos: logPos}, Event: &replication.XIDEvent{}}
+	}
+	gtid := func(logPos uint32) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{LogPos: logPos},
+			Event:  &replication.GTIDEvent{LastCommitted: 1, SequenceNumber: 2},
+		}
+	}
+	streamer := &fakeBinlogStreamer{events: []*replication.BinlogEvent{
+		{Header: &replication.EventHeader{}, Event: &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000001")}},
+		// Small enough to be sent whole
+		gtid(100),
+		insert(200, 1, 2),
+		xid(300),
+		// Sent in two pieces and the rest
+		gtid(400),
+		insert(500, 3, 4),
+		insert(600, 5),
+		insert(700, 6, 7, 8),
+		insert(800, 9),
+		xid(900),
+	}}
+
+	output := make(chan Transaction, 10)
+	start := Position{File: "binlog.000001", Position: 4}
+	err := s.readTransactions(context.Background(), backoff.NewExponentialBackOff(), streamer, start, output)
+	require.ErrorIs(t, err, io.EOF)
+	close(output)
+	var transactions []Transaction
+	for transaction := range output {
+		transactions = append(transactions, transaction)
+	}
+
+	require.Len(t, transactions, 4)
+	assert.False(t, transactions[0].Partial)
+	assert.Equal(t, Position{File: "binlog.000001", Position: 300}, transactions[0].FinalPosition)
+	assert.True(t, transactions[0].LogicalClock.valid())
+
+	// The pieces have the position of the transaction before them and no logical clock
+	assert.Equal(t, 0, transactions[0].Piece)
+	for i, piece := range transactions[1:3] {
+		assert.True(t, piece.Partial)
+		assert.Equal(t, i+1, piece.Piece)
+		assert.Equal(t, Position{File: "binlog.000001", Position: 300}, piece.FinalPosition)
+		assert.False(t, piece.LogicalClock.valid())
+	}
+	assert.Len(t, transactions[1].Mutations, 2)
+	assert.Len(t, transactions[2].Mutations, 1)
+	last := transactions[3]
+	assert.False(t, last.Partial)
+	assert.Equal(t, 3, last.Piece)
+	assert.Equal(t, Position{File: "binlog.000001", Position: 900}, last.FinalPosition)
+	assert.False(t, last.LogicalClock.valid())
+	assert.Equal(t, [][]interface{}{{9, "name"}}, last.Mutations[0].Rows)
+}
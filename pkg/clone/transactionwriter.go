@@ -6,7 +6,6 @@ import (
 	"database/sql/driver"
 	"fmt"
 	_ "net/http/pprof"
-	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,9 +14,7 @@ import (
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/dlmiddlecote/sqlstats"
-	mysqlschema "github.com/go-mysql-org/go-mysql/schema"
 	"github.com/mightyguava/autotx"
-	"github.com/mitchellh/hashstructure/v2"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -33,6 +30,16 @@ type TransactionWriter struct {
 	targetRetry     RetryOptions
 	replicateLogger *ThroughputLogger
 	repairLogger    *ThroughputLogger
+
+	// targetFlavor is the replication flavor of the target, only detected with --save-gtid-executed
+	targetFlavor string
+	// applied are the transactions parallel replication applied after the checkpoint, read when it starts
+	applied *appliedTransactions
+	// pacer is told how long it takes to apply transactions to pace the snapshot chunk reads
+	pacer *snapshotPacer
+	// pieces are the positions of the pieces of the large transaction parallel replication is receiving, their records
+	// are only deleted by the checkpoint after the last piece since earlier checkpoints are before the transaction
+	pieces []binlogPosition
 }
 
 func NewTransactionWriter(config Replicate) (*TransactionWriter, error) {
@@ -73,11 +80,60 @@ func (w *TransactionWriter) Init(ctx context.Context) error {
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		err = w.createSnapshotProgressTable(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if w.config.ReplicationParallelism > 1 {
+			err = w.createAppliedTable(ctx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if w.config.LoopPrevention {
+			err = w.createOriginTable(ctx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if w.config.ConflictPolicy == ConflictPolicyLog {
+			err = w.createConflictTable(ctx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if w.config.DirtyChunkSize > 0 {
+			err = w.createDirtyChunkTable(ctx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	if w.config.SaveGTIDExecuted {
+		w.targetFlavor, err = detectFlavor(ctx, w.target, w.config.Target.Flavor)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	}
 
 	return nil
 }
 
+// ReadCheckpoint reads the position of the last transaction written from the checkpoint table of the target
+func (w *TransactionWriter) ReadCheckpoint(ctx context.Context) (file string, position uint32, executedGtidSet string, err error) {
+	row := w.target.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT file, position, source_gtid FROM %s WHERE task = ?",
+			w.config.CheckpointTable),
+		w.config.TaskName)
+	err = errors.WithStack(row.Scan(
+		&file,
+		&position,
+		&executedGtidSet,
+	))
+	return
+}
+
 func (w *TransactionWriter) Run(ctx context.Context, b backoff.BackOff, transactions chan Transaction) error {
 	prometheus.MustRegister(w.targetCollector)
 	defer prometheus.Unregister(w.targetCollector)
@@ -99,14 +155,34 @@ func (w *TransactionWriter) runSequential(ctx context.Context, b backoff.BackOff
 			return ctx.Err()
 		}
 
-		err := w.transact(ctx, func(tx *sql.Tx) error {
+		if transaction.Partial && !w.config.SplitLargeTransactions {
+			err := w.writeStreamed(ctx, transaction, transactions)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			b.Reset()
+			continue
+		}
+
+		err := w.throttleRepairs(ctx, transaction)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dirty := w.newDirtyChunkSet()
+		dirty.add(w.config, transaction)
+		applyStart := time.Now()
+		err = w.transact(ctx, func(tx *sql.Tx) error {
 			for _, mutation := range transaction.Mutations {
 				err := w.handleMutation(ctx, tx, mutation)
 				if err != nil {
 					return errors.WithStack(err)
 				}
 			}
-			err := w.writeCheckpoint(ctx, tx, transaction.FinalPosition)
+			err := w.recordDirtyChunks(ctx, tx, dirty)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			err = w.writeCheckpoint(ctx, tx, transaction.FinalPosition)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -115,92 +191,71 @@ func (w *TransactionWriter) runSequential(ctx context.Context, b backoff.BackOff
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		w.pacer.observeApply(time.Since(applyStart))
 
 		// We've committed a transaction, we can reset the backoff
 		b.Reset()
 	}
 }
 
-type pkSet struct {
-	table      *Table
-	mysqlTable *mysqlschema.Table
-	m          map[uint64][][]interface{}
-}
-
-// Intersects checks if any PKs in the set belong to the chunk
-func (s *pkSet) Intersects(chunk Chunk) bool {
-	for _, pks := range s.m {
-		for _, pk := range pks {
-			if chunk.ContainsKeys(pk) {
-				return true
-			}
-		}
+// writeStreamed writes the pieces of a large transaction in a single target transaction as they are read, first is the
+// first piece which has already been read. Earlier pieces are no longer in memory so the target transaction can't be
+// retried, an error returns errRestartFromCheckpoint so that every stage restarts and the stream reads the transaction
+// again from the checkpoint before it.
+func (w *TransactionWriter) writeStreamed(ctx context.Context, first Transaction, transactions chan Transaction) error {
+	err := w.writeStreamedTransaction(ctx, first, transactions)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		// Permanent so that the sink isn't restarted on its own, it would read the next piece from the stream
+		return backoff.Permanent(errors.Wrapf(errRestartFromCheckpoint, "could not write large transaction: %v", err))
 	}
-	return false
+	return err
 }
 
-func (s *pkSet) ContainsRow(row []interface{}) bool {
-	pkValues, err := s.keysOfRow(row)
+func (w *TransactionWriter) writeStreamedTransaction(ctx context.Context, first Transaction, transactions chan Transaction) error {
+	tx, err := w.target.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
-		panic(err)
-	}
-	return s.ContainsKeys(pkValues)
-}
-
-func (s *pkSet) keysOfRow(row []interface{}) ([]interface{}, error) {
-	if s.table != nil {
-		return s.table.KeysOfRow(row), nil
+		return errors.WithStack(err)
 	}
-	return s.mysqlTable.GetPKValues(row)
-}
-
-func (s *pkSet) ContainsKeys(keys []interface{}) bool {
-	hash, err := hashstructure.Hash(keys, hashstructure.FormatV2, nil)
+	defer func() {
+		// No-op after the commit
+		_ = tx.Rollback()
+	}()
+	err = w.markOrigin(ctx, tx)
 	if err != nil {
-		panic(err)
-	}
-	vals, exists := s.m[hash]
-	if !exists {
-		return false
+		return errors.WithStack(err)
 	}
-	for _, val := range vals {
-		if reflect.DeepEqual(keys, val) {
-			return true
+	dirty := w.newDirtyChunkSet()
+	transaction := first
+	for {
+		err := w.throttleRepairs(ctx, transaction)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dirty.add(w.config, transaction)
+		for _, mutation := range transaction.Mutations {
+			err := w.handleMutation(ctx, tx, mutation)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if !transaction.Partial {
+			break
+		}
+		select {
+		case transaction = <-transactions:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
-	return false
-}
-
-func (s *pkSet) AddRow(row []interface{}) {
-	keys, err := s.keysOfRow(row)
+	err = w.recordDirtyChunks(ctx, tx, dirty)
 	if err != nil {
-		panic(err)
-	}
-	s.AddKeys(keys)
-}
-
-func (s *pkSet) AddKeys(keys []interface{}) {
-	if s.ContainsKeys(keys) {
-		// We already got it
-		return
+		return errors.WithStack(err)
 	}
-	hash, err := hashstructure.Hash(keys, hashstructure.FormatV2, nil)
+	err = w.writeCheckpoint(ctx, tx, transaction.FinalPosition)
 	if err != nil {
-		panic(err)
-	}
-	s.m[hash] = append(s.m[hash], keys)
-}
-
-func (s *pkSet) String() string {
-	var vals []string
-	for _, pks := range s.m {
-		for _, pk := range pks {
-			for _, val := range pk {
-				vals = append(vals, fmt.Sprintf("%v", val))
-			}
-		}
+		return errors.WithStack(err)
 	}
-	return strings.Join(vals, " ")
+	return errors.WithStack(tx.Commit())
 }
 
 type orderedTransaction struct {
@@ -209,12 +264,17 @@ type orderedTransaction struct {
 }
 
 type transactionSequence struct {
-	writer *TransactionWriter
-	// chunks is the list of chunks this sequence repair
-	chunks []Chunk
-	// primaryKeys caches the primary key sets of this sequence, keyed by table name
-	primaryKeys  map[string]*pkSet
+	writer       *TransactionWriter
 	transactions []orderedTransaction
+	// mergedInto is the sequence this sequence was merged into, see causalityIndex
+	mergedInto *transactionSequence
+
+	// clock, dependsOn and depth are only used when scheduling by logical clock, the sequence waits for the sequences it
+	// depends on before it runs and depth is the length of the longest chain of dependencies before it
+	clock     LogicalClock
+	dependsOn []*transactionSequence
+	depth     int
+	done      chan struct{}
 }
 
 func (s *transactionSequence) Print(ctx context.Context) {
@@ -235,89 +295,8 @@ func (s *transactionSequence) Print(ctx context.Context) {
 	}
 }
 
-func (s *transactionSequence) IsCausal(transaction Transaction) bool {
-	for _, chunk := range s.chunks {
-		for _, mutation := range transaction.Mutations {
-			if mutation.Type == Repair {
-				// Chunks never overlap so this mutation is certainly not causal
-				continue
-			}
-			if mutation.Table.Name != chunk.Table.Name {
-				// Not the same table so certainly not causal
-				continue
-			}
-
-			// Same table and not a Repair so go through all the PKs to check if they are inside this chunk
-			for _, row := range mutation.Before {
-				if chunk.ContainsRow(row) {
-					return true
-				}
-			}
-			for _, row := range mutation.Rows {
-				if chunk.ContainsRow(row) {
-					// Yep, causal
-					return true
-				}
-			}
-		}
-	}
-	for _, mutation := range transaction.Mutations {
-		if mutation.Type == Repair {
-			for tableName, pks := range s.primaryKeys {
-				chunk := mutation.Chunk
-				if chunk.Table.Name != tableName {
-					continue
-				}
-				if pks.Intersects(chunk) {
-					return true
-				}
-			}
-		} else {
-			pks, exists := s.primaryKeys[mutation.Table.Name]
-			if !exists {
-				// This sequence doesn't touch this table (yet?) so not causal with these mutations for sure
-				continue
-			}
-			for _, row := range mutation.Before {
-				if pks.ContainsRow(row) {
-					return true
-				}
-			}
-			for _, row := range mutation.Rows {
-				if pks.ContainsRow(row) {
-					return true
-				}
-			}
-		}
-	}
-	return false
-}
-
 func (s *transactionSequence) Append(transaction orderedTransaction) {
 	s.transactions = append(s.transactions, transaction)
-
-	// update the cache of the primary key set
-	for _, mutation := range transaction.transaction.Mutations {
-		if mutation.Type == Repair {
-			s.chunks = append(s.chunks, mutation.Chunk)
-		} else {
-			pks, exists := s.primaryKeys[mutation.Table.Name]
-			if !exists {
-				pks = &pkSet{
-					table:      mutation.Table,
-					mysqlTable: mutation.Table.MysqlTable,
-					m:          make(map[uint64][][]interface{}),
-				}
-				s.primaryKeys[mutation.Table.Name] = pks
-			}
-			for _, row := range mutation.Before {
-				pks.AddRow(row)
-			}
-			for _, row := range mutation.Rows {
-				pks.AddRow(row)
-			}
-		}
-	}
 }
 
 func (s *transactionSequence) Run(ctx context.Context) error {
@@ -325,14 +304,18 @@ func (s *transactionSequence) Run(ctx context.Context) error {
 		if len(transaction.transaction.Mutations) == 0 {
 			continue
 		}
-		err := s.writer.transact(ctx, func(tx *sql.Tx) error {
+		err := s.writer.throttleRepairs(ctx, transaction.transaction)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = s.writer.transact(ctx, func(tx *sql.Tx) error {
 			for _, mutation := range transaction.transaction.Mutations {
 				err := s.writer.handleMutation(ctx, tx, mutation)
 				if err != nil {
 					return errors.WithStack(err)
 				}
 			}
-			return nil
+			return errors.WithStack(s.writer.recordApplied(ctx, tx, transaction.transaction))
 		})
 		if err != nil {
 			return errors.WithStack(err)
@@ -343,19 +326,31 @@ func (s *transactionSequence) Run(ctx context.Context) error {
 
 func (s *transactionSequence) PKSetString() string {
 	var result []string
-	for _, c := range s.chunks {
-		result = append(result, fmt.Sprintf("%s: [%d - %d]", c.Table.Name, c.Start, c.End))
-	}
-	for table, pks := range s.primaryKeys {
-		result = append(result, fmt.Sprintf("%s: [%v]", table, pks))
+	for _, transaction := range s.transactions {
+		result = append(result, PKSetString(transaction.transaction))
 	}
 	return strings.Join(result, " ")
 }
 
 func PKSetString(t Transaction) string {
-	seq := transactionSequence{primaryKeys: make(map[string]*pkSet)}
-	seq.Append(orderedTransaction{transaction: t})
-	return seq.PKSetString()
+	var result []string
+	for _, mutation := range t.Mutations {
+		if mutation.Type == Repair {
+			c := mutation.Chunk
+			result = append(result, fmt.Sprintf("%s: [%d - %d]", c.Table.Name, c.Start, c.End))
+			continue
+		}
+		var vals []string
+		for _, rows := range [][][]interface{}{mutation.Before, mutation.Rows} {
+			for _, row := range rows {
+				for _, val := range mutation.Table.KeysOfRow(row) {
+					vals = append(vals, fmt.Sprintf("%v", val))
+				}
+			}
+		}
+		result = append(result, fmt.Sprintf("%s: [%s]", mutation.Table.Name, strings.Join(vals, " ")))
+	}
+	return strings.Join(result, " ")
 }
 
 type transactionSet struct {
@@ -366,6 +361,22 @@ type transactionSet struct {
 	finalPosition Position
 	g             *errgroup.Group
 	timer         *prometheus.Timer
+
+	// logicalClock schedules the transactions by their logical clocks instead of their keys, see appendByLogicalClock
+	logicalClock bool
+	barrier      *transactionSequence
+	sinceBarrier []*transactionSequence
+	clockFile    string
+	// shadow is scheduled with the other scheduler only to compare the parallelism, it's never started
+	shadow *transactionSet
+	// index finds the sequences a transaction is causal with when scheduling by keys
+	index *causalityIndex
+	// streamed is the first piece of a large transaction that follows the transactions of this set
+	streamed *Transaction
+	// applied are the positions of the transactions recorded in --applied-table that the checkpoint of this set covers
+	applied []binlogPosition
+	// dirty are the chunks the transactions of this set write to, recorded with its checkpoint
+	dirty dirtyChunkSet
 }
 
 func (s *transactionSet) Append(t Transaction) {
@@ -375,16 +386,21 @@ func (s *transactionSet) Append(t Transaction) {
 	}
 	s.ordinal++
 	s.finalPosition = transaction.transaction.FinalPosition
-	var sequences []*transactionSequence
-	for _, sequence := range s.sequences {
-		if sequence.IsCausal(transaction.transaction) {
-			sequences = append(sequences, sequence)
-		}
+	if s.shadow != nil {
+		s.shadow.Append(t)
+	}
+	if s.logicalClock {
+		s.appendByLogicalClock(transaction)
+		return
+	}
+	if s.index == nil {
+		s.index = newCausalityIndex()
 	}
+	sequences := s.index.causalSequences(transaction.transaction)
 	var sequence *transactionSequence
 	if len(sequences) == 0 {
 		// Non-causal with any of the existing sequences, so we create a new sequence for this transaction
-		sequence = &transactionSequence{writer: s.writer, primaryKeys: make(map[string]*pkSet)}
+		sequence = &transactionSequence{writer: s.writer}
 		s.sequences = append(s.sequences, sequence)
 	} else if len(sequences) == 1 {
 		sequence = sequences[0]
@@ -401,12 +417,13 @@ func (s *transactionSet) Append(t Transaction) {
 			return transactions[i].ordinal < transactions[j].ordinal
 		})
 		// add them to a fresh sequence
-		sequence = &transactionSequence{writer: s.writer, primaryKeys: make(map[string]*pkSet)}
+		sequence = &transactionSequence{writer: s.writer}
 		for _, t := range transactions {
 			sequence.Append(t)
 		}
-		// then remove all the merged sequences
+		// then remove all the merged sequences, the index still points to them so they point to the union
 		for _, seq := range sequences {
+			seq.mergedInto = sequence
 			for i, sq := range s.sequences {
 				if sq == seq {
 					s.sequences = append(s.sequences[:i], s.sequences[i+1:]...)
@@ -419,10 +436,23 @@ func (s *transactionSet) Append(t Transaction) {
 	}
 
 	sequence.Append(transaction)
+	s.index.add(transaction.transaction, sequence)
+}
+
+// Skip moves the checkpoint of the set past a transaction that was applied before a restart
+func (s *transactionSet) Skip(t Transaction) {
+	s.finalPosition = t.FinalPosition
+}
+
+// empty returns true if the set has neither transactions to apply nor a checkpoint to write
+func (s *transactionSet) empty() bool {
+	return s.ordinal == 0 && len(s.applied) == 0
 }
 
 func (s *transactionSet) Wait() error {
-	defer s.timer.ObserveDuration()
+	defer func() {
+		s.writer.pacer.observeApply(s.timer.ObserveDuration())
+	}()
 	return errors.WithStack(s.g.Wait())
 }
 
@@ -434,6 +464,11 @@ func (s *transactionSet) Start(parent context.Context) {
 	s.timer = prometheus.NewTimer(replicationParallelismApplyDuration.WithLabelValues(s.writer.config.TaskName))
 	replicationParallelism.WithLabelValues(s.writer.config.TaskName).Set(float64(len(s.sequences)))
 	replicationParallelismBatchSize.WithLabelValues(s.writer.config.TaskName).Set(float64(s.ordinal))
+	replicationParallelismEstimate.WithLabelValues(s.writer.config.TaskName, s.schedulerName()).Set(s.parallelismEstimate())
+	if s.shadow != nil {
+		replicationParallelismEstimate.WithLabelValues(s.writer.config.TaskName, s.shadow.schedulerName()).
+			Set(s.shadow.parallelismEstimate())
+	}
 	logrus.WithContext(parent).WithField("task", "replicate").
 		Debugf("starting a batch of %d transactions run in %d parallel sequences with actual parallelism of %d",
 			s.ordinal, len(s.sequences), s.writer.config.ReplicationParallelism)
@@ -441,13 +476,25 @@ func (s *transactionSet) Start(parent context.Context) {
 	g, ctx := errgroup.WithContext(parent)
 	g.SetLimit(s.writer.config.ReplicationParallelism)
 	s.g = g
+	for _, seq := range s.sequences {
+		seq.done = make(chan struct{})
+	}
+	// A sequence only depends on sequences started before it so waiting while holding a slot can't deadlock
 	for _, seq := range s.sequences {
 		sequence := seq
 		s.g.Go(func() error {
+			for _, dependency := range sequence.dependsOn {
+				select {
+				case <-dependency.done:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
 			err := sequence.Run(ctx)
 			if err != nil {
 				return errors.WithStack(err)
 			}
+			close(sequence.done)
 			return nil
 		})
 	}
@@ -479,6 +526,11 @@ func (s *transactionSet) Print(ctx context.Context) {
 
 // runParallel implements parallelized replication
 func (w *TransactionWriter) runParallel(ctx context.Context, b backoff.BackOff, transactions chan Transaction) error {
+	var err error
+	w.applied, err = w.readAppliedTransactions(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	var currentlyExecutingTransactionSet *transactionSet
 	for {
 		nextTransactionSet, err := w.fillTransactionSet(ctx, transactions)
@@ -488,46 +540,108 @@ func (w *TransactionWriter) runParallel(ctx context.Context, b backoff.BackOff,
 
 		// Wait for the currently executing transaction set to complete running
 		if currentlyExecutingTransactionSet != nil {
-			err := currentlyExecutingTransactionSet.Wait()
+			err := w.finishTransactionSet(ctx, currentlyExecutingTransactionSet)
 			if err != nil {
 				return errors.WithStack(err)
 			}
-			err = autotx.TransactWithOptions(ctx, w.target, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
-				err := w.writeCheckpoint(ctx, tx, currentlyExecutingTransactionSet.finalPosition)
-				return errors.WithStack(err)
-			})
+
+			// We've committed a transaction set, we can reset the backoff
+			b.Reset()
+			currentlyExecutingTransactionSet = nil
+		}
+		if nextTransactionSet.streamed != nil {
+			// The transactions before a large transaction have to be applied before we start streaming it
+			if !nextTransactionSet.empty() {
+				nextTransactionSet.Start(ctx)
+				err := w.finishTransactionSet(ctx, nextTransactionSet)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			err := w.writeStreamed(ctx, *nextTransactionSet.streamed, transactions)
 			if err != nil {
 				return errors.WithStack(err)
 			}
-
-			// We've committed a transaction set, we can reset the backoff
 			b.Reset()
+			continue
+		}
+		if nextTransactionSet.empty() {
+			// Nothing came in before the timeout, the checkpoint of the previous transaction set has been written so we
+			// can wait for more transactions
+			continue
 		}
 		currentlyExecutingTransactionSet = nextTransactionSet
 		currentlyExecutingTransactionSet.Start(ctx)
 	}
 }
 
+// finishTransactionSet waits for a started transaction set and then writes its checkpoint
+func (w *TransactionWriter) finishTransactionSet(ctx context.Context, set *transactionSet) error {
+	err := set.Wait()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = autotx.TransactWithOptions(ctx, w.target, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		err := w.markOrigin(ctx, tx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = w.deleteApplied(ctx, tx, set.applied)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = w.recordDirtyChunks(ctx, tx, set.dirty)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = w.writeCheckpoint(ctx, tx, set.finalPosition)
+		return errors.WithStack(err)
+	})
+	return errors.WithStack(err)
+}
+
+func (w *TransactionWriter) newTransactionSet() *transactionSet {
+	set := &transactionSet{
+		writer:       w,
+		logicalClock: w.config.ParallelApply == ParallelApplyLogicalClock,
+		dirty:        w.newDirtyChunkSet(),
+	}
+	if w.config.ParallelApplyCompare {
+		set.shadow = &transactionSet{writer: w, logicalClock: !set.logicalClock}
+	}
+	return set
+}
+
 func (w *TransactionWriter) fillTransactionSet(ctx context.Context, transactions chan Transaction) (*transactionSet, error) {
 	size := 0
-	nextTransactionSet := &transactionSet{writer: w}
+	nextTransactionSet := w.newTransactionSet()
 	transactionSetTimeout := time.After(w.config.ParallelTransactionBatchTimeout)
 
 	// Fill the next transaction set before the transaction set timeout expires
 	for {
 		select {
 		case transaction := <-transactions:
+			if transaction.Partial && !w.config.SplitLargeTransactions {
+				// The pieces of a large transaction are streamed to the target after the transactions of this set
+				nextTransactionSet.streamed = &transaction
+				return nextTransactionSet, nil
+			}
+			// A transaction applied before a restart is recorded again since the checkpoint that recorded it wasn't written
+			nextTransactionSet.dirty.add(w.config, transaction)
+			w.deleteAppliedWith(nextTransactionSet, transaction)
+			if w.applied.skip(transaction) {
+				appliedTransactionsSkipped.WithLabelValues(w.config.TaskName).Inc()
+				nextTransactionSet.Skip(transaction)
+				continue
+			}
 			size++
 			nextTransactionSet.Append(transaction)
 			if size >= w.config.ParallelTransactionBatchMaxSize {
 				return nextTransactionSet, nil
 			}
 		case <-transactionSetTimeout:
-			if size == 0 {
-				// We have no transactions, so we might as well wait a bit longer
-				transactionSetTimeout = time.After(w.config.ParallelTransactionBatchTimeout)
-				continue
-			}
+			// If we have no transactions we still return so that the checkpoint of the currently executing transaction
+			// set is written
 			return nextTransactionSet, nil
 		case <-ctx.Done():
 			return nextTransactionSet, ctx.Err()
@@ -535,11 +649,39 @@ func (w *TransactionWriter) fillTransactionSet(ctx context.Context, transactions
 	}
 }
 
+// throttleRepairs waits for the write rate limit and for the servers to be healthy for the snapshot repairs of a
+// transaction before we start the transaction, replicated mutations are not throttled since that would only grow the
+// replication lag
+func (w *TransactionWriter) throttleRepairs(ctx context.Context, transaction Transaction) error {
+	throttle := w.config.Throttles.get(WriteThrottle)
+	for _, mutation := range transaction.Mutations {
+		if mutation.Type != Repair {
+			continue
+		}
+		w.config.Health.WaitForGoodLag(ctx)
+		err := throttle.Wait(ctx, mutation.Table, len(mutation.Rows), mutation.SizeBytes())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
 func (w *TransactionWriter) handleMutation(ctx context.Context, tx *sql.Tx, m Mutation) error {
 	if m.Table.Name == w.config.WatermarkTable {
 		// We don't send writes to the watermark table to the target
 		return nil
 	}
+	if m.Type != Repair && w.verifiesConflicts() {
+		var err error
+		m, err = w.verify(ctx, tx, m)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(m.Rows) == 0 {
+			return nil
+		}
+	}
 	rowCount, sizeBytes, err := m.Write(ctx, tx)
 	if err != nil {
 		return errors.WithStack(err)
@@ -547,6 +689,10 @@ func (w *TransactionWriter) handleMutation(ctx context.Context, tx *sql.Tx, m Mu
 
 	switch m.Type {
 	case Repair:
+		err = w.recordSnapshotProgress(ctx, tx, m.Chunk)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 		w.repairLogger.Record(m.Table.Name, rowCount, sizeBytes)
 	case Delete, Insert, Update:
 		w.replicateLogger.Record(m.Table.Name, rowCount, sizeBytes)
@@ -566,7 +712,11 @@ func (m *Mutation) Write(ctx context.Context, tx DBWriter) (rowCount int, sizeBy
 		rowCount = len(m.Rows)
 		sizeBytes = m.SizeBytes()
 	case Insert, Update:
-		err = m.replace(ctx, tx)
+		if m.Type == Update && m.ColumnsBitmap != nil {
+			err = m.update(ctx, tx)
+		} else {
+			err = m.replace(ctx, tx)
+		}
 		rowCount = len(m.Rows)
 		sizeBytes = m.SizeBytes()
 	default:
@@ -599,10 +749,10 @@ func (m *Mutation) replace(ctx context.Context, tx DBWriter) error {
 	var questionMarks strings.Builder
 	var columnListBuilder strings.Builder
 	for i, column := range tableSchema.Columns {
-		if m.Table.IgnoredColumnsBitmap[i] {
+		if m.Table.IgnoredColumnsBitmap[i] || !m.hasColumn(i) {
 			continue
 		}
-		if i != 0 {
+		if columnListBuilder.Len() > 0 {
 			columnListBuilder.WriteString(",")
 			questionMarks.WriteString(",")
 		}
@@ -625,7 +775,7 @@ func (m *Mutation) replace(ctx context.Context, tx DBWriter) error {
 		}
 		valueStrings = append(valueStrings, values)
 		for i, val := range row {
-			if !m.Table.IgnoredColumnsBitmap[i] {
+			if !m.Table.IgnoredColumnsBitmap[i] && m.hasColumn(i) {
 				valueArgs = append(valueArgs, val)
 			}
 		}
@@ -731,7 +881,7 @@ func (w *TransactionWriter) writeCheckpoint(ctx context.Context, tx *sql.Tx, pos
 	targetGTIDValue := ""
 	if w.config.SaveGTIDExecuted {
 		targetGTIDColumn = ", target_gtid"
-		targetGTIDValue = ", @@GLOBAL.gtid_executed"
+		targetGTIDValue = ", " + gtidExecutedVariable(w.targetFlavor)
 	}
 	_, err := tx.ExecContext(ctx,
 		fmt.Sprintf("REPLACE INTO %s (task, file, position, source_gtid, timestamp%s) VALUES (?, ?, ?, ?, ?%s)",
@@ -750,9 +900,16 @@ func (w *TransactionWriter) transact(ctx context.Context, f func(tx *sql.Tx) err
 		autotx.RetryOptions{
 			MaxRetries: int(w.config.WriteRetries),
 			IsRetryable: func(err error) bool {
-				return !isSchemaError(err)
+				var permanent *backoff.PermanentError
+				return !isSchemaError(err) && !errors.As(err, &permanent)
 			},
-		}, f))
+		}, func(tx *sql.Tx) error {
+			err := w.markOrigin(ctx, tx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return f(tx)
+		}))
 }
 
 // repair synchronously diffs and writes the chunk to the target (diff and write)
@@ -3,8 +3,11 @@ package clone
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 
 	mysqlschema "github.com/go-mysql-org/go-mysql/schema"
@@ -734,3 +737,45 @@ func TestIgnoredColumnsReplaceStatement(t *testing.T) {
 	err = mutation.replace(context.Background(), writer)
 	assert.NoError(t, err)
 }
+
+func TestWriteStreamedFailureRestartsFromCheckpoint(t *testing.T) {
+	_, target, table := setupUniqueKeyConflict(t, nil)
+	ctx := context.Background()
+
+	config := Replicate{TaskName: "streamed-test", CheckpointTable: "_cloner_checkpoint_streamed_test"}
+	config.WriteTimeout = time.Minute
+	w := &TransactionWriter{
+		config:          config,
+		target:          target,
+		replicateLogger: NewThroughputLogger("replication", time.Minute, 0),
+	}
+	_, err := target.ExecContext(ctx, "DROP TABLE IF EXISTS "+config.CheckpointTable)
+	require.NoError(t, err)
+	err = w.createCheckpointTable(ctx)
+	require.NoError(t, err)
+
+	before := Position{File: "mysql-bin.000001", Position: 100}
+	piece := func(partial bool, rows ...[]interface{}) Transaction {
+		return Transaction{
+			Mutations:     []Mutation{{Type: Insert, Table: table, Rows: rows}},
+			FinalPosition: before,
+			Partial:       partial,
+		}
+	}
+	transactions := make(chan Transaction, 2)
+	// The email of the second piece can't be null so the target fails in the middle of the transaction
+	transactions <- piece(true, []interface{}{int64(4), nil})
+	transactions <- piece(false, []interface{}{int64(5), "e"})
+	err = w.writeStreamed(ctx, piece(true, []interface{}{int64(3), "c"}), transactions)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errRestartFromCheckpoint))
+	var permanent *backoff.PermanentError
+	assert.True(t, errors.As(err, &permanent), "the sink must not restart on its own")
+
+	// Nothing of the transaction was committed, not even the checkpoint
+	assert.Equal(t, map[int64]string{1: "a", 2: "b"}, readAccounts(t, target))
+	var checkpoints int
+	err = target.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+config.CheckpointTable).Scan(&checkpoints)
+	require.NoError(t, err)
+	assert.Equal(t, 0, checkpoints)
+}
@@ -0,0 +1,222 @@
+package clone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mightyguava/autotx"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	UniqueKeyConflictNone   = "none"
+	UniqueKeyConflictDelete = "delete"
+	UniqueKeyConflictDefer  = "defer"
+)
+
+var (
+	uniqueKeyConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "unique_key_conflicts",
+			Help: "How many writes failed on a unique secondary key, partitioned by table and how the conflict was resolved (deleted, deferred, failed).",
+		},
+		[]string{"table", "resolution"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uniqueKeyConflicts)
+}
+
+// duplicateEntryPattern matches the message of error 1062, MySQL 8 prefixes the key name with the table name
+var duplicateEntryPattern = regexp.MustCompile(`Duplicate entry '.*' for key '(?:[^']*\.)?([^'.]+)'`)
+
+// uniqueKeyConflict returns the name of the unique secondary index if the error is a duplicate entry error on a
+// secondary index, duplicate primary keys are not unique key conflicts
+func uniqueKeyConflict(err error) (string, bool) {
+	me := mysqlError(err)
+	if me == nil || me.Number != 1062 {
+		return "", false
+	}
+	match := duplicateEntryPattern.FindStringSubmatch(me.Message)
+	if match == nil {
+		return "", false
+	}
+	indexName := match[1]
+	if indexName == "PRIMARY" {
+		return "", false
+	}
+	return indexName, true
+}
+
+// resolveUniqueKeyConflict tries to resolve a unique secondary key conflict of a single row batch according to the
+// configured UniqueKeyConflictPolicy. Since we write batches grouped by type a row can be inserted before the row
+// currently holding the same unique key has been deleted or updated by another batch. Returns nil if the conflict was
+// resolved (or the batch has been deferred), otherwise the original error.
+func (w *Writer) resolveUniqueKeyConflict(ctx context.Context, batch Batch, writeErr error, canDefer bool) error {
+	if len(batch.Rows) != 1 || batch.Type == Delete {
+		return writeErr
+	}
+	policy := w.config.UniqueKeyConflictPolicy
+	if policy == "" || policy == UniqueKeyConflictNone {
+		return writeErr
+	}
+	indexName, ok := uniqueKeyConflict(writeErr)
+	if !ok {
+		return writeErr
+	}
+	table := batch.Table
+	columns, ok := table.UniqueKeyColumns(indexName)
+	if !ok {
+		return writeErr
+	}
+
+	logger := log.WithContext(ctx).
+		WithField("task", "writer").
+		WithField("table", table.Name).
+		WithField("index", indexName)
+
+	if policy == UniqueKeyConflictDelete {
+		resolved, err := w.deleteStaleConflictingRow(ctx, logger, batch, columns)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if resolved {
+			uniqueKeyConflicts.WithLabelValues(table.Name, "deleted").Inc()
+			return nil
+		}
+	}
+
+	if !canDefer {
+		uniqueKeyConflicts.WithLabelValues(table.Name, "failed").Inc()
+		return writeErr
+	}
+	logger.Debugf("deferring %s of row %v until all other batches have been written", batch.Type, batch.Rows[0].KeyValues())
+	w.deferBatch(batch)
+	uniqueKeyConflicts.WithLabelValues(table.Name, "deferred").Inc()
+	return nil
+}
+
+// deleteStaleConflictingRow finds the target row holding the unique key of the row we're trying to write, if that row
+// is stale (it's gone from the source or has moved to another unique key value) it's deleted in the same transaction
+// as the batch is written. If the stale row still exists in the source it's deferred for re-insertion since the batch
+// that was going to update it will now miss it.
+func (w *Writer) deleteStaleConflictingRow(ctx context.Context, logger *log.Entry, batch Batch, columns []string) (bool, error) {
+	table := batch.Table
+	row := batch.Rows[0]
+	uniqueValues := table.ValuesOfColumns(columns, row.Data)
+
+	var conflicting *Row
+	err := Retry(ctx, w.retry, func(ctx context.Context) error {
+		var err error
+		conflicting, err = selectRow(ctx, w.db, table, columns, uniqueValues)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if conflicting == nil {
+		// The conflicting row has been removed by another batch since, we just try again
+		err = w.writeBatch(ctx, batch)
+		return err == nil, nil
+	}
+	if genericEqualKeys(conflicting.KeyValues(), row.KeyValues()) {
+		// It's the same row, this is not something we can resolve
+		return false, nil
+	}
+
+	var sourceRow *Row
+	err = Retry(ctx, w.retry, func(ctx context.Context) error {
+		var err error
+		sourceRow, err = selectRow(ctx, w.source, table, table.KeyColumns, conflicting.KeyValues())
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if sourceRow != nil && genericEqualKeys(table.ValuesOfColumns(columns, sourceRow.Data), uniqueValues) {
+		// The source still has the conflicting row at this unique key so it's the row we're writing that is stale
+		return false, nil
+	}
+
+	logger.Infof("deleting stale row %v conflicting with %v", conflicting.KeyValues(), row.KeyValues())
+	err = Retry(ctx, w.retry, func(ctx context.Context) error {
+		return autotx.TransactWithOptions(ctx, w.db, &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+			err := w.deleteBatch(ctx, logger, tx, Batch{Type: Delete, Table: table, Rows: []*Row{conflicting}})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return w.writeBatchTx(ctx, logger, tx, batch)
+		})
+	})
+	if err != nil {
+		logger.WithError(err).Warnf("failed to delete stale conflicting row: %v", err)
+		return false, nil
+	}
+	w.speedLogger.Record(table.Name, len(batch.Rows), batch.SizeBytes())
+
+	if sourceRow != nil {
+		w.deferBatch(Batch{Type: Insert, Table: table, Rows: []*Row{sourceRow}})
+	}
+	return true, nil
+}
+
+func (w *Writer) deferBatch(batch Batch) {
+	w.deferredMutex.Lock()
+	defer w.deferredMutex.Unlock()
+	w.deferred = append(w.deferred, batch)
+}
+
+// writeDeferred writes the batches deferred due to unique key conflicts, it's called after all other batches of the
+// table have been written, conflicts at this point can't be deferred again. Deleting a stale conflicting row still
+// defers the re-insert of the source row so we keep going until nothing is left.
+func (w *Writer) writeDeferred(ctx context.Context) error {
+	for {
+		w.deferredMutex.Lock()
+		deferred := w.deferred
+		w.deferred = nil
+		w.deferredMutex.Unlock()
+		if len(deferred) == 0 {
+			return nil
+		}
+
+		for _, batch := range deferred {
+			err := w.writeBatch(ctx, batch)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return errors.WithStack(err)
+				}
+				err = w.resolveUniqueKeyConflict(ctx, batch, err, false)
+			}
+			if err != nil {
+				log.WithField("table", batch.Table.Name).WithError(err).
+					Warnf("failed to write deferred batch after retries and backoff, "+
+						"since this is a best effort clone we just give up: %+v", err)
+			}
+		}
+	}
+}
+
+// selectRow reads a single row by the values of the given (unique) columns, returns nil if there is no such row
+func selectRow(ctx context.Context, conn DBReader, table *Table, columns []string, values []interface{}) (*Row, error) {
+	clauses := make([]string, len(columns))
+	for i, column := range columns {
+		clauses[i] = fmt.Sprintf("`%s` = ?", column)
+	}
+	stmt := fmt.Sprintf("SELECT %s FROM `%s` WHERE %s", table.ColumnList, table.Name, strings.Join(clauses, " AND "))
+	rows, err := conn.QueryContext(ctx, stmt, values...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not execute: %s", stmt)
+	}
+	stream, err := newRowStream(table, rows)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer stream.Close()
+	return stream.Next()
+}
@@ -0,0 +1,376 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	mysqlschema "github.com/go-mysql-org/go-mysql/schema"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ConflictPolicyOff writes the replicated rows without looking at the target
+	ConflictPolicyOff = "off"
+	// ConflictPolicyOverwrite reports conflicts and writes the replicated rows anyway
+	ConflictPolicyOverwrite = "overwrite"
+	// ConflictPolicySkip reports conflicts and leaves the target rows as they are
+	ConflictPolicySkip = "skip"
+	// ConflictPolicyHalt stops replication at the first conflict
+	ConflictPolicyHalt = "halt"
+	// ConflictPolicyLog records conflicts in the conflict table and leaves the target rows as they are
+	ConflictPolicyLog = "log"
+)
+
+var (
+	targetConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_target_conflicts",
+			Help: "How many replicated rows didn't match the target row, partitioned by table, type (insert, update, delete) and the --conflict-policy applied",
+		},
+		[]string{"task", "table", "type", "policy"},
+	)
+	rowsVerified = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_rows_verified",
+			Help: "How many replicated rows have been verified against the target with --conflict-policy, partitioned by table",
+		},
+		[]string{"task", "table"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(targetConflicts)
+	prometheus.MustRegister(rowsVerified)
+}
+
+func (w *TransactionWriter) verifiesConflicts() bool {
+	return w.config.ConflictPolicy != "" && w.config.ConflictPolicy != ConflictPolicyOff
+}
+
+func (w *TransactionWriter) createConflictTable(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, w.config.WriteTimeout)
+	defer cancel()
+	stmt := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id          BIGINT       NOT NULL AUTO_INCREMENT,
+			task        VARCHAR(255) NOT NULL,
+			table_name  VARCHAR(255) NOT NULL,
+			type        VARCHAR(16)  NOT NULL,
+			before_row  JSON,
+			after_row   JSON,
+			target_row  JSON,
+			created_at  TIMESTAMP    NOT NULL,
+			PRIMARY KEY (id)
+		)
+		`, "`"+w.config.ConflictTable+"`")
+	_, err := w.target.ExecContext(timeoutCtx, stmt)
+	if err != nil {
+		return errors.Wrapf(err, "could not create conflict table in target database:\n%s", stmt)
+	}
+	return nil
+}
+
+// verify compares the rows of a mutation with the target rows before they are written with --conflict-policy and
+// returns the mutation with the rows that should be written. The before image of an update or delete has to match the
+// target row and an inserted row must not exist with other values. A target row that already matches the after image
+// is not a conflict since transactions are applied again after a restart from an earlier checkpoint.
+func (w *TransactionWriter) verify(ctx context.Context, tx DBWriter, m Mutation) (Mutation, error) {
+	switch m.Table.Name {
+	case w.config.HeartbeatTable, w.config.SnapshotRequestTable:
+		return m, nil
+	default:
+	}
+	// The target row is found by the primary key of the before image, it's the after image for inserts
+	keyRows := m.Rows
+	if m.Type == Update {
+		keyRows = m.Before
+	}
+	targetRows, err := readTargetRows(ctx, tx, m.Table, keyRows)
+	if err != nil {
+		return m, errors.WithStack(err)
+	}
+	rowsVerified.WithLabelValues(w.config.TaskName, m.Table.Name).Add(float64(len(m.Rows)))
+
+	result := m
+	result.Rows = make([][]interface{}, 0, len(m.Rows))
+	if m.Before != nil {
+		result.Before = make([][]interface{}, 0, len(m.Before))
+	}
+	for i, row := range m.Rows {
+		target := findTargetRow(m.Table, targetRows, keyRows[i])
+		var before []interface{}
+		if m.Type == Update {
+			before = m.Before[i]
+		}
+		conflicting, err := m.conflicts(before, row, target)
+		if err != nil {
+			return m, errors.WithStack(err)
+		}
+		if conflicting {
+			apply, err := w.handleConflict(ctx, tx, m, before, row, target)
+			if err != nil {
+				return m, errors.WithStack(err)
+			}
+			if !apply {
+				continue
+			}
+		}
+		result.Rows = append(result.Rows, row)
+		if m.Type == Update {
+			result.Before = append(result.Before, before)
+		}
+	}
+	return result, nil
+}
+
+// conflicts returns true if the target row doesn't match the replicated row, before is only set for updates and the
+// target row is nil if it's missing
+func (m *Mutation) conflicts(before []interface{}, row []interface{}, target []interface{}) (bool, error) {
+	switch m.Type {
+	case Insert, Delete:
+		if target == nil {
+			// A deleted row that is missing has already been deleted
+			return false, nil
+		}
+		matches, err := m.Table.imageMatches(row, m.ColumnsBitmap, target)
+		return !matches, errors.WithStack(err)
+	case Update:
+		if target == nil {
+			return true, nil
+		}
+		matches, err := m.Table.imageMatches(before, m.BeforeColumnsBitmap, target)
+		if err != nil || matches {
+			return false, errors.WithStack(err)
+		}
+		matches, err = m.Table.imageMatches(row, m.ColumnsBitmap, target)
+		return !matches, errors.WithStack(err)
+	default:
+		return false, nil
+	}
+}
+
+// imageMatches compares the columns of a row image (which can be partial) with the target row, ignored columns are not
+// compared
+func (t *Table) imageMatches(image []interface{}, bitmap []bool, target []interface{}) (bool, error) {
+	for i := range image {
+		if t.IgnoredColumnsBitmap[i] || (bitmap != nil && !bitmap[i]) {
+			continue
+		}
+		equals, err := columnEquals(t.MysqlTable.Columns[i], image[i], target[i])
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if !equals {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// columnEquals compares a value of a row image with the target value of the same column, temporal values are
+// compared as times since the binlog has them as strings (with the fraction of the column) while the target rows are
+// read as time.Time
+func columnEquals(column mysqlschema.TableColumn, value interface{}, target interface{}) (bool, error) {
+	switch column.Type {
+	case mysqlschema.TYPE_DATE, mysqlschema.TYPE_DATETIME, mysqlschema.TYPE_TIMESTAMP:
+	default:
+		return genericEquals(value, target)
+	}
+	if value == nil || target == nil {
+		return value == nil && target == nil, nil
+	}
+	valueTime, err := parseTemporal(value)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	targetTime, err := parseTemporal(target)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return valueTime.Equal(targetTime), nil
+}
+
+// parseTemporal parses a DATE, DATETIME or TIMESTAMP value, zero dates are parsed to the zero time like the driver does
+func parseTemporal(value interface{}) (time.Time, error) {
+	if value, ok := value.(time.Time); ok {
+		return value, nil
+	}
+	s, err := coerceString(value)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	if strings.HasPrefix(s, "0000-00-00") {
+		return time.Time{}, nil
+	}
+	layout := mysqlTimeFormat
+	if len(s) == len(mysqlDateFormat) {
+		layout = mysqlDateFormat
+	}
+	// Parsing accepts a fraction after the seconds even though the layout doesn't have one
+	parsed, err := time.Parse(layout, s)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	return parsed, nil
+}
+
+// handleConflict applies the --conflict-policy to a conflicting row and returns true if the row should be written
+func (w *TransactionWriter) handleConflict(ctx context.Context, tx DBWriter, m Mutation, before []interface{}, row []interface{}, target []interface{}) (bool, error) {
+	policy := w.config.ConflictPolicy
+	targetConflicts.WithLabelValues(w.config.TaskName, m.Table.Name, m.Type.String(), policy).Inc()
+	keys := m.Table.primaryKeyValues(row)
+	if m.Type == Update {
+		keys = m.Table.primaryKeyValues(before)
+	}
+	description := fmt.Sprintf("the %s of the row %v of %s doesn't match the target row", m.Type, keys, m.Table.Name)
+	if target == nil {
+		description = fmt.Sprintf("the row %v of %s updated on the source is missing from the target", keys, m.Table.Name)
+	}
+	logger := logrus.WithContext(ctx).WithField("task", "replicate")
+	switch policy {
+	case ConflictPolicyOverwrite:
+		logger.Warnf("%s, overwriting it", description)
+		return true, nil
+	case ConflictPolicySkip:
+		logger.Warnf("%s, skipping it", description)
+		return false, nil
+	case ConflictPolicyHalt:
+		// Retrying won't help so replication stops instead of restarting
+		return false, backoff.Permanent(errors.Errorf("%s, halting replication (--conflict-policy=halt)", description))
+	case ConflictPolicyLog:
+		err := w.logConflict(ctx, tx, m, before, row, target)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		logger.Warnf("%s, recorded it in %s", description, w.config.ConflictTable)
+		return false, nil
+	default:
+		return false, errors.Errorf("unknown conflict policy: %s", policy)
+	}
+}
+
+// logConflict records a conflict in the conflict table as JSON objects of the column values
+func (w *TransactionWriter) logConflict(ctx context.Context, tx DBWriter, m Mutation, before []interface{}, row []interface{}, target []interface{}) error {
+	var beforeImage, afterImage []interface{}
+	switch m.Type {
+	case Delete:
+		beforeImage = row
+	case Update:
+		beforeImage, afterImage = before, row
+	default:
+		afterImage = row
+	}
+	encode := func(image []interface{}, bitmap []bool) (interface{}, error) {
+		if image == nil {
+			return nil, nil
+		}
+		encoded, err := json.Marshal(encodeRows(m.Table, bitmap, [][]interface{}{image})[0])
+		return string(encoded), errors.WithStack(err)
+	}
+	beforeBitmap := m.BeforeColumnsBitmap
+	if m.Type == Delete {
+		beforeBitmap = m.ColumnsBitmap
+	}
+	beforeJSON, err := encode(beforeImage, beforeBitmap)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	afterJSON, err := encode(afterImage, m.ColumnsBitmap)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	targetJSON, err := encode(target, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (task, table_name, type, before_row, after_row, target_row, created_at) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?)", "`"+w.config.ConflictTable+"`"),
+		w.config.TaskName, m.Table.Name, m.Type.String(), beforeJSON, afterJSON, targetJSON, time.Now().UTC())
+	return errors.WithStack(err)
+}
+
+// primaryKeyValues returns the values of the primary key columns of a row
+func (t *Table) primaryKeyValues(row []interface{}) []interface{} {
+	keys := make([]interface{}, len(t.MysqlTable.PKColumns))
+	for i, index := range t.MysqlTable.PKColumns {
+		keys[i] = row[index]
+	}
+	return keys
+}
+
+// readTargetRows reads the target rows with the primary keys of the rows and locks them until the transaction ends
+func readTargetRows(ctx context.Context, tx DBWriter, table *Table, rows [][]interface{}) ([][]interface{}, error) {
+	tableSchema := table.MysqlTable
+	var stmt strings.Builder
+	args := make([]interface{}, 0, len(rows)*len(tableSchema.PKColumns))
+	stmt.WriteString("SELECT ")
+	stmt.WriteString(table.ColumnList)
+	stmt.WriteString(" FROM `")
+	stmt.WriteString(table.Name)
+	stmt.WriteString("` WHERE ")
+	for rowIdx, row := range rows {
+		if rowIdx > 0 {
+			stmt.WriteString(" OR ")
+		}
+		stmt.WriteString("(")
+		for i, pkIndex := range tableSchema.PKColumns {
+			if i > 0 {
+				stmt.WriteString(" AND ")
+			}
+			stmt.WriteString("`")
+			stmt.WriteString(tableSchema.Columns[pkIndex].Name)
+			stmt.WriteString("` = ?")
+			args = append(args, row[pkIndex])
+		}
+		stmt.WriteString(")")
+	}
+	stmt.WriteString(" FOR UPDATE")
+	stmtString := stmt.String()
+	result, err := tx.QueryContext(ctx, stmtString, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not execute: %s", stmtString)
+	}
+	stream, err := newRowStream(table, result)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer stream.Close()
+	var targetRows [][]interface{}
+	for {
+		row, err := stream.Next()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if row == nil {
+			break
+		}
+		targetRows = append(targetRows, row.Data)
+	}
+	return targetRows, errors.WithStack(result.Err())
+}
+
+// findTargetRow returns the target row with the primary key of the row or nil if there is none, the values are
+// compared with genericEquals since the types from the binlog and from the target differ
+func findTargetRow(table *Table, targetRows [][]interface{}, row []interface{}) []interface{} {
+	for _, target := range targetRows {
+		found := true
+		for _, pkIndex := range table.MysqlTable.PKColumns {
+			equals, err := genericEquals(row[pkIndex], target[pkIndex])
+			if err != nil || !equals {
+				found = false
+				break
+			}
+		}
+		if found {
+			return target
+		}
+	}
+	return nil
+}
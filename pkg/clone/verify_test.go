@@ -0,0 +1,243 @@
+package clone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	mysqlschema "github.com/go-mysql-org/go-mysql/schema"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflicts(t *testing.T) {
+	table := &Table{
+		Name:             "customers",
+		Columns:          []string{"id", "name", "bio"},
+		KeyColumnIndexes: []int{0},
+		MysqlTable: &mysqlschema.Table{
+			Name:      "customers",
+			PKColumns: []int{0},
+			Columns:   []mysqlschema.TableColumn{{Name: "id"}, {Name: "name"}, {Name: "bio"}},
+		},
+	}
+	table.IgnoredColumnsBitmap = ignoredColumnsBitmap(ReaderConfig{}, table.MysqlTable)
+
+	tests := []struct {
+		name        string
+		mutation    Mutation
+		before      []interface{}
+		row         []interface{}
+		target      []interface{}
+		conflicting bool
+	}{
+		{
+			name:     "insert of a missing row",
+			mutation: Mutation{Type: Insert},
+			row:      []interface{}{1, "one", "bio"},
+		},
+		{
+			name:     "insert of an already inserted row",
+			mutation: Mutation{Type: Insert},
+			row:      []interface{}{1, "one", "bio"},
+			target:   []interface{}{int64(1), []byte("one"), []byte("bio")},
+		},
+		{
+			name:        "insert of a row that exists with other values",
+			mutation:    Mutation{Type: Insert},
+			row:         []interface{}{1, "one", "bio"},
+			target:      []interface{}{int64(1), []byte("uno"), []byte("bio")},
+			conflicting: true,
+		},
+		{
+			name:     "update of a matching row",
+			mutation: Mutation{Type: Update},
+			before:   []interface{}{1, "one", "bio"},
+			row:      []interface{}{1, "uno", "bio"},
+			target:   []interface{}{int64(1), []byte("one"), []byte("bio")},
+		},
+		{
+			name:     "update of an already updated row",
+			mutation: Mutation{Type: Update},
+			before:   []interface{}{1, "one", "bio"},
+			row:      []interface{}{1, "uno", "bio"},
+			target:   []interface{}{int64(1), []byte("uno"), []byte("bio")},
+		},
+		{
+			name:        "update of a row modified on the target",
+			mutation:    Mutation{Type: Update},
+			before:      []interface{}{1, "one", "bio"},
+			row:         []interface{}{1, "uno", "bio"},
+			target:      []interface{}{int64(1), []byte("eins"), []byte("bio")},
+			conflicting: true,
+		},
+		{
+			name:        "update of a missing row",
+			mutation:    Mutation{Type: Update},
+			before:      []interface{}{1, "one", "bio"},
+			row:         []interface{}{1, "uno", "bio"},
+			conflicting: true,
+		},
+		{
+			name:     "partial update only compares the columns in the images",
+			mutation: Mutation{Type: Update, BeforeColumnsBitmap: []bool{true, false, false}, ColumnsBitmap: []bool{true, true, false}},
+			before:   []interface{}{1, nil, nil},
+			row:      []interface{}{1, "uno", nil},
+			target:   []interface{}{int64(1), []byte("eins"), []byte("bio")},
+		},
+		{
+			name:     "delete of a missing row",
+			mutation: Mutation{Type: Delete},
+			row:      []interface{}{1, "one", "bio"},
+		},
+		{
+			name:        "delete of a row modified on the target",
+			mutation:    Mutation{Type: Delete},
+			row:         []interface{}{1, "one", "bio"},
+			target:      []interface{}{int64(1), []byte("one"), []byte("other bio")},
+			conflicting: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.mutation.Table = table
+			conflicting, err := test.mutation.conflicts(test.before, test.row, test.target)
+			require.NoError(t, err)
+			assert.Equal(t, test.conflicting, conflicting)
+		})
+	}
+
+	targetRows := [][]interface{}{{int64(1), []byte("one"), nil}, {int64(2), []byte("two"), nil}}
+	assert.Equal(t, targetRows[1], findTargetRow(table, targetRows, []interface{}{2, "zwei", nil}))
+	assert.Nil(t, findTargetRow(table, targetRows, []interface{}{3, "three", nil}))
+}
+
+func TestConflictsOfTypedColumns(t *testing.T) {
+	table := &Table{
+		Name:             "accounts",
+		Columns:          []string{"id", "opened", "updated_at", "balance"},
+		KeyColumnIndexes: []int{0},
+		MysqlTable: &mysqlschema.Table{
+			Name:      "accounts",
+			PKColumns: []int{0},
+			Columns: []mysqlschema.TableColumn{
+				{Name: "id", Type: mysqlschema.TYPE_NUMBER},
+				{Name: "opened", Type: mysqlschema.TYPE_DATE},
+				{Name: "updated_at", Type: mysqlschema.TYPE_DATETIME},
+				{Name: "balance", Type: mysqlschema.TYPE_DECIMAL},
+			},
+		},
+	}
+	table.IgnoredColumnsBitmap = ignoredColumnsBitmap(ReaderConfig{}, table.MysqlTable)
+	opened := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+
+	// The binlog has temporal and decimal values as strings, the target rows are read with parseTime=true
+	tests := []struct {
+		name        string
+		before      []interface{}
+		target      []interface{}
+		conflicting bool
+	}{
+		{
+			name:   "matching row",
+			before: []interface{}{int64(1), "2024-01-01", "2024-01-02 03:04:05.123456", "12.50"},
+			target: []interface{}{int64(1), opened, updatedAt, []byte("12.50")},
+		},
+		{
+			name:        "date modified on the target",
+			before:      []interface{}{int64(1), "2024-01-01", "2024-01-02 03:04:05.123456", "12.50"},
+			target:      []interface{}{int64(1), opened.AddDate(0, 0, 1), updatedAt, []byte("12.50")},
+			conflicting: true,
+		},
+		{
+			name:        "fraction modified on the target",
+			before:      []interface{}{int64(1), "2024-01-01", "2024-01-02 03:04:05.123456", "12.50"},
+			target:      []interface{}{int64(1), opened, updatedAt.Add(time.Microsecond), []byte("12.50")},
+			conflicting: true,
+		},
+		{
+			name:        "decimal modified on the target",
+			before:      []interface{}{int64(1), "2024-01-01", "2024-01-02 03:04:05.123456", "12.50"},
+			target:      []interface{}{int64(1), opened, updatedAt, []byte("12.51")},
+			conflicting: true,
+		},
+		{
+			name:   "zero dates",
+			before: []interface{}{int64(1), "0000-00-00", "0000-00-00 00:00:00.000000", "0.00"},
+			target: []interface{}{int64(1), time.Time{}, time.Time{}, []byte("0.00")},
+		},
+		{
+			name:   "null values",
+			before: []interface{}{int64(1), nil, nil, nil},
+			target: []interface{}{int64(1), nil, nil, nil},
+		},
+		{
+			name:        "null value set on the target",
+			before:      []interface{}{int64(1), nil, "2024-01-02 03:04:05.123456", "12.50"},
+			target:      []interface{}{int64(1), opened, updatedAt, []byte("12.50")},
+			conflicting: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mutation := Mutation{Type: Update, Table: table}
+			row := []interface{}{int64(1), "2025-01-01", "2025-01-01 00:00:00.000000", "0.00"}
+			conflicting, err := mutation.conflicts(test.before, row, test.target)
+			require.NoError(t, err)
+			assert.Equal(t, test.conflicting, conflicting)
+		})
+	}
+}
+
+func TestHandleConflict(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	table := &Table{
+		Name:             "customers",
+		Columns:          []string{"id", "name"},
+		ColumnList:       "`id`,`name`",
+		KeyColumnIndexes: []int{0},
+		MysqlTable: &mysqlschema.Table{
+			Name:      "customers",
+			PKColumns: []int{0},
+			Columns:   []mysqlschema.TableColumn{{Name: "id"}, {Name: "name"}},
+		},
+	}
+	table.IgnoredColumnsBitmap = ignoredColumnsBitmap(ReaderConfig{}, table.MysqlTable)
+	mutation := Mutation{Type: Update, Table: table}
+	before := []interface{}{1, "one"}
+	row := []interface{}{1, "uno"}
+	target := []interface{}{int64(1), []byte("eins")}
+
+	writer := &TransactionWriter{config: Replicate{TaskName: "test", ConflictTable: "_cloner_conflict"}}
+	for policy, apply := range map[string]bool{ConflictPolicyOverwrite: true, ConflictPolicySkip: false} {
+		writer.config.ConflictPolicy = policy
+		applied, err := writer.handleConflict(context.Background(), NewMockDBWriter(ctrl), mutation, before, row, target)
+		require.NoError(t, err)
+		assert.Equal(t, apply, applied, policy)
+	}
+
+	// Halting isn't retried
+	writer.config.ConflictPolicy = ConflictPolicyHalt
+	_, err := writer.handleConflict(context.Background(), NewMockDBWriter(ctrl), mutation, before, row, target)
+	var permanent *backoff.PermanentError
+	assert.ErrorAs(t, err, &permanent)
+
+	writer.config.ConflictPolicy = ConflictPolicyLog
+	db := NewMockDBWriter(ctrl)
+	db.EXPECT().ExecContext(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(func(ctx context.Context, query string, values ...interface{}) {
+			assert.Equal(t, "INSERT INTO `_cloner_conflict` (task, table_name, type, before_row, after_row, target_row, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)", query)
+			assert.Equal(t, []interface{}{"test", "customers", "update"}, values[:3])
+			assert.JSONEq(t, `{"id":1,"name":"one"}`, values[3].(string))
+			assert.JSONEq(t, `{"id":1,"name":"uno"}`, values[4].(string))
+			assert.JSONEq(t, `{"id":1,"name":"eins"}`, values[5].(string))
+		})
+	applied, err := writer.handleConflict(context.Background(), db, mutation, before, row, target)
+	require.NoError(t, err)
+	assert.False(t, applied)
+}
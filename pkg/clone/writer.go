@@ -283,6 +283,11 @@ func (w *Writer) scheduleWriteBatch(ctx context.Context, g *errgroup.Group, batc
 				return nil
 			}
 
+			err = w.resolveUniqueKeyConflict(ctx, batch, err, true)
+			if err == nil {
+				return nil
+			}
+
 			if isConstraintViolation(err) {
 				constraintViolationErrors.WithLabelValues(batch.Table.Name, batch.Type.String()).Inc()
 			}
@@ -401,6 +406,11 @@ func splitBatch(batch Batch) (Batch, Batch) {
 func (w *Writer) writeBatch(ctx context.Context, batch Batch) (err error) {
 	logger := log.WithField("task", "writer").WithField("table", batch.Table.Name)
 
+	err = w.retry.Throttle.Wait(ctx, batch.Table, len(batch.Rows), batch.SizeBytes())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	retry := w.retry
 	timout := batch.Table.Config.WriteTimout.Duration
 	if timout != 0 {
@@ -427,21 +437,7 @@ func (w *Writer) writeBatch(ctx context.Context, batch Batch) (err error) {
 				}
 			}()
 
-			if w.config.NoDiff {
-				err = w.replaceBatch(ctx, logger, tx, batch)
-			} else {
-				switch batch.Type {
-				case Insert:
-					err = w.insertBatch(ctx, logger, tx, batch)
-				case Delete:
-					err = w.deleteBatch(ctx, logger, tx, batch)
-				case Update:
-					err = w.updateBatch(ctx, logger, tx, batch)
-				default:
-					logger.Panicf("Unknown batch type %s", batch.Type)
-					return nil
-				}
-			}
+			err = w.writeBatchTx(ctx, logger, tx, batch)
 			return err
 		})
 
@@ -467,6 +463,24 @@ func (w *Writer) writeBatch(ctx context.Context, batch Batch) (err error) {
 	return errors.WithStack(err)
 }
 
+// writeBatchTx writes the batch inside the transaction without retries
+func (w *Writer) writeBatchTx(ctx context.Context, logger *log.Entry, tx *sql.Tx, batch Batch) error {
+	if w.config.NoDiff {
+		return w.replaceBatch(ctx, logger, tx, batch)
+	}
+	switch batch.Type {
+	case Insert:
+		return w.insertBatch(ctx, logger, tx, batch)
+	case Delete:
+		return w.deleteBatch(ctx, logger, tx, batch)
+	case Update:
+		return w.updateBatch(ctx, logger, tx, batch)
+	default:
+		logger.Panicf("Unknown batch type %s", batch.Type)
+		return nil
+	}
+}
+
 func (w *Writer) deleteBatch(ctx context.Context, logger *log.Entry, tx *sql.Tx, batch Batch) error {
 	logger = logger.WithField("op", "delete")
 	rows := batch.Rows
@@ -660,22 +674,32 @@ type Writer struct {
 	db    *sql.DB
 	retry RetryOptions
 
+	// source is used to check if rows conflicting on unique keys are stale
+	source *sql.DB
+
 	speedLogger *ThroughputLogger
 
 	writerParallelism *semaphore.Weighted
+
+	deferredMutex sync.Mutex
+	// deferred holds the batches that failed on unique key conflicts and are retried after all other batches
+	deferred []Batch
 }
 
-func NewWriter(config WriterConfig, table *Table, writer *sql.DB, speedLogger *ThroughputLogger, limiter core.Limiter) *Writer {
+func NewWriter(config WriterConfig, table *Table, writer *sql.DB, source *sql.DB, speedLogger *ThroughputLogger, limiter core.Limiter) *Writer {
 	return &Writer{
 		config:      config,
 		table:       table,
 		db:          writer,
+		source:      source,
 		speedLogger: speedLogger,
 		retry: RetryOptions{
 			Limiter:       limiter,
 			AcquireMetric: writeLimiterDelay,
 			MaxRetries:    config.WriteRetries,
 			Timeout:       config.WriteTimeout,
+			Throttle:      config.Throttles.get(WriteThrottle),
+			Health:        config.Health,
 		},
 		writerParallelism: semaphore.NewWeighted(config.WriterParallelism),
 	}
@@ -696,7 +720,8 @@ func (w *Writer) Write(ctx context.Context, g *errgroup.Group, diffs chan Diff)
 
 	// Write every batch
 	g.Go(func() error {
-		g, ctx := errgroup.WithContext(ctx)
+		// The batch group's context is canceled once it's waited on so deferred batches are written with ours
+		wg, wctx := errgroup.WithContext(ctx)
 		inserts := 0
 		deletes := 0
 		updates := 0
@@ -712,12 +737,16 @@ func (w *Writer) Write(ctx context.Context, g *errgroup.Group, diffs chan Diff)
 			case Repair:
 				panic("not supported here")
 			}
-			err := w.scheduleWriteBatch(ctx, g, batch)
+			err := w.scheduleWriteBatch(wctx, wg, batch)
 			if err != nil {
 				return errors.WithStack(err)
 			}
 		}
-		err := g.Wait()
+		err := wg.Wait()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = w.writeDeferred(ctx)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -1,9 +1,19 @@
 package clone
 
 import (
+	"context"
+	"database/sql"
 	"testing"
+	"time"
 
+	"github.com/alecthomas/kong"
+	mysqlschema "github.com/go-mysql-org/go-mysql/schema"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 func TestSplitBatch(t *testing.T) {
@@ -48,3 +58,186 @@ func TestSplitBatch(t *testing.T) {
 		},
 	})
 }
+
+func TestUniqueKeyConflict(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		indexName string
+		conflict  bool
+	}{
+		{
+			name:      "mysql 5.7",
+			err:       &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'foo@example.com' for key 'email'"},
+			indexName: "email",
+			conflict:  true,
+		},
+		{
+			name:      "mysql 8 prefixes the table name",
+			err:       errors.WithStack(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'foo' for key 'customers.email'"}),
+			indexName: "email",
+			conflict:  true,
+		},
+		{
+			name:     "primary key",
+			err:      &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'customers.PRIMARY'"},
+			conflict: false,
+		},
+		{
+			name:     "other error",
+			err:      &mysql.MySQLError{Number: 1146, Message: "Table 'customers' doesn't exist"},
+			conflict: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indexName, conflict := uniqueKeyConflict(test.err)
+			assert.Equal(t, test.conflict, conflict)
+			assert.Equal(t, test.indexName, indexName)
+		})
+	}
+}
+
+func TestUniqueKeyColumns(t *testing.T) {
+	table := &Table{
+		Name:    "customers",
+		Columns: []string{"id", "email", "name"},
+		MysqlTable: &mysqlschema.Table{
+			Indexes: []*mysqlschema.Index{
+				{Name: "PRIMARY", Columns: []string{"id"}},
+				{Name: "email", Columns: []string{"email"}},
+				{Name: "name", Columns: []string{"name"}, NoneUnique: 1},
+			},
+		},
+	}
+	columns, ok := table.UniqueKeyColumns("email")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"email"}, columns)
+	assert.Equal(t, []interface{}{"foo@example.com"},
+		table.ValuesOfColumns(columns, []interface{}{1, "foo@example.com", "Foo"}))
+
+	_, ok = table.UniqueKeyColumns("name")
+	assert.False(t, ok)
+	_, ok = table.UniqueKeyColumns("PRIMARY")
+	assert.False(t, ok)
+}
+
+// setupUniqueKeyConflict creates an accounts table with a unique email in the target database and in a source database
+// on the same server, target has (1, a) and (2, b)
+func setupUniqueKeyConflict(t *testing.T, sourceRows [][]interface{}) (*sql.DB, *sql.DB, *Table) {
+	err := startTidb()
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	targetConfig := tidbContainer.Config()
+	target, err := targetConfig.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { target.Close() })
+	_, err = target.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS unique_source")
+	require.NoError(t, err)
+	sourceConfig := targetConfig
+	sourceConfig.Database = "unique_source"
+	source, err := sourceConfig.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { source.Close() })
+
+	for db, rows := range map[*sql.DB][][]interface{}{target: {{int64(1), "a"}, {int64(2), "b"}}, source: sourceRows} {
+		_, err = db.ExecContext(ctx, "DROP TABLE IF EXISTS accounts")
+		require.NoError(t, err)
+		_, err = db.ExecContext(ctx, `
+			CREATE TABLE accounts (
+				id    BIGINT(20)   NOT NULL,
+				email VARCHAR(255) NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY email (email)
+			)`)
+		require.NoError(t, err)
+		for _, row := range rows {
+			_, err = db.ExecContext(ctx, "INSERT INTO accounts (id, email) VALUES (?, ?)", row...)
+			require.NoError(t, err)
+		}
+	}
+
+	table, err := loadTable(ctx, ReaderConfig{}, targetConfig.Type, target, targetConfig.Database, "accounts", TableConfig{})
+	require.NoError(t, err)
+	return source, target, table
+}
+
+func newUniqueKeyConflictWriter(t *testing.T, policy string, table *Table, source *sql.DB, target *sql.DB) *Writer {
+	var config WriterConfig
+	err := kong.ApplyDefaults(&config)
+	require.NoError(t, err)
+	config.UniqueKeyConflictPolicy = policy
+	config.WriteRetries = 1
+	return NewWriter(config, table, target, source, NewThroughputLogger("write", time.Minute, 0), nil)
+}
+
+func readAccounts(t *testing.T, db *sql.DB) map[int64]string {
+	rows, err := db.Query("SELECT id, email FROM accounts")
+	require.NoError(t, err)
+	defer rows.Close()
+	accounts := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var email string
+		require.NoError(t, rows.Scan(&id, &email))
+		accounts[id] = email
+	}
+	require.NoError(t, rows.Err())
+	return accounts
+}
+
+func TestUniqueKeyConflictDelete(t *testing.T) {
+	// The source has swapped the emails
+	source, target, table := setupUniqueKeyConflict(t, [][]interface{}{{int64(1), "b"}, {int64(2), "a"}})
+	w := newUniqueKeyConflictWriter(t, UniqueKeyConflictDelete, table, source, target)
+	ctx := context.Background()
+
+	// A deferred update that deletes the stale row still re-inserts it from the source
+	w.deferBatch(Batch{Type: Update, Table: table, Rows: []*Row{table.ToRow([]interface{}{int64(1), "b"})}})
+	err := w.writeDeferred(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, w.deferred)
+	assert.Equal(t, map[int64]string{1: "b", 2: "a"}, readAccounts(t, target))
+}
+
+func TestUniqueKeyConflictDefer(t *testing.T) {
+	// The source has moved account 1 to another email and inserted account 3 with its old email
+	source, target, table := setupUniqueKeyConflict(t, [][]interface{}{{int64(1), "c"}, {int64(2), "b"}, {int64(3), "a"}})
+	w := newUniqueKeyConflictWriter(t, UniqueKeyConflictDefer, table, source, target)
+	ctx := context.Background()
+
+	insert := Batch{Type: Insert, Table: table, Rows: []*Row{table.ToRow([]interface{}{int64(3), "a"})}}
+	err := w.writeBatch(ctx, insert)
+	require.Error(t, err)
+	err = w.resolveUniqueKeyConflict(ctx, insert, err, true)
+	require.NoError(t, err)
+	assert.Len(t, w.deferred, 1)
+
+	err = w.writeBatch(ctx, Batch{Type: Update, Table: table, Rows: []*Row{table.ToRow([]interface{}{int64(1), "c"})}})
+	require.NoError(t, err)
+	err = w.writeDeferred(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int64]string{1: "c", 2: "b", 3: "a"}, readAccounts(t, target))
+}
+
+func TestUniqueKeyConflictDeferThroughWrite(t *testing.T) {
+	// The source has moved account 1 to another email and inserted account 3 with its old email
+	source, target, table := setupUniqueKeyConflict(t, [][]interface{}{{int64(1), "c"}, {int64(2), "b"}, {int64(3), "a"}})
+	table.Config.WriteBatchSize = 1
+	w := newUniqueKeyConflictWriter(t, UniqueKeyConflictDefer, table, source, target)
+	// Write one batch at a time so the insert conflicts and is deferred until after the update
+	w.writerParallelism = semaphore.NewWeighted(1)
+
+	diffs := make(chan Diff, 2)
+	diffs <- Diff{Type: Insert, Row: table.ToRow([]interface{}{int64(3), "a"})}
+	diffs <- Diff{Type: Update, Row: table.ToRow([]interface{}{int64(1), "c"})}
+	close(diffs)
+
+	g, ctx := errgroup.WithContext(context.Background())
+	w.Write(ctx, g, diffs)
+	err := g.Wait()
+	require.NoError(t, err)
+	assert.Empty(t, w.deferred)
+	assert.Equal(t, map[int64]string{1: "c", 2: "b", 3: "a"}, readAccounts(t, target))
+}